@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-pluto/maildir_tools/collect"
+	"github.com/oklog/oklog/pkg/group"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// Metrics aggregates all metrics we expose
+// to Prometheus for insights into the collector.
+type Metrics struct {
+	received   *prometheus.CounterVec
+	duplicates *prometheus.CounterVec
+}
+
+// initLogger initializes a JSON gokit-logger set
+// to the according log level supplied via CLI flag.
+func initLogger(loglevel string) log.Logger {
+
+	logger := log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
+	logger = log.With(logger,
+		"ts", log.DefaultTimestampUTC,
+		"caller", log.Caller(5),
+	)
+
+	switch strings.ToLower(loglevel) {
+	case "info":
+		logger = level.NewFilter(logger, level.AllowInfo())
+	case "warn":
+		logger = level.NewFilter(logger, level.AllowWarn())
+	case "error":
+		logger = level.NewFilter(logger, level.AllowError())
+	default:
+		logger = level.NewFilter(logger, level.AllowDebug())
+	}
+
+	return logger
+}
+
+// createMetrics initializes and registers all
+// Prometheus-exposed metrics.
+func createMetrics() *Metrics {
+
+	received := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maildir_collector_dumps_received_total",
+		Help: "Number of dumps received and stored",
+	}, []string{"worker"})
+
+	duplicates := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maildir_collector_dumps_duplicate_total",
+		Help: "Number of dumps received that had already been stored",
+	}, []string{"worker"})
+
+	// Register all of them with Prometheus.
+	prometheus.MustRegister(received)
+	prometheus.MustRegister(duplicates)
+
+	return &Metrics{
+		received:   received,
+		duplicates: duplicates,
+	}
+}
+
+func main() {
+	grpcAddrFlag := flag.String("grpcAddr", ":9276", "Address to receive dumps from dumpers on via gRPC.")
+	httpAddrFlag := flag.String("httpAddr", ":9277", "Address to serve stored runs and /metrics on via HTTP.")
+	dataDirFlag := flag.String("dataDir", "runs", "Specify path to directory to store all received dumps in.")
+	logLevel := flag.String("logLevel", "", "Set verbosity level of logging.")
+	flag.Parse()
+
+	// Create gokit-logger based on specified verbosity level.
+	logger := initLogger(*logLevel)
+
+	// Create metrics struct.
+	metrics := createMetrics()
+
+	store, err := NewStore(*dataDirFlag)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to create data dir", "path", *dataDirFlag, "err", err)
+		os.Exit(1)
+	}
+
+	collector := &Collector{
+		logger:  logger,
+		store:   store,
+		metrics: metrics,
+	}
+
+	var g group.Group
+	{
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "waiting for interrupt signal")
+			sig := <-stop
+			level.Debug(logger).Log("msg", "received sig", "signal", sig)
+			return nil
+		}, func(error) {})
+	}
+	{
+		ln, err := net.Listen("tcp", *grpcAddrFlag)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to listen for gRPC", "addr", *grpcAddrFlag, "err", err)
+			os.Exit(1)
+		}
+
+		server := grpc.NewServer(grpc.CustomCodec(collect.Codec{}))
+		collect.RegisterCollectorServer(server, collector)
+
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "collector now listens for gRPC streams", "addr", *grpcAddrFlag)
+			return server.Serve(ln)
+		}, func(error) {
+			level.Info(logger).Log("msg", "shutting down gRPC server")
+			server.GracefulStop()
+		})
+	}
+	{
+		http.Handle("/metrics", promhttp.Handler())
+		collector.Register(http.DefaultServeMux)
+		server := &http.Server{Addr: *httpAddrFlag}
+
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "collector now listens for http requests", "addr", *httpAddrFlag)
+
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		}, func(error) {
+			level.Info(logger).Log("msg", "shutting down http server")
+			server.Shutdown(context.Background())
+		})
+	}
+
+	if err := g.Run(); err != nil {
+		level.Error(logger).Log(
+			"msg", "failed to run group",
+			"err", err,
+		)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-pluto/maildir_tools/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Collector receives dumps streamed by dumpers
+// and serves the stored runs via HTTP.
+type Collector struct {
+	logger  log.Logger
+	store   *Store
+	metrics *Metrics
+}
+
+// Push stores every dump received on stream and
+// acknowledges each batch once it is persisted,
+// listing the dumps refused in the ack.
+func (c *Collector) Push(stream collect.Collector_PushServer) error {
+
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Invalid names will never be stored. All dumps of a
+		// batch share its worker and run, so the batch is
+		// refused as a whole if either is invalid, telling
+		// the dumper not to send it again; dumps of invalid
+		// name are refused on their own.
+		for _, n := range []string{batch.Worker, batch.Run} {
+			if !collect.ValidName(n) {
+				level.Warn(c.logger).Log(
+					"msg", "rejecting batch with invalid name",
+					"worker", batch.Worker,
+					"run", batch.Run,
+					"name", n,
+				)
+				return status.Errorf(codes.InvalidArgument, "invalid name %q", n)
+			}
+		}
+
+		ack := &collect.Ack{}
+		for _, dump := range batch.Dumps {
+
+			ack.Seq = dump.Seq
+
+			if !collect.ValidName(dump.Name) {
+				level.Warn(c.logger).Log(
+					"msg", "rejecting dump with invalid name",
+					"worker", batch.Worker,
+					"run", batch.Run,
+					"name", dump.Name,
+				)
+				ack.Rejected = append(ack.Rejected, dump.Seq)
+				continue
+			}
+
+			dup, err := c.store.Save(batch.Worker, batch.Run, dump.Name, dump.Data)
+			if err != nil {
+				level.Error(c.logger).Log(
+					"msg", "failed to store dump",
+					"worker", batch.Worker,
+					"run", batch.Run,
+					"dump", dump.Name,
+					"err", err,
+				)
+				return err
+			}
+
+			if dup {
+				c.metrics.duplicates.With(prometheus.Labels{"worker": batch.Worker}).Inc()
+			} else {
+				c.metrics.received.With(prometheus.Labels{"worker": batch.Worker}).Inc()
+			}
+		}
+
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// Register attaches the HTTP endpoints to mux:
+// /runs lists all runs as JSON and /runs/<archive>
+// serves the zip archive of a single run.
+func (c *Collector) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/runs", c.handleRuns)
+	mux.HandleFunc("/runs/", c.handleArchive)
+}
+
+func (c *Collector) handleRuns(w http.ResponseWriter, r *http.Request) {
+
+	runs, err := c.store.Runs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func (c *Collector) handleArchive(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/runs/")
+
+	runs, err := c.store.Runs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, run := range runs {
+
+		if run.Archive() != name {
+			continue
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		if err := c.store.WriteZip(w, run.Worker, run.Run); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to serve run", "archive", name, "err", err)
+		}
+		return
+	}
+
+	http.NotFound(w, r)
+}
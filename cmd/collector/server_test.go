@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-pluto/maildir_tools/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
+)
+
+func init() {
+	// Restarting servers makes gRPC log a lot.
+	grpclog.SetLogger(stdlog.New(ioutil.Discard, "", 0))
+}
+
+// newTestCollector returns a Collector storing into
+// a temporary directory, removed by the returned func.
+func newTestCollector(t *testing.T) (*Collector, func()) {
+
+	dir, err := ioutil.TempDir("", "collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not registered, as every test creates its own.
+	metrics := &Metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "received",
+		}, []string{"worker"}),
+		duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duplicates",
+		}, []string{"worker"}),
+	}
+
+	return &Collector{
+		logger:  log.NewNopLogger(),
+		store:   store,
+		metrics: metrics,
+	}, func() { os.RemoveAll(dir) }
+}
+
+// serve starts a gRPC server for c listening on addr.
+func serve(t *testing.T, c *Collector, addr string) (*grpc.Server, string) {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(grpc.CustomCodec(collect.Codec{}))
+	collect.RegisterCollectorServer(server, c)
+	go server.Serve(ln)
+
+	return server, ln.Addr().String()
+}
+
+// push queues n dumps named after the
+// seconds from first on at client.
+func push(client *collect.Client, first int, n int) {
+	for i := first; i < first+n; i++ {
+		client.Push(fmt.Sprintf("%d", i), []byte(fmt.Sprintf("dump %d\n", i)))
+	}
+}
+
+// waitFlushed waits for all dumps pushed
+// to client to be acknowledged.
+func waitFlushed(t *testing.T, client *collect.Client) {
+
+	deadline := time.Now().Add(10 * time.Second)
+	for client.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dumps still pending", client.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stored returns the number of dumps stored for worker and run.
+func stored(t *testing.T, c *Collector, worker string, run string) int {
+
+	runs, err := c.store.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range runs {
+		if r.Worker == worker && r.Run == run {
+			return r.Dumps
+		}
+	}
+
+	return 0
+}
+
+func TestPushAcrossRestart(t *testing.T) {
+
+	c, cleanup := newTestCollector(t)
+	defer cleanup()
+
+	server, addr := serve(t, c, "127.0.0.1:0")
+
+	client := collect.NewClient(log.NewNopLogger(), addr, "worker-1", "run-1", 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	push(client, 0, 150)
+	waitFlushed(t, client)
+
+	// Dumps taken while the collector is
+	// away are delivered after its restart.
+	server.Stop()
+	push(client, 150, 150)
+
+	server, _ = serve(t, c, addr)
+	defer server.Stop()
+
+	waitFlushed(t, client)
+
+	push(client, 300, 10)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := stored(t, c, "worker-1", "run-1"); n != 310 {
+		t.Errorf("expected 310 dumps stored, got %d", n)
+	}
+	if n := client.Pending(); n != 0 {
+		t.Errorf("expected no dumps pending after shutdown, got %d", n)
+	}
+	if n := client.Dropped(); n != 0 {
+		t.Errorf("expected no dumps dropped, got %d", n)
+	}
+}
+
+func TestPushFlushesOnShutdown(t *testing.T) {
+
+	c, cleanup := newTestCollector(t)
+	defer cleanup()
+
+	server, addr := serve(t, c, "127.0.0.1:0")
+	defer server.Stop()
+
+	client := collect.NewClient(log.NewNopLogger(), addr, "worker-1", "run-1", 1000)
+
+	// Shut down before even connecting.
+	ctx, cancel := context.WithCancel(context.Background())
+	push(client, 0, 250)
+	cancel()
+
+	if err := client.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := stored(t, c, "worker-1", "run-1"); n != 250 {
+		t.Errorf("expected 250 dumps stored, got %d", n)
+	}
+}
+
+func TestPushRejectsInvalidNames(t *testing.T) {
+
+	c, cleanup := newTestCollector(t)
+	defer cleanup()
+
+	server, addr := serve(t, c, "127.0.0.1:0")
+	defer server.Stop()
+
+	// pushAll pushes the dumps named by push and
+	// the extra ones given and waits for them.
+	pushAll := func(client *collect.Client, extra ...string) {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- client.Run(ctx)
+		}()
+
+		push(client, 0, 10)
+		for _, name := range extra {
+			client.Push(name, []byte("dump\n"))
+		}
+		push(client, 10, 10)
+
+		waitFlushed(t, client)
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dump of invalid name is refused on its own,
+	// the rest of its batch stored.
+	client := collect.NewClient(log.NewNopLogger(), addr, "worker-1", "run-1", 1000)
+	pushAll(client, "../escape")
+
+	if n := client.Rejected(); n != 1 {
+		t.Errorf("expected 1 dump rejected, got %d", n)
+	}
+	if n := stored(t, c, "worker-1", "run-1"); n != 20 {
+		t.Errorf("expected 20 dumps stored, got %d", n)
+	}
+
+	// An invalid run refuses all dumps.
+	client = collect.NewClient(log.NewNopLogger(), addr, "worker-1", "../run", 1000)
+	pushAll(client)
+
+	if n := client.Rejected(); n != 20 {
+		t.Errorf("expected 20 dumps rejected, got %d", n)
+	}
+	if n := client.Pending(); n != 0 {
+		t.Errorf("expected no dumps pending, got %d", n)
+	}
+
+	runs, err := c.store.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Errorf("expected only run-1 stored, got %+v", runs)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-pluto/maildir_tools/collect"
+)
+
+// Run describes all dumps stored for one run of a worker.
+type Run struct {
+	Worker string `json:"worker"`
+	Run    string `json:"run"`
+	Dumps  int    `json:"dumps"`
+	First  string `json:"first"`
+	Last   string `json:"last"`
+}
+
+// Archive returns the name the run is served
+// under, following the dumper's GCS uploads.
+func (r Run) Archive() string {
+	return fmt.Sprintf("%s-%s.zip", r.Run, r.Worker)
+}
+
+// Store keeps the dumps of every run in a directory
+// <dir>/<worker>/<run>/ in the format the dumper
+// writes them to its local disk.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewStore creates dir if it does not exist yet.
+func NewStore(dir string) (*Store, error) {
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		dir: dir,
+	}, nil
+}
+
+// Save stores a dump unless one of the same name already
+// exists for worker and run. It reports whether the dump
+// was a duplicate, as resent after a reconnect.
+func (s *Store) Save(worker string, run string, name string, data []byte) (bool, error) {
+
+	for _, n := range []string{worker, run, name} {
+		if !collect.ValidName(n) {
+			return false, fmt.Errorf("invalid name %q", n)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, worker, run)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return false, err
+	}
+
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return true, nil
+	}
+
+	// Write to a temporary file first so that
+	// readers never see a partial dump.
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return false, err
+	}
+
+	return false, os.Rename(tmp, path)
+}
+
+// Runs lists all stored runs.
+func (s *Store) Runs() ([]Run, error) {
+
+	workers, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []Run{}
+
+	for _, worker := range workers {
+
+		if !worker.IsDir() {
+			continue
+		}
+
+		ids, err := ioutil.ReadDir(filepath.Join(s.dir, worker.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+
+			if !id.IsDir() {
+				continue
+			}
+
+			dumps, err := s.dumps(worker.Name(), id.Name())
+			if err != nil {
+				return nil, err
+			}
+
+			run := Run{
+				Worker: worker.Name(),
+				Run:    id.Name(),
+				Dumps:  len(dumps),
+			}
+
+			if len(dumps) > 0 {
+				run.First = dumps[0]
+				run.Last = dumps[len(dumps)-1]
+			}
+
+			runs = append(runs, run)
+		}
+	}
+
+	return runs, nil
+}
+
+// dumps returns the names of all complete dumps of a run.
+func (s *Store) dumps(worker string, run string) ([]string, error) {
+
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, worker, run))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && collect.ValidName(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// WriteZip writes all dumps of a run as zip archive to w.
+func (s *Store) WriteZip(w io.Writer, worker string, run string) error {
+
+	dumps, err := s.dumps(worker, run)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+
+	for _, name := range dumps {
+
+		f, err := os.Open(filepath.Join(s.dir, worker, run, name))
+		if err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		header.Method = zip.Deflate
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		_, err = io.Copy(fw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
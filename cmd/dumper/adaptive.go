@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Modes of adapting the sampling rate.
+const (
+	adaptiveOff    = "off"
+	adaptiveGlobal = "global"
+	adaptiveUser   = "user"
+)
+
+// Adaptive decides which users are due for sampling.
+// Every interval is a power-of-two multiple of the
+// minimum interval: it is reset to the minimum as soon
+// as a size changes and doubled, up to the maximum,
+// after a number of runs without change. In global
+// mode all users share one interval, in user mode each
+// user has its own.
+type Adaptive struct {
+	mode       string
+	min        time.Duration
+	max        time.Duration
+	stableRuns int
+
+	mu     sync.Mutex
+	states map[string]*adaptiveState
+	sizes  map[string]int64
+}
+
+type adaptiveState struct {
+	interval time.Duration
+	next     time.Time
+	stable   int
+}
+
+// NewAdaptive validates mode and bounds.
+func NewAdaptive(mode string, min time.Duration, max time.Duration, stableRuns int) (*Adaptive, error) {
+
+	switch mode {
+	case adaptiveOff, adaptiveGlobal, adaptiveUser:
+	default:
+		return nil, fmt.Errorf("unknown adaptive mode %q", mode)
+	}
+
+	if min < time.Millisecond {
+		return nil, fmt.Errorf("minimum interval must be at least 1ms, got %s", min)
+	}
+
+	if max < min {
+		return nil, fmt.Errorf("maximum interval %s is below minimum interval %s", max, min)
+	}
+
+	if stableRuns < 1 {
+		stableRuns = 1
+	}
+
+	return &Adaptive{
+		mode:       mode,
+		min:        min,
+		max:        max,
+		stableRuns: stableRuns,
+		states:     make(map[string]*adaptiveState),
+		sizes:      make(map[string]int64),
+	}, nil
+}
+
+// Enabled reports whether rates are adapted at all.
+func (a *Adaptive) Enabled() bool {
+	return a.mode != adaptiveOff
+}
+
+// key maps user to the state its rate is tracked in.
+func (a *Adaptive) key(user string) string {
+
+	if a.mode == adaptiveGlobal {
+		return ""
+	}
+
+	return user
+}
+
+func (a *Adaptive) state(user string) *adaptiveState {
+
+	key := a.key(user)
+
+	s, ok := a.states[key]
+	if !ok {
+		s = &adaptiveState{
+			interval: a.min,
+		}
+		a.states[key] = s
+	}
+
+	return s
+}
+
+// Due reports whether user is to be sampled at t.
+func (a *Adaptive) Due(user string, t time.Time) bool {
+
+	if !a.Enabled() {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return !t.Before(a.state(user).next)
+}
+
+// Interval returns the interval user is currently sampled at.
+func (a *Adaptive) Interval(user string) time.Duration {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.state(user).interval
+}
+
+// Observe feeds the outcome of the samples taken at t
+// back into the rates and schedules the next samples.
+func (a *Adaptive) Observe(t time.Time, samples []Sample) {
+
+	if !a.Enabled() {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := make(map[string]bool)
+
+	for _, sample := range samples {
+
+		key := a.key(sample.User)
+
+		// Failed samples are no evidence of
+		// stability, so sample them quickly.
+		if sample.Error != "" {
+			changed[key] = true
+			continue
+		}
+
+		if size, ok := a.sizes[sample.User]; ok && size != sample.Size {
+			changed[key] = true
+		} else if _, ok := changed[key]; !ok {
+			changed[key] = false
+		}
+
+		a.sizes[sample.User] = sample.Size
+	}
+
+	for key, c := range changed {
+
+		s := a.state(key)
+
+		if c {
+			s.interval = a.min
+			s.stable = 0
+		} else {
+			s.stable++
+			if s.stable >= a.stableRuns && s.interval*2 <= a.max {
+				s.interval *= 2
+				s.stable = 0
+			}
+		}
+
+		s.next = nextBoundary(t, s.interval)
+	}
+}
+
+// Hot resets the interval of user to the minimum,
+// e.g. once it diverged from a peer's Maildir.
+func (a *Adaptive) Hot(user string, t time.Time) {
+
+	if !a.Enabled() {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.state(user)
+	s.interval = a.min
+	s.stable = 0
+	s.next = nextBoundary(t, s.interval)
+}
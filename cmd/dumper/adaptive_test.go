@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// adaptiveStep either observes sizes, negative ones
+// as failed samples, or marks the user hot as hot. It
+// then expects the intervals of the users given.
+type adaptiveStep struct {
+	sizes     map[string]int64
+	hot       string
+	intervals map[string]time.Duration
+}
+
+// runAdaptive takes the steps 10s apart.
+func runAdaptive(t *testing.T, a *Adaptive, steps []adaptiveStep) {
+
+	at := time.Unix(1500000000, 0)
+
+	for i, step := range steps {
+
+		if step.hot != "" {
+			a.Hot(step.hot, at)
+		} else {
+			var samples []Sample
+			for _, user := range []string{"user1", "user2"} {
+				size, ok := step.sizes[user]
+				if !ok {
+					continue
+				}
+				sample := Sample{User: user, Size: size}
+				if size < 0 {
+					sample.Size = 0
+					sample.Error = "exit status 1"
+				}
+				samples = append(samples, sample)
+			}
+			a.Observe(at, samples)
+		}
+
+		for user, expected := range step.intervals {
+			if interval := a.Interval(user); interval != expected {
+				t.Errorf("step %d: expected interval %s of %s, got %s", i, expected, user, interval)
+			}
+		}
+
+		at = at.Add(10 * time.Second)
+	}
+}
+
+func TestAdaptiveUserBackoff(t *testing.T) {
+
+	a, err := NewAdaptive(adaptiveUser, 10*time.Second, 80*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := time.Second
+	sizes := func(user1, user2 int64) map[string]int64 {
+		return map[string]int64{"user1": user1, "user2": user2}
+	}
+	intervals := func(user1, user2 time.Duration) map[string]time.Duration {
+		return map[string]time.Duration{"user1": user1, "user2": user2}
+	}
+
+	runAdaptive(t, a, []adaptiveStep{
+		// Doubling after every 2 runs without change.
+		{sizes: sizes(1, 1), intervals: intervals(10*s, 10*s)},
+		{sizes: sizes(1, 1), intervals: intervals(20*s, 20*s)},
+		{sizes: sizes(1, 1), intervals: intervals(20*s, 20*s)},
+		{sizes: sizes(1, 1), intervals: intervals(40*s, 40*s)},
+		{sizes: sizes(1, 1), intervals: intervals(40*s, 40*s)},
+		{sizes: sizes(1, 1), intervals: intervals(80*s, 80*s)},
+
+		// Never beyond the maximum.
+		{sizes: sizes(1, 1), intervals: intervals(80*s, 80*s)},
+		{sizes: sizes(1, 1), intervals: intervals(80*s, 80*s)},
+
+		// A change resets only the user that changed.
+		{sizes: sizes(2, 1), intervals: intervals(10*s, 80*s)},
+		{sizes: sizes(2, 1), intervals: intervals(10*s, 80*s)},
+		{sizes: sizes(2, 1), intervals: intervals(20*s, 80*s)},
+
+		// Users not sampled keep their interval.
+		{sizes: map[string]int64{"user2": 1}, intervals: intervals(20*s, 80*s)},
+
+		// A failed sample resets, and the size
+		// before it is the one compared against.
+		{sizes: sizes(-1, 1), intervals: intervals(10*s, 80*s)},
+		{sizes: sizes(2, 1), intervals: intervals(10*s, 80*s)},
+		{sizes: sizes(2, 1), intervals: intervals(20*s, 80*s)},
+
+		// Hot resets and starts counting stable runs anew.
+		{hot: "user2", intervals: intervals(20*s, 10*s)},
+		{sizes: sizes(2, 1), intervals: intervals(20*s, 10*s)},
+		{sizes: sizes(2, 1), intervals: intervals(40*s, 20*s)},
+	})
+}
+
+func TestAdaptiveGlobalBackoff(t *testing.T) {
+
+	a, err := NewAdaptive(adaptiveGlobal, 10*time.Second, 40*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := time.Second
+	sizes := func(user1, user2 int64) map[string]int64 {
+		return map[string]int64{"user1": user1, "user2": user2}
+	}
+	intervals := func(d time.Duration) map[string]time.Duration {
+		return map[string]time.Duration{"user1": d, "user2": d}
+	}
+
+	runAdaptive(t, a, []adaptiveStep{
+		{sizes: sizes(1, 1), intervals: intervals(20 * s)},
+		{sizes: sizes(1, 1), intervals: intervals(40 * s)},
+		{sizes: sizes(1, 1), intervals: intervals(40 * s)},
+
+		// One user changing resets all.
+		{sizes: sizes(1, 2), intervals: intervals(10 * s)},
+		{sizes: sizes(1, 2), intervals: intervals(20 * s)},
+
+		// So does one user being hot.
+		{hot: "user1", intervals: intervals(10 * s)},
+		{sizes: sizes(-1, 2), intervals: intervals(10 * s)},
+	})
+}
+
+func TestAdaptiveDue(t *testing.T) {
+
+	a, err := NewAdaptive(adaptiveUser, 10*time.Second, 40*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(secs int64) time.Time {
+		return time.Unix(1500000000+secs, 0)
+	}
+
+	if !a.Due("user1", at(0)) {
+		t.Errorf("expected unobserved user to be due")
+	}
+
+	// Observed at 0 with an interval of 20s,
+	// the next sample is due at 20.
+	a.Observe(at(0), []Sample{{User: "user1", Size: 1}})
+
+	for secs, due := range map[int64]bool{10: false, 19: false, 20: true, 30: true} {
+		if a.Due("user1", at(secs)) != due {
+			t.Errorf("expected due %v at %ds", due, secs)
+		}
+	}
+
+	// Hot users are due at the next minimum interval.
+	a.Hot("user1", at(3))
+
+	for secs, due := range map[int64]bool{9: false, 10: true} {
+		if a.Due("user1", at(secs)) != due {
+			t.Errorf("expected due %v at %ds after hot", due, secs)
+		}
+	}
+
+	if !a.Due("user2", at(3)) {
+		t.Errorf("expected other user to stay due")
+	}
+}
+
+func TestAdaptiveOff(t *testing.T) {
+
+	a, err := NewAdaptive(adaptiveOff, 10*time.Second, 40*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Unix(1500000000, 0)
+	a.Observe(at, []Sample{{User: "user1", Size: 1}})
+	a.Hot("user1", at)
+
+	if !a.Due("user1", at) || !a.Due("user1", at.Add(time.Second)) {
+		t.Errorf("expected every user to be due at every tick")
+	}
+	if interval := a.Interval("user1"); interval != 10*time.Second {
+		t.Errorf("expected minimum interval, got %s", interval)
+	}
+}
+
+func TestNewAdaptiveValidates(t *testing.T) {
+
+	for _, test := range []struct {
+		mode     string
+		min, max time.Duration
+	}{
+		{"fast", time.Second, time.Second},
+		{adaptiveUser, time.Microsecond, time.Second},
+		{adaptiveUser, time.Second, time.Millisecond},
+	} {
+		if _, err := NewAdaptive(test.mode, test.min, test.max, 1); err == nil {
+			t.Errorf("expected error for mode %q, min %s and max %s", test.mode, test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Kinds of alerting rules.
+const (
+	// ruleUserLag fires for every user that has been
+	// diverging from a peer for longer than Threshold.
+	ruleUserLag = "user_lag"
+
+	// ruleLagQuantile fires for every peer the Quantile
+	// of the lags of all users exceeds Threshold for.
+	ruleLagQuantile = "lag_quantile"
+)
+
+// Rule is a single alerting rule as read from the rules file.
+type Rule struct {
+	Name      string  `json:"name"`
+	Kind      string  `json:"kind"`
+	Threshold string  `json:"threshold"`
+	Quantile  float64 `json:"quantile,omitempty"`
+
+	threshold time.Duration
+}
+
+// Alert is a single notification sent to the webhook.
+type Alert struct {
+	Rule      string            `json:"rule"`
+	Status    string            `json:"status"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Threshold float64           `json:"threshold"`
+	StartsAt  time.Time         `json:"startsAt"`
+	EndsAt    *time.Time        `json:"endsAt,omitempty"`
+}
+
+// webhookPayload is the body POSTed to the webhook.
+type webhookPayload struct {
+	Worker string  `json:"worker"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// activeAlert tracks a firing alert for deduplication.
+type activeAlert struct {
+	alert    Alert
+	lastSent time.Time
+}
+
+// Alerter evaluates alerting rules against the lags
+// computed in peer mode and notifies a webhook about
+// alerts starting, still firing every resend interval
+// and resolving.
+type Alerter struct {
+	logger   log.Logger
+	peers    *Peers
+	rules    []Rule
+	webhook  string
+	worker   string
+	interval time.Duration
+	resend   time.Duration
+	client   *http.Client
+
+	active map[string]*activeAlert
+}
+
+// LoadRules reads and validates the JSON rules file at path.
+func LoadRules(path string) ([]Rule, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []Rule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %v", path, err)
+	}
+
+	for i := range rules {
+
+		r := &rules[i]
+
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+
+		r.threshold, err = time.ParseDuration(r.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q has invalid threshold: %v", r.Name, err)
+		}
+
+		switch r.Kind {
+		case ruleUserLag:
+		case ruleLagQuantile:
+			if r.Quantile <= 0 || r.Quantile > 1 {
+				return nil, fmt.Errorf("rule %q needs a quantile in (0, 1]", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q has unknown kind %q", r.Name, r.Kind)
+		}
+	}
+
+	return rules, nil
+}
+
+// NewAlerter returns an Alerter evaluating rules once per interval.
+func NewAlerter(logger log.Logger, peers *Peers, rules []Rule, webhook string, worker string, interval time.Duration, resend time.Duration) *Alerter {
+	return &Alerter{
+		logger:   logger,
+		peers:    peers,
+		rules:    rules,
+		webhook:  webhook,
+		worker:   worker,
+		interval: interval,
+		resend:   resend,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		active: make(map[string]*activeAlert),
+	}
+}
+
+// Run evaluates all rules once per interval until ctx is done.
+func (a *Alerter) Run(ctx context.Context) error {
+
+	tick := time.NewTicker(a.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			a.evaluate(ctx, time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// evaluate determines the firing alerts and notifies the
+// webhook about all that started, are due for resending
+// or resolved since the previous evaluation.
+func (a *Alerter) evaluate(ctx context.Context, now time.Time) {
+
+	firing := make(map[string]Alert)
+	lags := a.peers.Lags()
+
+	for _, rule := range a.rules {
+		for _, alert := range rule.evaluate(lags) {
+			firing[alertKey(alert)] = alert
+		}
+	}
+
+	var notify []Alert
+	var sent []*activeAlert
+
+	for key, alert := range firing {
+
+		active, ok := a.active[key]
+		if !ok {
+			alert.StartsAt = now
+			active = &activeAlert{}
+			a.active[key] = active
+		} else {
+			alert.StartsAt = active.alert.StartsAt
+		}
+		active.alert = alert
+
+		if now.Sub(active.lastSent) >= a.resend {
+			notify = append(notify, alert)
+			sent = append(sent, active)
+		}
+	}
+
+	var resolved []string
+
+	for key, active := range a.active {
+
+		if _, ok := firing[key]; ok {
+			continue
+		}
+
+		alert := active.alert
+		alert.Status = "resolved"
+		alert.EndsAt = &now
+
+		notify = append(notify, alert)
+		resolved = append(resolved, key)
+	}
+
+	if len(notify) == 0 {
+		return
+	}
+
+	if err := a.send(ctx, notify); err != nil {
+		// Nothing is marked as sent, so all of
+		// it is retried on the next evaluation.
+		level.Warn(a.logger).Log("msg", "failed to send alerts", "webhook", a.webhook, "err", err)
+		return
+	}
+
+	for _, active := range sent {
+		active.lastSent = now
+	}
+
+	for _, key := range resolved {
+		delete(a.active, key)
+	}
+}
+
+// send POSTs alerts as JSON to the webhook.
+func (a *Alerter) send(ctx context.Context, alerts []Alert) error {
+
+	body, err := json.Marshal(webhookPayload{
+		Worker: a.worker,
+		Alerts: alerts,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// evaluate returns the alerts of rule firing for lags.
+func (r Rule) evaluate(lags []PeerLag) []Alert {
+
+	var alerts []Alert
+
+	switch r.Kind {
+	case ruleUserLag:
+		for _, lag := range lags {
+			if lag.Lag > r.threshold {
+				alerts = append(alerts, r.alert(lag.Lag, map[string]string{
+					"peer": lag.Peer,
+					"user": lag.User,
+				}))
+			}
+		}
+
+	case ruleLagQuantile:
+		byPeer := make(map[string][]time.Duration)
+		for _, lag := range lags {
+			byPeer[lag.Peer] = append(byPeer[lag.Peer], lag.Lag)
+		}
+
+		for peer, values := range byPeer {
+			if q := quantile(values, r.Quantile); q > r.threshold {
+				alerts = append(alerts, r.alert(q, map[string]string{
+					"peer": peer,
+				}))
+			}
+		}
+	}
+
+	return alerts
+}
+
+func (r Rule) alert(value time.Duration, labels map[string]string) Alert {
+	return Alert{
+		Rule:      r.Name,
+		Status:    "firing",
+		Labels:    labels,
+		Value:     value.Seconds(),
+		Threshold: r.threshold.Seconds(),
+	}
+}
+
+// alertKey identifies an alert by its rule and labels.
+func alertKey(alert Alert) string {
+
+	names := make([]string, 0, len(alert.Labels))
+	for name := range alert.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := alert.Rule
+	for _, name := range names {
+		key += fmt.Sprintf("\x00%s=%s", name, alert.Labels[name])
+	}
+
+	return key
+}
+
+// quantile returns the q-quantile of values
+// using the nearest-rank method.
+func quantile(values []time.Duration, q float64) time.Duration {
+
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
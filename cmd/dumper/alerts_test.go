@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// webhook records the alerts POSTed to it, failing
+// requests with status while it is set.
+type webhook struct {
+	mu       sync.Mutex
+	status   int
+	payloads []webhookPayload
+	failed   int
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.status != 0 {
+		h.failed++
+		http.Error(w, "unavailable", h.status)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.payloads = append(h.payloads, payload)
+}
+
+// fail makes the webhook answer with status, 0 for success.
+func (h *webhook) fail(status int) {
+	h.mu.Lock()
+	h.status = status
+	h.mu.Unlock()
+}
+
+// received returns and forgets the alerts received.
+func (h *webhook) received() []Alert {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var alerts []Alert
+	for _, payload := range h.payloads {
+		alerts = append(alerts, payload.Alerts...)
+	}
+	h.payloads = nil
+
+	return alerts
+}
+
+// setLag makes user lag behind peer by lag, or not at all if zero.
+func setLag(p *Peers, peer string, user string, lag time.Duration) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if lag == 0 {
+		delete(p.lags[peer], user)
+		return
+	}
+
+	p.lags[peer][user] = &PeerLag{
+		Peer: peer,
+		User: user,
+		Lag:  lag,
+	}
+}
+
+func TestAlerterDelivery(t *testing.T) {
+
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	peers := &Peers{
+		lags: map[string]map[string]*PeerLag{
+			"peer-1": make(map[string]*PeerLag),
+		},
+	}
+
+	rules := []Rule{{
+		Name:      "lagging",
+		Kind:      ruleUserLag,
+		Threshold: "1m",
+		threshold: time.Minute,
+	}}
+
+	a := NewAlerter(log.NewNopLogger(), peers, rules, server.URL, "worker-1", time.Second, time.Minute)
+
+	ctx := context.Background()
+	start := time.Unix(1500000000, 0)
+	at := func(secs int) time.Time {
+		return start.Add(time.Duration(secs) * time.Second)
+	}
+
+	expect := func(step string, alerts []Alert, status string, startsAt time.Time, endsAt *time.Time) {
+
+		if len(alerts) != 1 {
+			t.Fatalf("%s: expected 1 alert, got %+v", step, alerts)
+		}
+
+		alert := alerts[0]
+		if alert.Rule != "lagging" || alert.Status != status || alert.Labels["user"] != "user1" || alert.Labels["peer"] != "peer-1" {
+			t.Errorf("%s: expected %s alert of lagging for user1 behind peer-1, got %+v", step, status, alert)
+		}
+		if !alert.StartsAt.Equal(startsAt) {
+			t.Errorf("%s: expected alert to start at %v, got %v", step, startsAt, alert.StartsAt)
+		}
+		if (endsAt == nil) != (alert.EndsAt == nil) || endsAt != nil && !alert.EndsAt.Equal(*endsAt) {
+			t.Errorf("%s: expected alert to end at %v, got %v", step, endsAt, alert.EndsAt)
+		}
+	}
+
+	// Lags below the threshold do not fire.
+	setLag(peers, "peer-1", "user1", 30*time.Second)
+	a.evaluate(ctx, at(0))
+	if alerts := hook.received(); len(alerts) != 0 {
+		t.Fatalf("expected no alerts below threshold, got %+v", alerts)
+	}
+
+	setLag(peers, "peer-1", "user1", 2*time.Minute)
+	a.evaluate(ctx, at(10))
+	expect("firing", hook.received(), "firing", at(10), nil)
+
+	// Still firing alerts are only resent
+	// once the resend interval passed.
+	a.evaluate(ctx, at(20))
+	if alerts := hook.received(); len(alerts) != 0 {
+		t.Fatalf("expected no alerts before resending, got %+v", alerts)
+	}
+
+	a.evaluate(ctx, at(70))
+	expect("resent", hook.received(), "firing", at(10), nil)
+
+	// Failed deliveries are retried on the next evaluation.
+	hook.fail(http.StatusServiceUnavailable)
+	a.evaluate(ctx, at(130))
+	hook.fail(0)
+
+	a.evaluate(ctx, at(140))
+	expect("retried", hook.received(), "firing", at(10), nil)
+
+	setLag(peers, "peer-1", "user1", 0)
+	hook.fail(http.StatusInternalServerError)
+	a.evaluate(ctx, at(150))
+	hook.fail(0)
+
+	ends := at(160)
+	a.evaluate(ctx, ends)
+	expect("resolved", hook.received(), "resolved", at(10), &ends)
+
+	// Resolved alerts are sent once.
+	a.evaluate(ctx, at(170))
+	if alerts := hook.received(); len(alerts) != 0 {
+		t.Fatalf("expected no alerts after resolving, got %+v", alerts)
+	}
+
+	if hook.failed != 2 {
+		t.Errorf("expected 2 failed deliveries, got %d", hook.failed)
+	}
+
+	// A firing alert starts anew after resolving.
+	setLag(peers, "peer-1", "user1", 2*time.Minute)
+	a.evaluate(ctx, at(180))
+	expect("refiring", hook.received(), "firing", at(180), nil)
+}
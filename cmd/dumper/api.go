@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// API serves the samples kept in a
+// History to scripts and other dumpers.
+type API struct {
+	logger  log.Logger
+	history *History
+}
+
+// Register attaches all API endpoints to mux.
+func (api *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/samples", api.handleSamples)
+	mux.HandleFunc("/api/v1/latest", api.handleLatest)
+	mux.HandleFunc("/api/v1/time", handleTime)
+}
+
+// handleSamples returns all samples of a user within
+// the optional time range given via 'from' and 'to'.
+func (api *API) handleSamples(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	from, err := parseTime(q.Get("from"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid 'from': %v", err), http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseTime(q.Get("to"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid 'to': %v", err), http.StatusBadRequest)
+		return
+	}
+
+	api.write(w, r, api.history.Range(q.Get("user"), from, to))
+}
+
+// handleLatest returns the most recent sample
+// of every user or of the one given via 'user'.
+func (api *API) handleLatest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	api.write(w, r, api.history.Latest(r.URL.Query().Get("user")))
+}
+
+// write encodes samples as CSV if requested via 'format'
+// or the Accept header and as JSON otherwise.
+func (api *API) write(w http.ResponseWriter, r *http.Request, samples []Sample) {
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+
+	switch format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(samples); err != nil {
+			level.Warn(api.logger).Log("msg", "failed to write samples", "err", err)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "user", "size", "error"})
+		for _, s := range samples {
+			cw.Write([]string{
+				s.Timestamp.UTC().Format(time.RFC3339Nano),
+				s.User,
+				strconv.FormatInt(s.Size, 10),
+				s.Error,
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			level.Warn(api.logger).Log("msg", "failed to write samples", "err", err)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+// parseTime accepts either RFC3339 or (fractional) Unix
+// seconds. An empty value yields the zero time.
+func parseTime(value string) (time.Time, error) {
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	secs, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 or Unix seconds, got %q", value)
+	}
+
+	whole, frac := math.Modf(secs)
+
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+}
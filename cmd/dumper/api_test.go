@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// newAPIServer serves the API on a history of
+// 3 runs, each with samples of user1 and user2.
+func newAPIServer() *httptest.Server {
+
+	h := NewHistory(3)
+	for i := 0; i < 3; i++ {
+		at := time.Unix(1500000000+int64(i)*60, 0)
+		h.Add([]Sample{
+			{Timestamp: at, User: "user1", Size: int64(100 + i)},
+			{Timestamp: at, User: "user2", Error: "exit status 1"},
+		})
+	}
+
+	api := &API{
+		logger:  log.NewNopLogger(),
+		history: h,
+	}
+
+	mux := http.NewServeMux()
+	api.Register(mux)
+
+	return httptest.NewServer(mux)
+}
+
+// request sends method for path to server, with accept as
+// Accept header if not empty, and returns the response.
+func request(t *testing.T, server *httptest.Server, method string, path string, accept string) (int, string, string) {
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+}
+
+func TestAPISamples(t *testing.T) {
+
+	server := newAPIServer()
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "json by default",
+			path:        "/api/v1/samples?user=user1",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body: `[{"timestamp":"` + time.Unix(1500000000, 0).Format(time.RFC3339Nano) + `","user":"user1","size":100},` +
+				`{"timestamp":"` + time.Unix(1500000060, 0).Format(time.RFC3339Nano) + `","user":"user1","size":101},` +
+				`{"timestamp":"` + time.Unix(1500000120, 0).Format(time.RFC3339Nano) + `","user":"user1","size":102}]` + "\n",
+		},
+		{
+			name:        "csv via format",
+			path:        "/api/v1/samples?format=csv&from=1500000060",
+			status:      http.StatusOK,
+			contentType: "text/csv",
+			body: "timestamp,user,size,error\n" +
+				"2017-07-14T02:41:00Z,user1,101,\n" +
+				"2017-07-14T02:41:00Z,user2,0,exit status 1\n" +
+				"2017-07-14T02:42:00Z,user1,102,\n" +
+				"2017-07-14T02:42:00Z,user2,0,exit status 1\n",
+		},
+		{
+			name:        "csv via Accept",
+			path:        "/api/v1/samples?user=user1&from=2017-07-14T02:41:00Z&to=1500000060.5",
+			accept:      "text/csv, */*",
+			status:      http.StatusOK,
+			contentType: "text/csv",
+			body: "timestamp,user,size,error\n" +
+				"2017-07-14T02:41:00Z,user1,101,\n",
+		},
+		{
+			name:        "format overrides Accept",
+			path:        "/api/v1/samples?user=user1&from=1500000120&format=json",
+			accept:      "text/csv",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `[{"timestamp":"` + time.Unix(1500000120, 0).Format(time.RFC3339Nano) + `","user":"user1","size":102}]` + "\n",
+		},
+		{
+			name:        "empty json",
+			path:        "/api/v1/samples?user=user3",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        "[]\n",
+		},
+		{
+			name:        "empty csv",
+			path:        "/api/v1/samples?user=user3&format=csv",
+			status:      http.StatusOK,
+			contentType: "text/csv",
+			body:        "timestamp,user,size,error\n",
+		},
+		{
+			name:   "invalid from",
+			path:   "/api/v1/samples?from=yesterday",
+			status: http.StatusBadRequest,
+			body:   "invalid 'from': expected RFC3339 or Unix seconds, got \"yesterday\"\n",
+		},
+		{
+			name:   "invalid to",
+			path:   "/api/v1/samples?to=2017-07-14",
+			status: http.StatusBadRequest,
+			body:   "invalid 'to': expected RFC3339 or Unix seconds, got \"2017-07-14\"\n",
+		},
+		{
+			name:   "unknown format",
+			path:   "/api/v1/samples?format=xml",
+			status: http.StatusBadRequest,
+			body:   "unknown format \"xml\"\n",
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodPost,
+			path:   "/api/v1/samples",
+			status: http.StatusMethodNotAllowed,
+			body:   "method not allowed\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			status, contentType, body := request(t, server, method, test.path, test.accept)
+
+			if status != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, status, body)
+			}
+			if test.contentType != "" && contentType != test.contentType {
+				t.Errorf("expected content type %q, got %q", test.contentType, contentType)
+			}
+			if body != test.body {
+				t.Errorf("expected body\n%s\ngot\n%s", test.body, body)
+			}
+		})
+	}
+}
+
+func TestAPILatest(t *testing.T) {
+
+	server := newAPIServer()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		accept string
+		status int
+		body   string
+	}{
+		{
+			name:   "all users as csv",
+			path:   "/api/v1/latest?format=csv",
+			status: http.StatusOK,
+			body: "timestamp,user,size,error\n" +
+				"2017-07-14T02:42:00Z,user1,102,\n" +
+				"2017-07-14T02:42:00Z,user2,0,exit status 1\n",
+		},
+		{
+			name:   "single user via Accept",
+			path:   "/api/v1/latest?user=user2",
+			accept: "text/csv",
+			status: http.StatusOK,
+			body: "timestamp,user,size,error\n" +
+				"2017-07-14T02:42:00Z,user2,0,exit status 1\n",
+		},
+		{
+			name:   "single user as json",
+			path:   "/api/v1/latest?user=user2",
+			status: http.StatusOK,
+			body:   `[{"timestamp":"` + time.Unix(1500000120, 0).Format(time.RFC3339Nano) + `","user":"user2","size":0,"error":"exit status 1"}]` + "\n",
+		},
+		{
+			name:   "unknown format",
+			path:   "/api/v1/latest?format=tsv",
+			status: http.StatusBadRequest,
+			body:   "unknown format \"tsv\"\n",
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodDelete,
+			path:   "/api/v1/latest",
+			status: http.StatusMethodNotAllowed,
+			body:   "method not allowed\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			status, _, body := request(t, server, method, test.path, test.accept)
+
+			if status != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, status, body)
+			}
+			if body != test.body {
+				t.Errorf("expected body\n%s\ngot\n%s", test.body, body)
+			}
+		})
+	}
+}
+
+func TestAPITime(t *testing.T) {
+
+	server := newAPIServer()
+	defer server.Close()
+
+	before := time.Now().UnixNano()
+	status, contentType, body := request(t, server, http.MethodGet, "/api/v1/time", "")
+	after := time.Now().UnixNano()
+
+	if status != http.StatusOK || contentType != "application/json" {
+		t.Fatalf("expected status 200 with JSON, got %d with %q: %s", status, contentType, body)
+	}
+
+	var tr timeResponse
+	if err := json.NewDecoder(strings.NewReader(body)).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Receive < before || tr.Transmit < tr.Receive || tr.Transmit > after {
+		t.Errorf("expected %d <= receive <= transmit <= %d, got %+v", before, after, tr)
+	}
+}
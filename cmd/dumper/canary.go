@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Headers identifying a canary message. The clock header,
+// repeated per reference, gives the offset of the sender's
+// clock to it in nanoseconds: '<ref> <offset>'.
+const (
+	canaryIDHeader    = "X-Canary-Id"
+	canarySentHeader  = "X-Canary-Sent"
+	canaryClockHeader = "X-Canary-Clock"
+)
+
+// CanaryObservation is the first sighting
+// of a canary message on this node.
+type CanaryObservation struct {
+	ID      string
+	Sent    time.Time
+	Latency time.Duration
+}
+
+// CanaryWriter injects a uniquely named canary message into
+// a user's Maildir once per interval, either by writing it
+// directly into new/ or by IMAP APPEND to a server. The
+// offsets last measured by clock, if set, are sent along.
+type CanaryWriter struct {
+	logger   log.Logger
+	metrics  *Metrics
+	worker   string
+	maildir  string
+	interval time.Duration
+	clock    *Clock
+
+	imapAddr     string
+	imapTLS      bool
+	imapUser     string
+	imapPassword string
+
+	seq int
+}
+
+// Run injects a canary once per interval until ctx is done.
+func (cw *CanaryWriter) Run(ctx context.Context) error {
+
+	tick := time.NewTicker(cw.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := cw.inject(time.Now()); err != nil {
+				level.Warn(cw.logger).Log("msg", "failed to inject canary", "err", err)
+				cw.metrics.canaryErrors.Inc()
+				continue
+			}
+			cw.metrics.canariesSent.Inc()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// inject writes one canary message sent at now.
+func (cw *CanaryWriter) inject(now time.Time) error {
+
+	cw.seq++
+	id := fmt.Sprintf("%s-%d-%d", cw.worker, now.UnixNano(), cw.seq)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: canary@maildir-dumper\r\n"+
+		"To: canary@maildir-dumper\r\n"+
+		"Subject: canary %s\r\n"+
+		"Date: %s\r\n"+
+		"%s: %s\r\n"+
+		"%s: %d\r\n",
+		id, now.Format(time.RFC1123Z), canaryIDHeader, id, canarySentHeader, now.UnixNano())
+
+	offsets := cw.clock.Offsets()
+	refs := make([]string, 0, len(offsets))
+	for ref := range offsets {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		fmt.Fprintf(&msg, "%s: %s %d\r\n", canaryClockHeader, ref, offsets[ref].Nanoseconds())
+	}
+
+	fmt.Fprintf(&msg, "\r\nCanary message to measure replication latency.\r\n")
+
+	if cw.imapAddr != "" {
+		return cw.append(msg.Bytes())
+	}
+
+	// Deliver following the Maildir protocol: write to
+	// tmp/ first and move the complete file into new/.
+	name := fmt.Sprintf("%d.canary-%s.%s", now.Unix(), id, cw.worker)
+
+	tmp := filepath.Join(cw.maildir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg.Bytes(), 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(cw.maildir, "new", name))
+}
+
+// append delivers msg via IMAP APPEND.
+func (cw *CanaryWriter) append(msg []byte) error {
+
+	c, err := dialIMAP(cw.imapAddr, cw.imapTLS, cw.interval)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Login(cw.imapUser, cw.imapPassword); err != nil {
+		return err
+	}
+
+	return c.Append("INBOX", msg)
+}
+
+// canaryRetention is how long the ID of a canary is remembered
+// after its last message vanished from the Maildir, so that
+// a message moved from new/ to cur/ while listing them is
+// not reported twice. Canaries are left in the Maildir of
+// the worker that injected them as long, for the others to
+// see them.
+const canaryRetention = 10 * time.Minute
+
+// canary is a canary message as read from its headers: its
+// ID, when it was sent and the clock offsets of its sender
+// by reference.
+type canary struct {
+	id      string
+	sent    time.Time
+	offsets map[string]time.Duration
+}
+
+// CanaryWatcher polls a user's Maildir for canary messages
+// and records the latency at which each is first seen,
+// corrected by the offsets of both clocks to a common
+// reference if clock measured one. Canaries injected by
+// the watching worker itself are skipped, as they are seen
+// right away. Canaries are deleted once seen, those of the
+// watching worker after canaryRetention.
+type CanaryWatcher struct {
+	logger   log.Logger
+	metrics  *Metrics
+	maildir  string
+	interval time.Duration
+	worker   string
+	clock    *Clock
+
+	// seen maps the messages listed before to their
+	// canary, of empty ID if they are no canaries.
+	// reported holds when a message of each canary
+	// reported was last seen.
+	seen     map[string]canary
+	reported map[string]time.Time
+
+	mu      sync.Mutex
+	pending []CanaryObservation
+}
+
+// NewCanaryWatcher returns a CanaryWatcher of worker polling
+// maildir once per interval, correcting latencies by the
+// offsets of clock, which may be nil. Messages present at
+// startup are not reported.
+func NewCanaryWatcher(logger log.Logger, metrics *Metrics, maildir string, interval time.Duration, worker string, clock *Clock) *CanaryWatcher {
+
+	cw := &CanaryWatcher{
+		logger:   logger,
+		metrics:  metrics,
+		maildir:  maildir,
+		interval: interval,
+		worker:   worker,
+		clock:    clock,
+		seen:     make(map[string]canary),
+		reported: make(map[string]time.Time),
+	}
+
+	now := time.Now()
+	for _, name := range cw.list() {
+		c, _ := readCanary(filepath.Join(maildir, name))
+		cw.seen[name] = c
+		if c.id != "" {
+			cw.reported[c.id] = now
+		}
+	}
+
+	return cw
+}
+
+// Run polls the Maildir once per interval until ctx is done.
+func (cw *CanaryWatcher) Run(ctx context.Context) error {
+
+	tick := time.NewTicker(cw.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			cw.poll(time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Drain returns and forgets all observations made
+// since the previous call, to be written to a dump.
+func (cw *CanaryWatcher) Drain() []CanaryObservation {
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	pending := cw.pending
+	cw.pending = nil
+
+	return pending
+}
+
+// list returns the paths of all messages in new/ and cur/
+// relative to the Maildir. A message moved to cur/ is
+// listed under a new name, carrying its info part.
+func (cw *CanaryWatcher) list() []string {
+
+	var names []string
+
+	for _, dir := range []string{"new", "cur"} {
+
+		files, err := ioutil.ReadDir(filepath.Join(cw.maildir, dir))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			names = append(names, filepath.Join(dir, file.Name()))
+		}
+	}
+
+	return names
+}
+
+// poll inspects all messages not seen before
+// and deletes the canaries seen long enough.
+func (cw *CanaryWatcher) poll(now time.Time) {
+
+	// Only remember what is still there, so that
+	// expunged messages don't pile up in memory.
+	seen := make(map[string]canary)
+	defer func() {
+		cw.seen = seen
+
+		for id, last := range cw.reported {
+			if now.Sub(last) > canaryRetention {
+				delete(cw.reported, id)
+			}
+		}
+	}()
+
+	for _, name := range cw.list() {
+
+		c, ok := cw.seen[name]
+		if !ok {
+			c, ok = readCanary(filepath.Join(cw.maildir, name))
+			if ok {
+				cw.observe(c, now)
+			}
+		}
+
+		if c.id == "" {
+			seen[name] = c
+			continue
+		}
+		cw.reported[c.id] = now
+
+		if canaryWorker(c.id) == cw.worker && now.Sub(c.sent) <= canaryRetention {
+			seen[name] = c
+			continue
+		}
+
+		err := os.Remove(filepath.Join(cw.maildir, name))
+		if err != nil && !os.IsNotExist(err) {
+			level.Warn(cw.logger).Log("msg", "failed to delete canary", "id", c.id, "err", err)
+			seen[name] = c
+		}
+	}
+}
+
+// observe records the latency of c first seen at
+// now, unless reported before or injected by the
+// watching worker itself.
+func (cw *CanaryWatcher) observe(c canary, now time.Time) {
+
+	if _, reported := cw.reported[c.id]; reported || canaryWorker(c.id) == cw.worker {
+		return
+	}
+
+	latency, ref := cw.latency(c, now)
+	obs := CanaryObservation{
+		ID:      c.id,
+		Sent:    c.sent,
+		Latency: latency,
+	}
+
+	level.Debug(cw.logger).Log("msg", "canary arrived", "id", c.id, "latency", obs.Latency, "ref", ref)
+	cw.metrics.canaryLatency.Observe(obs.Latency.Seconds())
+
+	cw.mu.Lock()
+	cw.pending = append(cw.pending, obs)
+	cw.mu.Unlock()
+}
+
+// latency returns the time from sending c until now. If the
+// sender and this worker measured their clock offset to the
+// same reference, the first of them by name, it is corrected
+// by both offsets and returned along with the reference.
+// Otherwise both clocks are taken to agree.
+func (cw *CanaryWatcher) latency(c canary, now time.Time) (time.Duration, string) {
+
+	refs := make([]string, 0, len(c.offsets))
+	for ref := range c.offsets {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	offsets := cw.clock.Offsets()
+	for _, ref := range refs {
+		if offset, ok := offsets[ref]; ok {
+			return now.Add(offset).Sub(c.sent.Add(c.offsets[ref])), ref
+		}
+	}
+
+	return now.Sub(c.sent), ""
+}
+
+// canaryWorker returns the worker that injected the canary
+// id, named '<worker>-<nanoseconds>-<seq>' by CanaryWriter.
+func canaryWorker(id string) string {
+
+	for i := 0; i < 2; i++ {
+		if j := strings.LastIndex(id, "-"); j >= 0 {
+			id = id[:j]
+		}
+	}
+
+	return id
+}
+
+// readCanary reads the canary of the message at
+// path from its headers, if it is a canary.
+func readCanary(path string) (canary, bool) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return canary{}, false
+	}
+	defer f.Close()
+
+	var c canary
+	var sent int64
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+
+		if v := strings.TrimPrefix(line, canaryIDHeader+":"); v != line {
+			c.id = strings.TrimSpace(v)
+		} else if v := strings.TrimPrefix(line, canarySentHeader+":"); v != line {
+			sent, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		} else if v := strings.TrimPrefix(line, canaryClockHeader+":"); v != line {
+			fields := strings.Fields(v)
+			if len(fields) != 2 {
+				continue
+			}
+			offset, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if c.offsets == nil {
+				c.offsets = make(map[string]time.Duration)
+			}
+			c.offsets[fields[0]] = time.Duration(offset)
+		}
+	}
+
+	if c.id == "" || sent == 0 {
+		return canary{}, false
+	}
+	c.sent = time.Unix(0, sent)
+
+	return c, true
+}
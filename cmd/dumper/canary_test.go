@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// canaryMaildir creates an empty Maildir below a temporary
+// directory and returns its path.
+func canaryMaildir(t *testing.T) string {
+
+	root, err := ioutil.TempDir("", "canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// messages returns the number of messages in new/ and cur/.
+func messages(t *testing.T, maildir string) int {
+
+	n := 0
+	for _, dir := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(maildir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(files)
+	}
+
+	return n
+}
+
+func newCanaryMetrics() *Metrics {
+	return &Metrics{
+		canaryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency"}),
+	}
+}
+
+// clockOf returns a Clock having measured offsets.
+func clockOf(offsets map[string]time.Duration) *Clock {
+	return &Clock{latest: offsets}
+}
+
+func TestCanaryLatency(t *testing.T) {
+
+	sent := time.Unix(1500000000, 0)
+
+	// The injector's clock is 2s ahead of the
+	// reference, the watcher's 1s behind it.
+	injector := clockOf(map[string]time.Duration{
+		"ntp://ref": -2 * time.Second,
+		"other":     time.Hour,
+	})
+
+	tests := []struct {
+		name    string
+		clock   *Clock
+		latency time.Duration
+	}{
+		{"common reference", clockOf(map[string]time.Duration{"ntp://ref": time.Second}), 3500 * time.Millisecond},
+		{"no common reference", clockOf(map[string]time.Duration{"ntp://else": time.Second}), 500 * time.Millisecond},
+		{"no clock", nil, 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			maildir := canaryMaildir(t)
+			defer os.RemoveAll(maildir)
+
+			watcher := NewCanaryWatcher(log.NewNopLogger(), newCanaryMetrics(), maildir, time.Second, "w2", test.clock)
+			writer := &CanaryWriter{worker: "w1", maildir: maildir, clock: injector}
+
+			if err := writer.inject(sent); err != nil {
+				t.Fatal(err)
+			}
+
+			watcher.poll(sent.Add(500 * time.Millisecond))
+
+			obs := watcher.Drain()
+			if len(obs) != 1 || !obs[0].Sent.Equal(sent) || obs[0].Latency != test.latency {
+				t.Fatalf("expected one canary of latency %s, got %+v", test.latency, obs)
+			}
+			if worker := canaryWorker(obs[0].ID); worker != "w1" {
+				t.Errorf("expected canary of w1, got %s", worker)
+			}
+
+			// Seen canaries are deleted and reported once.
+			if n := messages(t, maildir); n != 0 {
+				t.Errorf("expected canary deleted once seen, got %d messages", n)
+			}
+
+			watcher.poll(sent.Add(time.Second))
+			if obs := watcher.Drain(); len(obs) != 0 {
+				t.Errorf("expected canary reported once, got %+v", obs)
+			}
+		})
+	}
+}
+
+func TestCanaryWatcherDeletes(t *testing.T) {
+
+	maildir := canaryMaildir(t)
+	defer os.RemoveAll(maildir)
+
+	now := time.Now()
+
+	// A canary of another worker and a message
+	// that is no canary present at startup.
+	other := &CanaryWriter{worker: "w2", maildir: maildir}
+	if err := other.inject(now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(maildir, "cur", "1.mail:2,S"), []byte("Subject: hello\r\n\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := NewCanaryWatcher(log.NewNopLogger(), newCanaryMetrics(), maildir, time.Second, "w1", nil)
+	own := &CanaryWriter{worker: "w1", maildir: maildir}
+	if err := own.inject(now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The canary present at startup is deleted without
+	// being reported, the watcher's own one is kept for
+	// the others to see.
+	watcher.poll(now.Add(time.Second))
+
+	if obs := watcher.Drain(); len(obs) != 0 {
+		t.Errorf("expected no canaries reported, got %+v", obs)
+	}
+	if n := messages(t, maildir); n != 2 {
+		t.Errorf("expected the own canary and the message kept, got %d messages", n)
+	}
+
+	watcher.poll(now.Add(canaryRetention))
+	if n := messages(t, maildir); n != 2 {
+		t.Errorf("expected the own canary kept for %s, got %d messages", canaryRetention, n)
+	}
+
+	watcher.poll(now.Add(canaryRetention + time.Second))
+	if n := messages(t, maildir); n != 1 {
+		t.Errorf("expected only the message left, got %d messages", n)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// exchangesPerMeasurement is the number of request/response
+// exchanges a measurement consists of. The one with the
+// shortest round trip is the most accurate.
+const exchangesPerMeasurement = 4
+
+// ntpEpochOffset is the number of seconds
+// between 1900-01-01 and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ClockMeasurement is the offset of the local clock to a
+// reference clock. Adding Offset to a local timestamp
+// yields the reference's time, give or take half of RTT.
+type ClockMeasurement struct {
+	Ref    string        `json:"ref"`
+	Time   time.Time     `json:"time"`
+	Offset time.Duration `json:"offset"`
+	RTT    time.Duration `json:"rtt"`
+}
+
+// timeResponse is returned by the /api/v1/time endpoint.
+type timeResponse struct {
+	Receive  int64 `json:"receive"`
+	Transmit int64 `json:"transmit"`
+}
+
+// Clock periodically measures the offset of the local
+// clock to a set of references, which are either other
+// dumpers queried via HTTP or, prefixed with 'ntp://',
+// SNTP servers.
+type Clock struct {
+	logger   log.Logger
+	metrics  *Metrics
+	refs     []string
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []ClockMeasurement
+	latest  map[string]time.Duration
+}
+
+// NewClock returns a Clock measuring
+// against refs once per interval.
+func NewClock(logger log.Logger, metrics *Metrics, refs []string, interval time.Duration) *Clock {
+	return &Clock{
+		logger:   logger,
+		metrics:  metrics,
+		refs:     refs,
+		interval: interval,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		latest: make(map[string]time.Duration),
+	}
+}
+
+// Run measures all references once per interval until ctx is done.
+func (c *Clock) Run(ctx context.Context) error {
+
+	tick := time.NewTicker(c.interval)
+	defer tick.Stop()
+
+	for {
+		for _, ref := range c.refs {
+
+			m, err := c.measure(ctx, ref)
+			if err != nil {
+				level.Warn(c.logger).Log("msg", "failed to measure clock offset", "ref", ref, "err", err)
+				continue
+			}
+
+			level.Debug(c.logger).Log("msg", "measured clock offset", "ref", ref, "offset", m.Offset, "rtt", m.RTT)
+			c.metrics.clockOffset.WithLabelValues(ref).Set(m.Offset.Seconds())
+			c.metrics.clockRTT.WithLabelValues(ref).Set(m.RTT.Seconds())
+
+			c.mu.Lock()
+			c.pending = append(c.pending, m)
+			c.latest[ref] = m.Offset
+			c.mu.Unlock()
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Drain returns and forgets all measurements taken
+// since the previous call, to be written to a dump.
+func (c *Clock) Drain() []ClockMeasurement {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.pending
+	c.pending = nil
+
+	return pending
+}
+
+// Offsets returns the offset last measured
+// to each reference, none if c is nil.
+func (c *Clock) Offsets() map[string]time.Duration {
+
+	offsets := make(map[string]time.Duration)
+	if c == nil {
+		return offsets
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ref, offset := range c.latest {
+		offsets[ref] = offset
+	}
+
+	return offsets
+}
+
+// measure performs several exchanges with ref and
+// keeps the one with the shortest round trip.
+func (c *Clock) measure(ctx context.Context, ref string) (ClockMeasurement, error) {
+
+	var best ClockMeasurement
+	var lastErr error
+
+	for i := 0; i < exchangesPerMeasurement; i++ {
+
+		var t1, t2, t3, t4 time.Time
+		var err error
+
+		if strings.HasPrefix(ref, "ntp://") {
+			t1, t2, t3, t4, err = exchangeSNTP(strings.TrimPrefix(ref, "ntp://"))
+		} else {
+			t1, t2, t3, t4, err = c.exchangeHTTP(ctx, ref)
+		}
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		offset, rtt := offsetAndRTT(t1, t2, t3, t4)
+
+		m := ClockMeasurement{
+			Ref:    ref,
+			Time:   t4,
+			Offset: offset,
+			RTT:    rtt,
+		}
+
+		if best.Ref == "" || m.RTT < best.RTT {
+			best = m
+		}
+	}
+
+	if best.Ref == "" {
+		return best, lastErr
+	}
+
+	return best, nil
+}
+
+// offsetAndRTT computes the offset of the reference clock
+// and the round trip time of one exchange from the times the
+// request was sent (t1) and received by the reference (t2)
+// and the response was sent (t3) and received (t4).
+func offsetAndRTT(t1, t2, t3, t4 time.Time) (time.Duration, time.Duration) {
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, t4.Sub(t1) - t3.Sub(t2)
+}
+
+// exchangeHTTP queries the time endpoint of the dumper at
+// addr and returns the four timestamps of the exchange.
+func (c *Clock) exchangeHTTP(ctx context.Context, addr string) (time.Time, time.Time, time.Time, time.Time, error) {
+
+	var zero time.Time
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/v1/time", addr), nil)
+	if err != nil {
+		return zero, zero, zero, zero, err
+	}
+
+	t1 := time.Now()
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return zero, zero, zero, zero, err
+	}
+	defer resp.Body.Close()
+
+	var tr timeResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+
+	t4 := time.Now()
+
+	if err != nil {
+		return zero, zero, zero, zero, fmt.Errorf("failed to decode time response: %v", err)
+	}
+
+	return t1, time.Unix(0, tr.Receive), time.Unix(0, tr.Transmit), t4, nil
+}
+
+// exchangeSNTP sends a client request to the SNTP server
+// at addr and returns the four timestamps of the exchange.
+func exchangeSNTP(addr string) (time.Time, time.Time, time.Time, time.Time, error) {
+
+	var zero time.Time
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return zero, zero, zero, zero, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Leap indicator 0, version 4, mode 3 (client).
+	req := make([]byte, 48)
+	req[0] = 0x23
+
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTP(t1))
+
+	if _, err := conn.Write(req); err != nil {
+		return zero, zero, zero, zero, err
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+
+	t4 := time.Now()
+
+	if err != nil {
+		return zero, zero, zero, zero, err
+	}
+
+	if n < 48 {
+		return zero, zero, zero, zero, fmt.Errorf("short SNTP response of %d bytes", n)
+	}
+
+	if mode := resp[0] & 0x07; mode != 4 {
+		return zero, zero, zero, zero, fmt.Errorf("unexpected SNTP mode %d", mode)
+	}
+
+	if resp[1] == 0 {
+		return zero, zero, zero, zero, fmt.Errorf("SNTP server sent kiss-o'-death")
+	}
+
+	t2 := fromNTP(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTP(binary.BigEndian.Uint64(resp[40:]))
+
+	return t1, t2, t3, t4, nil
+}
+
+// toNTP converts t to a 64 bit NTP timestamp.
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// fromNTP converts a 64 bit NTP timestamp to a time.
+func fromNTP(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nsecs := int64(((ts & 0xffffffff) * uint64(time.Second)) >> 32)
+	return time.Unix(secs, nsecs)
+}
+
+// handleTime answers NTP-style exchanges of other dumpers
+// with the times the request was received and answered.
+func handleTime(w http.ResponseWriter, r *http.Request) {
+
+	receive := time.Now().UnixNano()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeResponse{
+		Receive:  receive,
+		Transmit: time.Now().UnixNano(),
+	})
+}
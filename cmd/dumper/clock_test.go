@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sntpServer answers SNTP requests on a local UDP port
+// as a server whose clock is off by offset. respond, if
+// set, may alter each response before it is sent.
+type sntpServer struct {
+	conn    net.PacketConn
+	offset  time.Duration
+	respond func(resp []byte) []byte
+
+	mu       sync.Mutex
+	requests [][]byte
+}
+
+func newSNTPServer(t *testing.T, offset time.Duration, respond func([]byte) []byte) *sntpServer {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sntpServer{
+		conn:    conn,
+		offset:  offset,
+		respond: respond,
+	}
+	go s.serve()
+
+	return s
+}
+
+func (s *sntpServer) serve() {
+
+	for {
+		req := make([]byte, 128)
+		n, addr, err := s.conn.ReadFrom(req)
+		if err != nil {
+			return
+		}
+		received := time.Now().Add(s.offset)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req[:n])
+		s.mu.Unlock()
+
+		// Leap indicator 0, version 4, mode 4 (server),
+		// stratum 1 and the client's transmit time as
+		// originate time.
+		resp := make([]byte, 48)
+		resp[0] = 0x24
+		resp[1] = 1
+		copy(resp[24:32], req[40:48])
+		binary.BigEndian.PutUint64(resp[32:], toNTP(received))
+		binary.BigEndian.PutUint64(resp[40:], toNTP(time.Now().Add(s.offset)))
+
+		if s.respond != nil {
+			resp = s.respond(resp)
+		}
+
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func (s *sntpServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *sntpServer) Close() {
+	s.conn.Close()
+}
+
+// timeServer serves the time endpoint of a dumper whose
+// clock is off by offset, delaying the first delayed
+// requests by delay before taking the receive time.
+type timeServer struct {
+	offset  time.Duration
+	delay   time.Duration
+	delayed int
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (s *timeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	s.requests++
+	slow := s.requests <= s.delayed
+	s.mu.Unlock()
+
+	if slow {
+		time.Sleep(s.delay)
+	}
+
+	receive := time.Now().Add(s.offset).UnixNano()
+
+	json.NewEncoder(w).Encode(timeResponse{
+		Receive:  receive,
+		Transmit: time.Now().Add(s.offset).UnixNano(),
+	})
+}
+
+func newClockMetrics() *Metrics {
+	return &Metrics{
+		clockOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "offset"}, []string{"ref"}),
+		clockRTT:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rtt"}, []string{"ref"}),
+	}
+}
+
+// expectOffset fails unless m is within half its
+// round trip time of offset, as NTP guarantees.
+func expectOffset(t *testing.T, m ClockMeasurement, offset time.Duration) {
+
+	if m.RTT < 0 || m.RTT > time.Second {
+		t.Errorf("expected round trip time below 1s, got %s", m.RTT)
+	}
+
+	err := m.Offset - offset
+	if err < 0 {
+		err = -err
+	}
+	if err > m.RTT/2+time.Millisecond {
+		t.Errorf("expected offset %s within %s, got %s", offset, m.RTT/2, m.Offset)
+	}
+}
+
+func TestOffsetAndRTT(t *testing.T) {
+
+	base := time.Unix(1500000000, 0)
+	ms := time.Millisecond
+
+	tests := []struct {
+		name           string
+		t1, t2, t3, t4 time.Duration
+		offset, rtt    time.Duration
+	}{
+		{"in sync", 0, 10 * ms, 10 * ms, 20 * ms, 0, 20 * ms},
+		{"reference ahead", 0, 2005 * ms, 2006 * ms, 11 * ms, 2 * time.Second, 10 * ms},
+		{"reference behind", 0, -2995 * ms, -2995 * ms, 10 * ms, -3 * time.Second, 10 * ms},
+		{"slow response", 0, 1 * ms, 3 * ms, 14 * ms, -5 * ms, 12 * ms},
+		{"asymmetric path", 0, 8 * ms, 8 * ms, 10 * ms, 3 * ms, 10 * ms},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			offset, rtt := offsetAndRTT(base.Add(test.t1), base.Add(test.t2), base.Add(test.t3), base.Add(test.t4))
+			if offset != test.offset || rtt != test.rtt {
+				t.Errorf("expected offset %s and round trip %s, got %s and %s", test.offset, test.rtt, offset, rtt)
+			}
+		})
+	}
+}
+
+func TestNTPTimestamps(t *testing.T) {
+
+	for _, ts := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1500000000, 0),
+		time.Unix(1500000000, 500000000),
+		time.Unix(1500000000, 999999999),
+		time.Unix(2085978495, 1),
+	} {
+		back := fromNTP(toNTP(ts))
+		if d := ts.Sub(back); d < 0 || d > time.Nanosecond {
+			t.Errorf("expected %s back within 1ns, got %s", ts.UTC(), back.UTC())
+		}
+	}
+
+	// The seconds are counted since 1900, the
+	// fraction in units of 2^-32 seconds.
+	if ts := toNTP(time.Unix(1500000000, 500000000)); ts != (1500000000+2208988800)<<32|1<<31 {
+		t.Errorf("expected seconds since 1900 and half a second, got %x", ts)
+	}
+}
+
+func TestExchangeSNTP(t *testing.T) {
+
+	server := newSNTPServer(t, 90*time.Second, nil)
+	defer server.Close()
+
+	c := NewClock(log.NewNopLogger(), newClockMetrics(), nil, time.Minute)
+
+	m, err := c.measure(context.Background(), "ntp://"+server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Ref != "ntp://"+server.addr() {
+		t.Errorf("expected measurement of %s, got %s", server.addr(), m.Ref)
+	}
+	expectOffset(t, m, 90*time.Second)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(server.requests) != exchangesPerMeasurement {
+		t.Errorf("expected %d exchanges, got %d", exchangesPerMeasurement, len(server.requests))
+	}
+	for _, req := range server.requests {
+		if len(req) != 48 || req[0] != 0x23 {
+			t.Errorf("expected 48 byte request of version 4 in mode 3, got %x", req)
+		}
+	}
+}
+
+func TestExchangeSNTPInvalid(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		respond func([]byte) []byte
+		err     string
+	}{
+		{
+			name: "short response",
+			respond: func(resp []byte) []byte {
+				return resp[:47]
+			},
+			err: "short SNTP response of 47 bytes",
+		},
+		{
+			name: "not a server",
+			respond: func(resp []byte) []byte {
+				resp[0] = 0x23
+				return resp
+			},
+			err: "unexpected SNTP mode 3",
+		},
+		{
+			name: "kiss-o'-death",
+			respond: func(resp []byte) []byte {
+				resp[1] = 0
+				copy(resp[12:16], "RATE")
+				return resp
+			},
+			err: "SNTP server sent kiss-o'-death",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := newSNTPServer(t, 0, test.respond)
+			defer server.Close()
+
+			_, _, _, _, err := exchangeSNTP(server.addr())
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+
+			c := NewClock(log.NewNopLogger(), newClockMetrics(), nil, time.Minute)
+			if _, err := c.measure(context.Background(), "ntp://"+server.addr()); err == nil || err.Error() != test.err {
+				t.Errorf("expected measurement to fail with %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestExchangeHTTP(t *testing.T) {
+
+	// All exchanges but the last are slow, so only
+	// the last one is accurate enough to be kept.
+	ts := &timeServer{
+		offset:  -90 * time.Second,
+		delay:   100 * time.Millisecond,
+		delayed: exchangesPerMeasurement - 1,
+	}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	c := NewClock(log.NewNopLogger(), newClockMetrics(), nil, time.Minute)
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	m, err := c.measure(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.RTT >= ts.delay {
+		t.Errorf("expected the exchange of shortest round trip, got one of %s", m.RTT)
+	}
+	expectOffset(t, m, -90*time.Second)
+
+	if ts.requests != exchangesPerMeasurement {
+		t.Errorf("expected %d exchanges, got %d", exchangesPerMeasurement, ts.requests)
+	}
+}
+
+func TestClockRun(t *testing.T) {
+
+	server := httptest.NewServer(&timeServer{offset: 5 * time.Second})
+	defer server.Close()
+
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer invalid.Close()
+
+	metrics := newClockMetrics()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	c := NewClock(log.NewNopLogger(), metrics, []string{strings.TrimPrefix(invalid.URL, "http://"), addr}, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	var measurements []ClockMeasurement
+	for i := 0; i < 500 && len(measurements) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		measurements = c.Drain()
+	}
+
+	cancel()
+	<-done
+
+	// Only the valid reference is recorded.
+	if len(measurements) != 1 || measurements[0].Ref != addr {
+		t.Fatalf("expected one measurement of %s, got %+v", addr, measurements)
+	}
+	expectOffset(t, measurements[0], 5*time.Second)
+
+	if offsets := gaugeValues(t, metrics.clockOffset); len(offsets) != 1 || offsets[addr] != measurements[0].Offset.Seconds() {
+		t.Errorf("expected offset gauge of %s only, got %v", addr, offsets)
+	}
+
+	if pending := c.Drain(); len(pending) != 0 {
+		t.Errorf("expected drained measurements to be forgotten, got %+v", pending)
+	}
+}
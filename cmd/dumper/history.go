@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// Sample holds all measurements of one user at a point
+// in time: the size of the Maildir via 'du -s' or the
+// error it failed with, the mailbox states reported by
+// IMAP and the fields of all other probes, namespaced
+// as '<probe>.<field>'. Errors of all probes are kept
+// by probe name.
+type Sample struct {
+	Timestamp   time.Time            `json:"timestamp"`
+	User        string               `json:"user"`
+	Size        int64                `json:"size"`
+	Error       string               `json:"error,omitempty"`
+	Mailboxes   []dump.MailboxStatus `json:"mailboxes,omitempty"`
+	Fields      map[string]float64   `json:"fields,omitempty"`
+	ProbeErrors map[string]string    `json:"probeErrors,omitempty"`
+}
+
+// History is a fixed-size ring buffer holding the
+// samples of the most recent runs of the 'du -s' loop.
+type History struct {
+	mu    sync.RWMutex
+	runs  [][]Sample
+	next  int
+	count int
+}
+
+// NewHistory returns a History that keeps
+// the samples of at most size runs.
+func NewHistory(size int) *History {
+	return &History{
+		runs: make([][]Sample, size),
+	}
+}
+
+// Add stores the samples of one run, overwriting
+// the oldest run once the buffer is full.
+func (h *History) Add(samples []Sample) {
+
+	if len(h.runs) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.runs[h.next] = samples
+	h.next = (h.next + 1) % len(h.runs)
+
+	if h.count < len(h.runs) {
+		h.count++
+	}
+}
+
+// Range returns all samples, oldest first, taken within
+// [from, to]. A zero from or to leaves that side open
+// and an empty user matches every user.
+func (h *History) Range(user string, from, to time.Time) []Sample {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	samples := []Sample{}
+
+	for i := 0; i < h.count; i++ {
+
+		idx := (h.next - h.count + i + len(h.runs)) % len(h.runs)
+
+		for _, s := range h.runs[idx] {
+
+			if user != "" && s.User != user {
+				continue
+			}
+
+			if !from.IsZero() && s.Timestamp.Before(from) {
+				continue
+			}
+
+			if !to.IsZero() && s.Timestamp.After(to) {
+				continue
+			}
+
+			samples = append(samples, s)
+		}
+	}
+
+	return samples
+}
+
+// Latest returns the most recent sample of every user,
+// or only of user if it is not empty.
+func (h *History) Latest(user string) []Sample {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	samples := []Sample{}
+
+	for i := 0; i < h.count; i++ {
+
+		idx := (h.next - 1 - i + len(h.runs)) % len(h.runs)
+
+		for _, s := range h.runs[idx] {
+
+			if seen[s.User] || (user != "" && s.User != user) {
+				continue
+			}
+
+			seen[s.User] = true
+			samples = append(samples, s)
+		}
+	}
+
+	return samples
+}
+
+// parseDu extracts the size from the
+// output of a single 'du -s' invocation.
+func parseDu(out []byte) (int64, error) {
+
+	fields := strings.SplitN(strings.TrimSpace(string(out)), "\t", 2)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected 'du -s' output: %q", out)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size in 'du -s' output: %v", err)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// historyOf returns a History of size that got runs added,
+// where run i holds one sample per user taken at second i.
+func historyOf(size int, runs int, users ...string) *History {
+
+	h := NewHistory(size)
+
+	for i := 0; i < runs; i++ {
+
+		samples := make([]Sample, 0, len(users))
+		for _, user := range users {
+			samples = append(samples, Sample{
+				Timestamp: time.Unix(int64(i), 0),
+				User:      user,
+				Size:      int64(i),
+			})
+		}
+
+		h.Add(samples)
+	}
+
+	return h
+}
+
+// describe reduces samples to '<user>@<second>'
+// to keep the expectations of the tables short.
+func describe(samples []Sample) []string {
+
+	described := []string{}
+	for _, s := range samples {
+		described = append(described, fmt.Sprintf("%s@%ds", s.User, s.Timestamp.Unix()))
+	}
+
+	return described
+}
+
+func TestHistoryRange(t *testing.T) {
+
+	at := func(secs int64) time.Time {
+		return time.Unix(secs, 0)
+	}
+
+	tests := []struct {
+		name     string
+		history  *History
+		user     string
+		from, to time.Time
+		expected []string
+	}{
+		{
+			name:     "empty buffer",
+			history:  NewHistory(3),
+			expected: []string{},
+		},
+		{
+			name:     "zero size",
+			history:  historyOf(0, 2, "a"),
+			expected: []string{},
+		},
+		{
+			name:     "partly filled",
+			history:  historyOf(3, 2, "a", "b"),
+			expected: []string{"a@0s", "b@0s", "a@1s", "b@1s"},
+		},
+		{
+			name:     "exactly full",
+			history:  historyOf(3, 3, "a"),
+			expected: []string{"a@0s", "a@1s", "a@2s"},
+		},
+		{
+			name:     "wrapped around",
+			history:  historyOf(3, 5, "a"),
+			expected: []string{"a@2s", "a@3s", "a@4s"},
+		},
+		{
+			name:     "wrapped around twice",
+			history:  historyOf(2, 5, "a"),
+			expected: []string{"a@3s", "a@4s"},
+		},
+		{
+			name:     "single user",
+			history:  historyOf(3, 5, "a", "b"),
+			user:     "b",
+			expected: []string{"b@2s", "b@3s", "b@4s"},
+		},
+		{
+			name:     "unknown user",
+			history:  historyOf(3, 5, "a"),
+			user:     "c",
+			expected: []string{},
+		},
+		{
+			name:     "bounds are inclusive",
+			history:  historyOf(5, 5, "a"),
+			from:     at(1),
+			to:       at(3),
+			expected: []string{"a@1s", "a@2s", "a@3s"},
+		},
+		{
+			name:     "open end",
+			history:  historyOf(5, 5, "a"),
+			from:     at(3),
+			expected: []string{"a@3s", "a@4s"},
+		},
+		{
+			name:     "open start",
+			history:  historyOf(5, 5, "a"),
+			to:       at(1),
+			expected: []string{"a@0s", "a@1s"},
+		},
+		{
+			name:     "bounds across wrap-around",
+			history:  historyOf(3, 5, "a"),
+			from:     at(0),
+			to:       at(3),
+			expected: []string{"a@2s", "a@3s"},
+		},
+		{
+			name:     "empty range",
+			history:  historyOf(3, 5, "a"),
+			from:     at(3),
+			to:       at(2),
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			samples := test.history.Range(test.user, test.from, test.to)
+			if samples == nil {
+				t.Fatalf("expected empty slice, got nil")
+			}
+
+			if got := describe(samples); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestHistoryLatest(t *testing.T) {
+
+	// Users that vanished from later runs keep
+	// their most recent sample of an older run.
+	vanished := NewHistory(3)
+	vanished.Add([]Sample{{Timestamp: time.Unix(0, 0), User: "a"}, {Timestamp: time.Unix(0, 0), User: "b"}})
+	vanished.Add([]Sample{{Timestamp: time.Unix(1, 0), User: "a"}})
+
+	tests := []struct {
+		name     string
+		history  *History
+		user     string
+		expected []string
+	}{
+		{
+			name:     "empty buffer",
+			history:  NewHistory(3),
+			expected: []string{},
+		},
+		{
+			name:     "zero size",
+			history:  historyOf(0, 2, "a"),
+			expected: []string{},
+		},
+		{
+			name:     "partly filled",
+			history:  historyOf(3, 2, "a", "b"),
+			expected: []string{"a@1s", "b@1s"},
+		},
+		{
+			name:     "wrapped around",
+			history:  historyOf(3, 7, "a", "b"),
+			expected: []string{"a@6s", "b@6s"},
+		},
+		{
+			name:     "wrapped around onto first slot",
+			history:  historyOf(3, 6, "a"),
+			expected: []string{"a@5s"},
+		},
+		{
+			name:     "single user",
+			history:  historyOf(3, 5, "a", "b"),
+			user:     "b",
+			expected: []string{"b@4s"},
+		},
+		{
+			name:     "unknown user",
+			history:  historyOf(3, 5, "a"),
+			user:     "c",
+			expected: []string{},
+		},
+		{
+			name:     "vanished user",
+			history:  vanished,
+			expected: []string{"a@1s", "b@0s"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			samples := test.history.Latest(test.user)
+			if samples == nil {
+				t.Fatalf("expected empty slice, got nil")
+			}
+
+			if got := describe(samples); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/prometheus/procfs"
+)
+
+// hostSnapshot holds the counters of the previous
+// collection that rates are computed against.
+type hostSnapshot struct {
+	t     time.Time
+	cpu   procfs.CPUStat
+	disks map[string][]float64
+	nets  map[string][]float64
+	procs map[int]float64
+}
+
+// HostCollector reads CPU, load, memory, disk and network
+// statistics of the host and CPU, memory and file descriptor
+// usage of the processes called process from procfs. Counters
+// are turned into rates since the previous collection.
+type HostCollector struct {
+	fs      procfs.FS
+	process string
+	prev    *hostSnapshot
+}
+
+// NewHostCollector returns a HostCollector reading the proc
+// filesystem, additionally watching process if not empty.
+func NewHostCollector(process string) (*HostCollector, error) {
+
+	fs, err := procfs.NewFS(procfs.DefaultMountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HostCollector{
+		fs:      fs,
+		process: process,
+	}, nil
+}
+
+// Collect returns all host metrics at now, sorted by name.
+// Rates are left out on the first call. Sources that fail
+// to be read are skipped and reported in the error.
+func (hc *HostCollector) Collect(now time.Time) ([]dump.HostMetric, error) {
+
+	var metrics []dump.HostMetric
+	var errs []string
+
+	add := func(name string, value float64) {
+		metrics = append(metrics, dump.HostMetric{Name: name, Value: value})
+	}
+
+	snap := &hostSnapshot{
+		t:     now,
+		disks: make(map[string][]float64),
+		nets:  make(map[string][]float64),
+		procs: make(map[int]float64),
+	}
+
+	prev := hc.prev
+	elapsed := 0.0
+	if prev != nil {
+		elapsed = now.Sub(prev.t).Seconds()
+	}
+
+	// rate returns the per-second increase of a counter,
+	// or false if there is nothing to compare against.
+	rate := func(cur float64, old []float64, i int) (float64, bool) {
+		if old == nil || elapsed <= 0 || cur < old[i] {
+			return 0, false
+		}
+		return (cur - old[i]) / elapsed, true
+	}
+
+	if stat, err := hc.fs.NewStat(); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		snap.cpu = stat.CPUTotal
+		if prev != nil {
+			hc.cpuMetrics(prev.cpu, stat.CPUTotal, add)
+		}
+	}
+
+	if err := hc.loadMetrics(add); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if err := hc.memoryMetrics(add); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	disks, err := hc.diskStats()
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for dev, c := range disks {
+		snap.disks[dev] = c
+		var old []float64
+		if prev != nil {
+			old = prev.disks[dev]
+		}
+
+		for i, name := range []string{"read_bytes", "write_bytes", "util"} {
+			if r, ok := rate(c[i], old, i); ok {
+				add("disk."+dev+"."+name, r)
+			}
+		}
+		add("disk."+dev+".in_flight", c[3])
+	}
+
+	nets, err := hc.netStats()
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for iface, c := range nets {
+		snap.nets[iface] = c
+		var old []float64
+		if prev != nil {
+			old = prev.nets[iface]
+		}
+
+		for i, name := range []string{"rx_bytes", "rx_dropped", "tx_bytes", "tx_dropped"} {
+			if r, ok := rate(c[i], old, i); ok {
+				add("net."+iface+"."+name, r)
+			}
+		}
+	}
+
+	if hc.process != "" {
+		if err := hc.processMetrics(prev, snap, elapsed, add); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	hc.prev = snap
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return metrics, nil
+}
+
+// cpuMetrics adds the share of CPU time spent in
+// each mode between the old and the cur totals.
+func (hc *HostCollector) cpuMetrics(old procfs.CPUStat, cur procfs.CPUStat, add func(string, float64)) {
+
+	// Guest time is already accounted as user time.
+	modes := []struct {
+		name     string
+		old, cur float64
+	}{
+		{"user", old.User + old.Nice, cur.User + cur.Nice},
+		{"system", old.System + old.IRQ + old.SoftIRQ, cur.System + cur.IRQ + cur.SoftIRQ},
+		{"iowait", old.Iowait, cur.Iowait},
+		{"idle", old.Idle, cur.Idle},
+		{"steal", old.Steal, cur.Steal},
+	}
+
+	var total float64
+	for _, m := range modes {
+		total += m.cur - m.old
+	}
+
+	if total <= 0 {
+		return
+	}
+
+	for _, m := range modes {
+		add("cpu."+m.name, (m.cur-m.old)/total)
+	}
+}
+
+// loadMetrics adds the load averages from /proc/loadavg.
+func (hc *HostCollector) loadMetrics(add func(string, float64)) error {
+
+	content, err := ioutil.ReadFile(hc.fs.Path("loadavg"))
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) < 3 {
+		return fmt.Errorf("malformed loadavg: %q", content)
+	}
+
+	for i, name := range []string{"load.1", "load.5", "load.15"} {
+		load, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("malformed loadavg: %q", content)
+		}
+		add(name, load)
+	}
+
+	return nil
+}
+
+// memoryMetrics adds total, available and used
+// memory in bytes from /proc/meminfo.
+func (hc *HostCollector) memoryMetrics(add func(string, float64)) error {
+
+	f, err := os.Open(hc.fs.Path("meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info := make(map[string]float64)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16318852 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+
+		if len(fields) == 3 && fields[2] == "kB" {
+			value *= 1024
+		}
+
+		info[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	total, ok := info["MemTotal"]
+	if !ok {
+		return fmt.Errorf("meminfo lacks MemTotal")
+	}
+
+	// Kernels before 3.14 lack MemAvailable.
+	available, ok := info["MemAvailable"]
+	if !ok {
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+
+	add("mem.total", total)
+	add("mem.available", available)
+	add("mem.used", total-available)
+
+	return nil
+}
+
+// diskStats returns per block device the bytes read and
+// written, seconds spent doing I/O and I/Os in flight from
+// /proc/diskstats. Loop and RAM devices are skipped.
+func (hc *HostCollector) diskStats() (map[string][]float64, error) {
+
+	f, err := os.Open(hc.fs.Path("diskstats"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	disks := make(map[string][]float64)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// major minor name reads merged sectors ms writes merged sectors ms in_flight io_ms weighted_ms ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+
+		dev := fields[2]
+		if strings.HasPrefix(dev, "loop") || strings.HasPrefix(dev, "ram") {
+			continue
+		}
+
+		// Sectors are 512 bytes regardless of the device.
+		var c []float64
+		for _, field := range []struct {
+			index int
+			scale float64
+		}{{5, 512}, {9, 512}, {12, 0.001}, {11, 1}} {
+			v, err := strconv.ParseFloat(fields[field.index], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed diskstats line: %q", scanner.Text())
+			}
+			c = append(c, v*field.scale)
+		}
+
+		disks[dev] = c
+	}
+
+	return disks, scanner.Err()
+}
+
+// netStats returns per network interface but loopback the
+// bytes and packets dropped when receiving and transmitting
+// from /proc/net/dev.
+func (hc *HostCollector) netStats() (map[string][]float64, error) {
+
+	f, err := os.Open(hc.fs.Path("net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nets := make(map[string][]float64)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		//   eth0: rx_bytes packets errs drop fifo frame compressed multicast tx_bytes packets errs drop ...
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		iface := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if iface == "lo" || len(fields) < 12 {
+			continue
+		}
+
+		var c []float64
+		for _, i := range []int{0, 3, 8, 11} {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed net/dev line: %q", scanner.Text())
+			}
+			c = append(c, v)
+		}
+
+		nets[iface] = c
+	}
+
+	return nets, scanner.Err()
+}
+
+// processMetrics adds the CPU cores used, resident memory in
+// bytes and open file descriptors of all processes called
+// hc.process. CPU usage only covers processes already
+// running at the previous collection.
+func (hc *HostCollector) processMetrics(prev *hostSnapshot, snap *hostSnapshot, elapsed float64, add func(string, float64)) error {
+
+	procs, err := hc.fs.AllProcs()
+	if err != nil {
+		return err
+	}
+
+	var cpu, rss, fds float64
+	found := false
+
+	for _, p := range procs {
+
+		stat, err := p.NewStat()
+		if err != nil || stat.Comm != hc.process {
+			// Processes exit all the time, just skip them.
+			continue
+		}
+		found = true
+
+		// A PID whose CPU time went backwards
+		// was reused by another process since.
+		snap.procs[p.PID] = stat.CPUTime()
+		if prev != nil {
+			if old, ok := prev.procs[p.PID]; ok && elapsed > 0 && stat.CPUTime() >= old {
+				cpu += (stat.CPUTime() - old) / elapsed
+			}
+		}
+
+		rss += float64(stat.ResidentMemory())
+
+		if n, err := p.FileDescriptorsLen(); err == nil {
+			fds += float64(n)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no process called %q", hc.process)
+	}
+
+	prefix := "proc." + hc.process + "."
+	if prev != nil {
+		add(prefix+"cpu", cpu)
+	}
+	add(prefix+"rss", rss)
+	add(prefix+"fds", fds)
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/prometheus/procfs"
+)
+
+// collectHost collects the metrics of the proc
+// filesystem fixture dir into hc at t.
+func collectHost(t *testing.T, hc *HostCollector, dir string, at time.Time) (map[string]float64, error) {
+
+	fs, err := procfs.NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.fs = fs
+
+	metrics, err := hc.Collect(at)
+
+	if !sort.SliceIsSorted(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name }) {
+		t.Errorf("expected metrics sorted by name, got %+v", metrics)
+	}
+
+	return hostValues(metrics), err
+}
+
+func hostValues(metrics []dump.HostMetric) map[string]float64 {
+
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+
+	return values
+}
+
+func expectHostValues(t *testing.T, step string, expected, got map[string]float64) {
+
+	for name, value := range expected {
+		v, ok := got[name]
+		if !ok {
+			t.Errorf("%s: expected %s of %v, got none", step, name, value)
+		} else if math.Abs(v-value) > 1e-9 {
+			t.Errorf("%s: expected %s of %v, got %v", step, name, value, v)
+		}
+	}
+
+	for name, value := range got {
+		if _, ok := expected[name]; !ok {
+			t.Errorf("%s: expected no %s, got %v", step, name, value)
+		}
+	}
+}
+
+func TestHostCollector(t *testing.T) {
+
+	page := float64(os.Getpagesize())
+	hc := &HostCollector{process: "dumper"}
+	start := time.Unix(1500000000, 0)
+
+	// Without previous collection there are no rates.
+	before, err := collectHost(t, hc, "testdata/proc-before", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectHostValues(t, "first collection", map[string]float64{
+		"load.1":              0.5,
+		"load.5":              1.25,
+		"load.15":             2,
+		"mem.total":           16000 * 1024,
+		"mem.available":       8000 * 1024,
+		"mem.used":            8000 * 1024,
+		"disk.sda.in_flight":  3,
+		"disk.sda1.in_flight": 0,
+		"proc.dumper.rss":     100 * page,
+		"proc.dumper.fds":     3,
+	}, before)
+
+	// Collected 10s later, process 43 started in between
+	// and the kernel does not report MemAvailable.
+	after, err := collectHost(t, hc, "testdata/proc-after", start.Add(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectHostValues(t, "second collection", map[string]float64{
+		"cpu.user":              0.3,
+		"cpu.system":            0.1,
+		"cpu.iowait":            0.1,
+		"cpu.idle":              0.5,
+		"cpu.steal":             0,
+		"load.1":                0.75,
+		"load.5":                1,
+		"load.15":               1.5,
+		"mem.total":             16000 * 1024,
+		"mem.available":         6000 * 1024,
+		"mem.used":              10000 * 1024,
+		"disk.sda.read_bytes":   20480 * 512 / 10,
+		"disk.sda.write_bytes":  10240 * 512 / 10,
+		"disk.sda.util":         0.5,
+		"disk.sda.in_flight":    1,
+		"disk.sda1.read_bytes":  20480 * 512 / 10,
+		"disk.sda1.write_bytes": 10240 * 512 / 10,
+		"disk.sda1.util":        0.5,
+		"disk.sda1.in_flight":   0,
+		"disk.sdb.in_flight":    0,
+		"net.eth0.rx_bytes":     1000,
+		"net.eth0.rx_dropped":   1,
+		"net.eth0.tx_bytes":     2000,
+		"net.eth0.tx_dropped":   0,
+		"proc.dumper.cpu":       0.3,
+		"proc.dumper.rss":       150 * page,
+		"proc.dumper.fds":       4,
+	}, after)
+
+	// Counters going backwards, e.g. after a reboot or of
+	// a reused PID, yield no rates, unchanged ones 0.
+	again, err := collectHost(t, hc, "testdata/proc-before", start.Add(20*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectHostValues(t, "counters going backwards", map[string]float64{
+		"load.1":              0.5,
+		"load.5":              1.25,
+		"load.15":             2,
+		"mem.total":           16000 * 1024,
+		"mem.available":       8000 * 1024,
+		"mem.used":            8000 * 1024,
+		"disk.sda.in_flight":  3,
+		"disk.sda1.in_flight": 0,
+		"net.eth0.tx_dropped": 0,
+		"proc.dumper.cpu":     0,
+		"proc.dumper.rss":     100 * page,
+		"proc.dumper.fds":     3,
+	}, again)
+}
+
+func TestHostCollectorErrors(t *testing.T) {
+
+	hc := &HostCollector{process: "dumper"}
+
+	values, err := collectHost(t, hc, "testdata/proc-broken", time.Unix(1500000000, 0))
+	if err == nil {
+		t.Fatalf("expected error, got %v", values)
+	}
+
+	// Every source failing is reported, yet
+	// does not keep the others from being read.
+	for _, msg := range []string{
+		"testdata/proc-broken/stat",
+		`malformed loadavg: "garbage\n"`,
+		"testdata/proc-broken/meminfo",
+		"testdata/proc-broken/diskstats",
+		"testdata/proc-broken/net/dev",
+		`no process called "dumper"`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected error to mention %s, got %v", msg, err)
+		}
+	}
+
+	if len(values) != 0 {
+		t.Errorf("expected no metrics, got %v", values)
+	}
+
+	hc = &HostCollector{process: "imapd"}
+	values, err = collectHost(t, hc, "testdata/proc-before", time.Unix(1500000000, 0))
+	if err == nil || err.Error() != `no process called "imapd"` {
+		t.Errorf("expected only the process to be missing, got %v", err)
+	}
+	if values["load.1"] != 0.5 {
+		t.Errorf("expected host metrics despite missing process, got %v", values)
+	}
+}
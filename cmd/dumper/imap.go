@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// imapConn is a minimal IMAP client speaking just the
+// commands the dumper needs, one at a time.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// dialIMAP connects to the IMAP server at addr, optionally
+// via TLS, and consumes its greeting.
+func dialIMAP(addr string, useTLS bool, timeout time.Duration) (*imapConn, error) {
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+
+	var conn net.Conn
+	var err error
+
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	return newIMAPConn(conn)
+}
+
+// newIMAPConn speaks IMAP over an established conn and
+// consumes the greeting. conn is closed on failure.
+func newIMAPConn(conn net.Conn) (*imapConn, error) {
+
+	c := &imapConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	greeting, err := c.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %q", strings.TrimSpace(greeting))
+	}
+
+	return c, nil
+}
+
+// command sends a command with a fresh tag and returns all
+// untagged responses once the tagged OK response arrived.
+func (c *imapConn) command(format string, args ...interface{}) ([]string, error) {
+
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	return c.response(tag)
+}
+
+// response reads lines up to the tagged response of tag.
+func (c *imapConn) response(tag string) ([]string, error) {
+
+	var untagged []string
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if !strings.HasPrefix(line, tag+" ") {
+			untagged = append(untagged, line)
+			continue
+		}
+
+		status := strings.TrimPrefix(line, tag+" ")
+		if !strings.HasPrefix(status, "OK") {
+			return untagged, fmt.Errorf("IMAP command failed: %s", status)
+		}
+
+		return untagged, nil
+	}
+}
+
+// Login authenticates as user.
+func (c *imapConn) Login(user string, password string) error {
+	_, err := c.command("LOGIN %s %s", quoteIMAP(user), quoteIMAP(password))
+	return err
+}
+
+// Append stores msg in mailbox.
+func (c *imapConn) Append(mailbox string, msg []byte) error {
+
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+
+	if _, err := fmt.Fprintf(c.conn, "%s APPEND %s {%d}\r\n", tag, quoteIMAP(mailbox), len(msg)); err != nil {
+		return err
+	}
+
+	// Wait for the server to ask for the literal.
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("IMAP server rejected APPEND: %s", strings.TrimSpace(line))
+	}
+
+	if _, err := c.conn.Write(append(msg, '\r', '\n')); err != nil {
+		return err
+	}
+
+	_, err = c.response(tag)
+	return err
+}
+
+// List returns the names of all selectable mailboxes.
+func (c *imapConn) List() ([]string, error) {
+
+	untagged, err := c.command(`LIST "" "*"`)
+	if err != nil {
+		return nil, err
+	}
+
+	var mailboxes []string
+
+	for _, line := range untagged {
+
+		// * LIST (<flags>) <delimiter> <name>
+		if !strings.HasPrefix(line, "* LIST (") {
+			continue
+		}
+
+		end := strings.Index(line, ")")
+		if end < 0 {
+			continue
+		}
+
+		flags := strings.ToLower(line[len("* LIST ("):end])
+		if strings.Contains(flags, `\noselect`) || strings.Contains(flags, `\nonexistent`) {
+			continue
+		}
+
+		// Skip the delimiter, either NIL or a quoted character.
+		_, rest := nextIMAPString(strings.TrimSpace(line[end+1:]))
+		name, _ := nextIMAPString(rest)
+
+		if name != "" {
+			mailboxes = append(mailboxes, name)
+		}
+	}
+
+	return mailboxes, nil
+}
+
+// Status returns the logical state of mailbox.
+func (c *imapConn) Status(mailbox string) (dump.MailboxStatus, error) {
+
+	status := dump.MailboxStatus{
+		Mailbox: mailbox,
+	}
+
+	untagged, err := c.command("STATUS %s (MESSAGES UIDNEXT UIDVALIDITY UNSEEN)", quoteIMAP(mailbox))
+	if err != nil {
+		return status, err
+	}
+
+	for _, line := range untagged {
+
+		// * STATUS <name> (<item> <value> ...)
+		if !strings.HasPrefix(line, "* STATUS ") {
+			continue
+		}
+
+		start := strings.LastIndex(line, "(")
+		end := strings.LastIndex(line, ")")
+		if start < 0 || end < start {
+			return status, fmt.Errorf("malformed STATUS response: %q", line)
+		}
+
+		items := strings.Fields(line[start+1 : end])
+		for i := 0; i+1 < len(items); i += 2 {
+
+			value, err := strconv.ParseUint(items[i+1], 10, 32)
+			if err != nil {
+				return status, fmt.Errorf("malformed STATUS response: %q", line)
+			}
+
+			switch strings.ToUpper(items[i]) {
+			case "MESSAGES":
+				status.Messages = uint32(value)
+			case "UIDNEXT":
+				status.UIDNext = uint32(value)
+			case "UIDVALIDITY":
+				status.UIDValidity = uint32(value)
+			case "UNSEEN":
+				status.Unseen = uint32(value)
+			}
+		}
+
+		return status, nil
+	}
+
+	return status, fmt.Errorf("no STATUS response for %q", mailbox)
+}
+
+// Close logs out and closes the connection.
+func (c *imapConn) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+// nextIMAPString splits the leading quoted string or atom
+// off s and returns it decoded together with the rest.
+func nextIMAPString(s string) (string, string) {
+
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			return s[:i], strings.TrimSpace(s[i+1:])
+		}
+		return s, ""
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), strings.TrimSpace(s[i+1:])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), ""
+}
+
+// quoteIMAP encodes s as IMAP quoted string.
+func quoteIMAP(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
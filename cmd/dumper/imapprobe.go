@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// imapProbeName names the IMAP probe.
+const imapProbeName = "imap"
+
+// IMAPProbe logs into an IMAP server as a user
+// and queries the status of all their mailboxes.
+type IMAPProbe struct {
+	timeout   time.Duration
+	passwords map[string]string
+	password  string
+	mailboxes []string
+
+	// dial opens a connection to the server that
+	// gives up after timeout. Replaceable to probe
+	// an in-process stand-in instead.
+	dial func(timeout time.Duration) (*imapConn, error)
+}
+
+// NewIMAPProbe returns an IMAPProbe for the server at addr.
+// Passwords are looked up per user in the JSON object in
+// passwordFile if given, falling back to password. Unless
+// mailboxes are given, all selectable ones are probed.
+func NewIMAPProbe(addr string, useTLS bool, timeout time.Duration, passwordFile string, password string, mailboxes []string) (*IMAPProbe, error) {
+
+	p := &IMAPProbe{
+		timeout:   timeout,
+		passwords: make(map[string]string),
+		password:  password,
+		mailboxes: mailboxes,
+		dial: func(timeout time.Duration) (*imapConn, error) {
+			return dialIMAP(addr, useTLS, timeout)
+		},
+	}
+
+	if passwordFile != "" {
+
+		f, err := os.Open(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := json.NewDecoder(f).Decode(&p.passwords); err != nil {
+			return nil, fmt.Errorf("failed to parse IMAP passwords %s: %v", passwordFile, err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *IMAPProbe) Name() string {
+	return imapProbeName
+}
+
+func (p *IMAPProbe) Timeout() time.Duration {
+	return p.timeout
+}
+
+// Measure records the status of the mailboxes of user in
+// sample, giving up once the timeout passed or ctx is done.
+func (p *IMAPProbe) Measure(ctx context.Context, user string, sample *Sample) error {
+
+	statuses, err := p.statuses(ctx, user)
+	sample.Mailboxes = statuses
+
+	return err
+}
+
+// statuses returns the status of the mailboxes of user.
+func (p *IMAPProbe) statuses(ctx context.Context, user string) ([]dump.MailboxStatus, error) {
+
+	password, ok := p.passwords[user]
+	if !ok {
+		password = p.password
+	}
+
+	c, err := p.dial(p.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The deadline set by dial covers all commands,
+	// only cancellation needs to be handled here.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+	defer c.Close()
+
+	if err := c.Login(user, password); err != nil {
+		return nil, err
+	}
+
+	mailboxes := p.mailboxes
+	if len(mailboxes) == 0 {
+		mailboxes, err = c.List()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]dump.MailboxStatus, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+
+		status, err := c.Status(mailbox)
+		if err != nil {
+			return nil, fmt.Errorf("mailbox %s: %v", mailbox, err)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// imapStandIn answers the commands of IMAPProbe for the
+// mailboxes of all users, checking their passwords.
+type imapStandIn struct {
+	passwords map[string]string
+	mailboxes map[string][]dump.MailboxStatus
+
+	// hang leaves STATUS unanswered.
+	hang bool
+}
+
+// dial returns a connection to a stand-in
+// session served in the background.
+func (s *imapStandIn) dial(timeout time.Duration) (*imapConn, error) {
+
+	client, server := net.Pipe()
+	go s.serve(server)
+
+	client.SetDeadline(time.Now().Add(timeout))
+
+	return newIMAPConn(client)
+}
+
+func (s *imapStandIn) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "* OK stand-in ready\r\n")
+
+	var user string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+		tag, args := parts[0], ""
+		if len(parts) > 2 {
+			args = parts[2]
+		}
+
+		switch strings.ToUpper(parts[1]) {
+		case "LOGIN":
+			name, rest := nextIMAPString(args)
+			password, _ := nextIMAPString(rest)
+			if s.passwords[name] != password {
+				fmt.Fprintf(conn, "%s NO authentication failed\r\n", tag)
+				continue
+			}
+			user = name
+			fmt.Fprintf(conn, "%s OK logged in\r\n", tag)
+
+		case "LIST":
+			fmt.Fprintf(conn, "* LIST (\\Noselect \\HasChildren) \"/\" \"[Archive]\"\r\n")
+			for _, status := range s.mailboxes[user] {
+				fmt.Fprintf(conn, "* LIST (\\HasNoChildren) \"/\" %s\r\n", quoteIMAP(status.Mailbox))
+			}
+			fmt.Fprintf(conn, "%s OK listed\r\n", tag)
+
+		case "STATUS":
+			if s.hang {
+				continue
+			}
+
+			name, _ := nextIMAPString(args)
+			found := false
+			for _, status := range s.mailboxes[user] {
+				if status.Mailbox == name {
+					fmt.Fprintf(conn, "* STATUS %s (MESSAGES %d UIDNEXT %d UIDVALIDITY %d UNSEEN %d)\r\n",
+						quoteIMAP(name), status.Messages, status.UIDNext, status.UIDValidity, status.Unseen)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Fprintf(conn, "%s NO no such mailbox\r\n", tag)
+				continue
+			}
+			fmt.Fprintf(conn, "%s OK status\r\n", tag)
+
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE\r\n%s OK logged out\r\n", tag)
+			return
+
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+	}
+}
+
+func TestIMAPProbe(t *testing.T) {
+
+	inbox := dump.MailboxStatus{Mailbox: "INBOX", Messages: 3, UIDNext: 4, UIDValidity: 1, Unseen: 1}
+	sent := dump.MailboxStatus{Mailbox: "Sent \"Items\"", Messages: 2, UIDNext: 7, UIDValidity: 2}
+
+	s := &imapStandIn{
+		passwords: map[string]string{
+			"alice": "secret",
+			"bob":   "default",
+		},
+		mailboxes: map[string][]dump.MailboxStatus{
+			"alice": {inbox, sent},
+			"bob":   {inbox},
+		},
+	}
+
+	// Alice has a password of her own, bob
+	// logs in with the one given for all.
+	p := &IMAPProbe{
+		timeout:   time.Second,
+		passwords: map[string]string{"alice": "secret"},
+		password:  "default",
+		dial:      s.dial,
+	}
+
+	for user, expected := range map[string][]dump.MailboxStatus{
+		"alice": {inbox, sent},
+		"bob":   {inbox},
+	} {
+		var sample Sample
+		if err := p.Measure(context.Background(), user, &sample); err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+
+		if !reflect.DeepEqual(sample.Mailboxes, expected) {
+			t.Errorf("%s: expected %+v, got %+v", user, expected, sample.Mailboxes)
+		}
+	}
+
+	p.passwords["bob"] = "wrong"
+	if _, err := p.statuses(context.Background(), "bob"); err == nil {
+		t.Error("expected login with wrong password to fail")
+	}
+
+	// Only the mailboxes given are probed.
+	p.mailboxes = []string{"INBOX"}
+	statuses, err := p.statuses(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(statuses, []dump.MailboxStatus{inbox}) {
+		t.Errorf("expected only INBOX, got %+v", statuses)
+	}
+
+	p.mailboxes = []string{"INBOX", "Drafts"}
+	if _, err := p.statuses(context.Background(), "alice"); err == nil || !strings.Contains(err.Error(), "Drafts") {
+		t.Errorf("expected an error for missing mailbox Drafts, got %v", err)
+	}
+}
+
+func TestIMAPProbeCancel(t *testing.T) {
+
+	s := &imapStandIn{
+		passwords: map[string]string{"alice": "secret"},
+		mailboxes: map[string][]dump.MailboxStatus{
+			"alice": {{Mailbox: "INBOX"}},
+		},
+		hang: true,
+	}
+
+	p := &IMAPProbe{
+		timeout:  time.Minute,
+		password: "secret",
+		dial:     s.dial,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := p.statuses(ctx, "alice"); err == nil {
+		t.Fatal("expected a canceled probe to fail")
+	}
+
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("expected the probe to give up when canceled, took %v", d)
+	}
+}
@@ -11,25 +11,49 @@ import (
 	"syscall"
 	"time"
 
-	"archive/zip"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 
 	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/go-pluto/maildir_tools/collect"
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/go-pluto/maildir_tools/topology"
 	"github.com/oklog/oklog/pkg/group"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metrics aggregates all four gauges we expose
-// to Prometheus for insights into underlying Maildirs.
+// Metrics aggregates all metrics we expose to Prometheus
+// for insights into underlying Maildirs and the dumper.
 type Metrics struct {
-	duration prometheus.Histogram
+	duration     prometheus.Histogram
+	stalled      prometheus.Gauge
+	rootPathOK   prometheus.Gauge
+	backlog      prometheus.Gauge
+	userErrors   *prometheus.CounterVec
+	missedTicks  prometheus.Counter
+	overruns     prometheus.Counter
+	userInterval *prometheus.GaugeVec
+
+	peerUp            *prometheus.GaugeVec
+	peerDivergence    *prometheus.GaugeVec
+	peerLag           *prometheus.GaugeVec
+	peerDivergedUsers *prometheus.GaugeVec
+	peerMaxLag        *prometheus.GaugeVec
+
+	clockOffset *prometheus.GaugeVec
+	clockRTT    *prometheus.GaugeVec
+
+	walkerOps       prometheus.Counter
+	walkerThrottled prometheus.Counter
+
+	canariesSent  prometheus.Counter
+	canaryErrors  prometheus.Counter
+	canaryLatency prometheus.Histogram
 }
 
 // initLogger initializes a JSON gokit-logger set
@@ -56,9 +80,10 @@ func initLogger(loglevel string) log.Logger {
 	return logger
 }
 
-// createMetrics initializes and registers all four
-// Prometheus-exposed metrics.
-func createMetrics() *Metrics {
+// createMetrics initializes and registers all
+// Prometheus-exposed metrics, including the state
+// of collector's buffer if given.
+func createMetrics(collector *collect.Client) *Metrics {
 
 	maildirDuration := prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "maildir_duration",
@@ -66,60 +91,173 @@ func createMetrics() *Metrics {
 		Buckets: []float64{.01, .02, .03, .04, .05, .06, .07, .08, .09, .10, .15, .20, .25, .30, .35, .40, .45, .50, 1},
 	})
 
-	// Register all of them with Prometheus.
-	prometheus.MustRegister(maildirDuration)
+	watchdogStalled := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "maildir_watchdog_stalled",
+		Help: "Whether the 'du -s' loop has not completed a run within the configured number of intervals",
+	})
 
-	return &Metrics{
-		duration: maildirDuration,
-	}
-}
+	watchdogRootPathOK := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "maildir_watchdog_root_path_ok",
+		Help: "Whether the Maildir root path still exists on the device it resided on at startup",
+	})
 
-func userDu(path string) ([]byte, error) {
-	cmd := exec.Command("/usr/bin/du", "-s", path)
-	return cmd.CombinedOutput()
-}
+	watchdogBacklog := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "maildir_watchdog_upload_backlog",
+		Help: "Number of dumps not yet acknowledged by the collector",
+	})
 
-// ZipFiles compresses one or many files into a single zip archive file
-func ZipFiles(root string, files []os.FileInfo) (io.Reader, error) {
+	userErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maildir_user_errors_total",
+		Help: "Number of failed samples of a single user by probe and reason",
+	}, []string{"probe", "reason"})
 
-	newfile := bytes.NewBuffer(nil)
+	missedTicks := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_scheduler_missed_ticks_total",
+		Help: "Number of ticks at which no run took place",
+	})
 
-	zipWriter := zip.NewWriter(newfile)
-	defer zipWriter.Close()
+	overruns := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_scheduler_overruns_total",
+		Help: "Number of runs that took longer than the interval",
+	})
 
-	// Add files to zip
-	for _, file := range files {
-		zipfile, err := os.Open(filepath.Join(root, file.Name()))
-		if err != nil {
-			return newfile, err
-		}
-		defer zipfile.Close()
+	userInterval := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_adaptive_interval_seconds",
+		Help: "Interval a user was last sampled at in adaptive mode",
+	}, []string{"user"})
+
+	peerUp := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_peer_up",
+		Help: "Whether the latest samples could be fetched from a peer",
+	}, []string{"peer"})
+
+	peerDivergence := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_peer_divergence",
+		Help: "Difference between the local and a peer's size of a user's Maildir as reported by 'du -s'",
+	}, []string{"peer", "user"})
+
+	peerLag := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_peer_lag_seconds",
+		Help: "For how long a user's Maildir has been diverging from a peer's",
+	}, []string{"peer", "user"})
+
+	peerDivergedUsers := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_peer_diverged_users",
+		Help: "Number of users whose Maildir currently diverges from a peer's",
+	}, []string{"peer"})
+
+	peerMaxLag := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_peer_max_lag_seconds",
+		Help: "Highest lag of any user compared to a peer",
+	}, []string{"peer"})
+
+	clockOffset := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_clock_offset_seconds",
+		Help: "Offset of the local clock to a reference clock",
+	}, []string{"ref"})
+
+	clockRTT := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maildir_clock_rtt_seconds",
+		Help: "Round trip time of the clock offset measurement to a reference",
+	}, []string{"ref"})
+
+	walkerOps := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_walker_ops_total",
+		Help: "Number of directory reads and stat calls of the throttled walker",
+	})
 
-		// Get the file information
-		info, err := zipfile.Stat()
-		if err != nil {
-			return newfile, err
-		}
+	walkerThrottled := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_walker_throttled_seconds_total",
+		Help: "Time the throttled walker spent waiting for its I/O budget",
+	})
 
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return newfile, err
-		}
+	canariesSent := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_canaries_sent_total",
+		Help: "Number of canary messages injected",
+	})
 
-		// Change to deflate to gain better compression
-		// see http://golang.org/pkg/archive/zip/#pkg-constants
-		header.Method = zip.Deflate
+	canaryErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "maildir_canary_errors_total",
+		Help: "Number of canary messages that failed to be injected",
+	})
 
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return newfile, err
-		}
-		_, err = io.Copy(writer, zipfile)
-		if err != nil {
-			return newfile, err
-		}
+	canaryLatency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "maildir_canary_latency_seconds",
+		Help:    "Time from injecting a canary message until it was first seen on this node",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	// Register all of them with Prometheus.
+	prometheus.MustRegister(maildirDuration)
+	prometheus.MustRegister(walkerOps)
+	prometheus.MustRegister(walkerThrottled)
+	prometheus.MustRegister(canariesSent)
+	prometheus.MustRegister(canaryErrors)
+	prometheus.MustRegister(canaryLatency)
+	prometheus.MustRegister(clockOffset)
+	prometheus.MustRegister(clockRTT)
+	prometheus.MustRegister(peerUp)
+	prometheus.MustRegister(peerDivergence)
+	prometheus.MustRegister(peerLag)
+	prometheus.MustRegister(peerDivergedUsers)
+	prometheus.MustRegister(peerMaxLag)
+	prometheus.MustRegister(userInterval)
+	prometheus.MustRegister(missedTicks)
+	prometheus.MustRegister(overruns)
+	prometheus.MustRegister(userErrors)
+	prometheus.MustRegister(watchdogStalled)
+	prometheus.MustRegister(watchdogRootPathOK)
+	prometheus.MustRegister(watchdogBacklog)
+
+	if collector != nil {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "maildir_collector_pending_dumps",
+			Help: "Number of dumps buffered until acknowledged by the collector",
+		}, func() float64 {
+			return float64(collector.Pending())
+		}))
+
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "maildir_collector_dropped_dumps_total",
+			Help: "Number of dumps dropped from the full collector buffer",
+		}, func() float64 {
+			return float64(collector.Dropped())
+		}))
+
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "maildir_collector_rejected_dumps_total",
+			Help: "Number of dumps dropped because the collector refused to store them",
+		}, func() float64 {
+			return float64(collector.Rejected())
+		}))
+	}
+
+	return &Metrics{
+		duration:     maildirDuration,
+		stalled:      watchdogStalled,
+		rootPathOK:   watchdogRootPathOK,
+		backlog:      watchdogBacklog,
+		userErrors:   userErrors,
+		missedTicks:  missedTicks,
+		overruns:     overruns,
+		userInterval: userInterval,
+
+		peerUp:            peerUp,
+		peerDivergence:    peerDivergence,
+		peerLag:           peerLag,
+		peerDivergedUsers: peerDivergedUsers,
+		peerMaxLag:        peerMaxLag,
+
+		clockOffset: clockOffset,
+		clockRTT:    clockRTT,
+
+		walkerOps:       walkerOps,
+		walkerThrottled: walkerThrottled,
+
+		canariesSent:  canariesSent,
+		canaryErrors:  canaryErrors,
+		canaryLatency: canaryLatency,
 	}
-	return newfile, nil
 }
 
 func main() {
@@ -129,27 +267,73 @@ func main() {
 	usersFlag := flag.String("users", "", "Users to watch, separated by comma.")
 	intervalFlag := flag.Duration("interval", 3*time.Second, "The interval to sleep between runs.")
 	workerNameFlag := flag.String("workerName", "", "The name of the worker this maildir_exporter works for.")
+	topologyFlag := flag.String("topology", "", "Specify path to a topology file to label dumps with this worker's role and replica group. Its users are watched unless given via -users.")
+	historySizeFlag := flag.Int("historySize", 1200, "Number of most recent runs to keep in memory for the samples API.")
+	adaptiveFlag := flag.String("adaptive", adaptiveOff, "Adapt the sampling rate to observed changes: 'off', 'global' for all users at once or 'user' for each user on its own.")
+	minIntervalFlag := flag.Duration("minInterval", time.Second, "Shortest interval to sample at in adaptive mode.")
+	maxIntervalFlag := flag.Duration("maxInterval", 30*time.Second, "Longest interval to back off to in adaptive mode.")
+	stableRunsFlag := flag.Int("stableRuns", 3, "Number of runs without change after which the interval is doubled in adaptive mode.")
+	gcsBucketFlag := flag.String("gcsBucket", "pluto-benchmark", "GCS bucket to upload all dumps to on shutdown. Empty disables uploading.")
+	collectorFlag := flag.String("collector", "", "Address of a collector to stream all dumps to via gRPC.")
+	collectorBufferFlag := flag.Int("collectorBuffer", 10000, "Number of dumps to buffer while the collector is unreachable.")
+	dumpVersionFlag := flag.Int("dumpVersion", dump.Version, "Format version of the dumps written, to keep them readable by older tools. Defaults to the newest.")
+	phaseFlag := flag.String("phase", "", "Phase of the benchmark, e.g. 'warmup', to mark dumps with until changed via /api/v1/phase.")
+	runIDFlag := flag.String("runID", "", "ID of the run the collector and visualizer group dumps by. Defaults to the ID recorded in -maildirDumpPath by a previous start, so that restarts continue the run, or else the start time.")
+	peersFlag := flag.String("peers", "", "Addresses of other dumpers to compare samples with, separated by comma.")
+	peerIntervalFlag := flag.Duration("peerInterval", 3*time.Second, "The interval to fetch the latest samples from peers.")
+	alertRulesFlag := flag.String("alertRules", "", "Specify path to a JSON file of alerting rules evaluated against the lags computed in peer mode.")
+	alertWebhookFlag := flag.String("alertWebhook", "", "URL to POST alerts to as JSON.")
+	alertIntervalFlag := flag.Duration("alertInterval", 10*time.Second, "The interval to evaluate alerting rules at.")
+	alertResendFlag := flag.Duration("alertResendInterval", 5*time.Minute, "The interval to resend still firing alerts at.")
+	imapAddrFlag := flag.String("imapAddr", "", "Address of an IMAP server to log into as each user and record the STATUS of their mailboxes at.")
+	imapTLSFlag := flag.Bool("imapTLS", false, "Connect to -imapAddr via TLS.")
+	imapPasswordFlag := flag.String("imapPassword", "", "Password to log in with via IMAP.")
+	imapPasswordFileFlag := flag.String("imapPasswordFile", "", "Specify path to a JSON object mapping users to their IMAP passwords, overriding -imapPassword.")
+	imapMailboxesFlag := flag.String("imapMailboxes", "", "Mailboxes to probe via IMAP, separated by comma. Defaults to all.")
+	hostMetricsFlag := flag.Bool("hostMetrics", false, "Record CPU, load, memory, disk and network statistics of the host into every dump.")
+	hostProcessFlag := flag.String("hostProcess", "", "Name of processes, e.g. 'pluto', to additionally record CPU, memory and file descriptor usage of with -hostMetrics.")
+	ioBudgetFlag := flag.Float64("ioBudget", 0, "Directory reads and stat calls per second to walk Maildirs within. Walks them by the dumper itself instead of 'du -s'. 0 disables throttling.")
+	niceFlag := flag.Int("nice", 0, "CPU niceness to run the dumper and 'du -s' at. 0 leaves it unchanged.")
+	ioniceFlag := flag.String("ionice", "", "I/O scheduling class to run the dumper and 'du -s' in: 'idle', 'best-effort[:0-7]' or 'realtime[:0-7]'.")
+	probesFlag := flag.String("probes", "", "Specify path to a JSON file of additional probes to measure every user with.")
+	canaryUserFlag := flag.String("canaryUser", "", "User whose Maildir is watched for canary messages.")
+	canaryInjectFlag := flag.Bool("canaryInject", false, "Inject canary messages into the Maildir of -canaryUser on this node. They are not measured on this node itself.")
+	canaryIntervalFlag := flag.Duration("canaryInterval", 10*time.Second, "The interval to inject canary messages at.")
+	canaryPollFlag := flag.Duration("canaryPollInterval", 100*time.Millisecond, "The interval to look for new canary messages at.")
+	canaryIMAPAddrFlag := flag.String("canaryIMAPAddr", "", "Inject canary messages via IMAP APPEND to this server instead of writing to new/.")
+	canaryIMAPTLSFlag := flag.Bool("canaryIMAPTLS", false, "Connect to -canaryIMAPAddr via TLS.")
+	canaryIMAPUserFlag := flag.String("canaryIMAPUser", "", "User to log in as via IMAP. Defaults to -canaryUser.")
+	canaryIMAPPasswordFlag := flag.String("canaryIMAPPassword", "", "Password to log in with via IMAP.")
+	clockRefsFlag := flag.String("clockRefs", "", "References to measure the clock offset against, separated by comma: dumper addresses or 'ntp://host' for SNTP. Defaults to the peers.")
+	clockIntervalFlag := flag.Duration("clockInterval", 30*time.Second, "The interval to measure the clock offset at.")
+	overrunPolicyFlag := flag.String("overrunPolicy", policySkip, "What to do with ticks passing while a run takes longer than the interval: 'skip' them, 'queue' them or 'stretch' the interval.")
+	userTimeoutFlag := flag.Duration("userTimeout", 0, "Maximum time 'du -s' and every other probe without own timeout may take for a single user. Defaults to the interval.")
+	stallIntervalsFlag := flag.Int("stallIntervals", 5, "Number of intervals without a completed run after which the 'du -s' loop is considered stalled. 0 disables the check.")
+	maxBacklogFlag := flag.Int("maxUploadBacklog", 0, "Number of dumps not yet acknowledged by -collector above which the dumper reports not ready. 0 disables the check.")
+	exitOnStallFlag := flag.Bool("exitOnStall", false, "Exit immediately, without uploading dumps, once the 'du -s' loop is considered stalled.")
 	logLevel := flag.String("logLevel", "", "Set verbosity level of logging.")
 	flag.Parse()
 
 	// Create gokit-logger based on specified verbosity level.
 	logger := initLogger(*logLevel)
 
-	// Create metrics struct.
-	metrics := createMetrics()
+	if _, err := dump.NewWriter(ioutil.Discard, *dumpVersionFlag); err != nil {
+		level.Error(logger).Log("msg", "invalid dumpVersion", "err", err)
+		os.Exit(1)
+	}
 
 	if *maildirRootPath == "" {
 		level.Error(logger).Log("msg", "please specify a maildirRootPath")
 		os.Exit(1)
 	}
 
-	if *usersFlag == "" {
-		level.Error(logger).Log("msg", "please specify users to watch")
+	if *workerNameFlag == "" {
+		level.Error(logger).Log("msg", "please specify the worker's name")
 		os.Exit(1)
 	}
 
-	if *workerNameFlag == "" {
-		level.Error(logger).Log("msg", "please specify the worker's name")
+	if *historySizeFlag < 0 {
+		level.Error(logger).Log("msg", "historySize must not be negative", "historySize", *historySizeFlag)
 		os.Exit(1)
 	}
 
@@ -158,29 +342,231 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Check that associated Google Cloud Project
-	// is set as environment variable.
-	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if projectID == "" {
-		level.Error(logger).Log("msg", "env flag must be set", "env", "GOOGLE_CLOUD_PROJECT")
+	runID, err := loadRunID(*maildirDumpPath, *runIDFlag, time.Now())
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to load run ID", "path", *maildirDumpPath, "err", err)
 		os.Exit(1)
 	}
 
-	// Make sure that we possess Application Default Credentials.
-	appCredentials := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if appCredentials == "" {
-		level.Error(logger).Log("msg", "env flag must be set", "env", "GOOGLE_APPLICATION_CREDENTIALS")
+	// The collector refuses names it cannot store
+	// safely, so reject them before any dump is taken.
+	if *collectorFlag != "" {
+		for name, value := range map[string]string{"workerName": *workerNameFlag, "runID": runID} {
+			if !collect.ValidName(value) {
+				level.Error(logger).Log(
+					"msg", "invalid name for collector, only letters, digits and '_@.-' are allowed, not starting with '.'",
+					"flag", name,
+					"value", value,
+				)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Stream dumps to a central collector if configured.
+	var collector *collect.Client
+	var backlog func() int
+	if *collectorFlag != "" {
+		collector = collect.NewClient(logger, *collectorFlag, *workerNameFlag, runID, *collectorBufferFlag)
+		backlog = collector.Pending
+	} else if *maxBacklogFlag > 0 {
+		level.Error(logger).Log("msg", "maxUploadBacklog needs a collector to upload to")
 		os.Exit(1)
 	}
 
-	// Connect to GCS for log file uploading.
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	// Create metrics struct.
+	metrics := createMetrics(collector)
+
+	var users []string
+	if *usersFlag != "" {
+		users = strings.Split(*usersFlag, ",")
+	}
+
+	// Label dumps with our place in the topology and
+	// watch the users we serve unless given explicitly.
+	var worker topology.Worker
+	if *topologyFlag != "" {
+		topo, err := topology.Load(*topologyFlag)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load topology", "err", err)
+			os.Exit(1)
+		}
+
+		var ok bool
+		worker, ok = topo.Worker(*workerNameFlag)
+		if !ok {
+			level.Error(logger).Log("msg", "worker not found in topology", "worker", *workerNameFlag, "topology", *topologyFlag)
+			os.Exit(1)
+		}
+
+		if len(users) == 0 {
+			users = worker.Users
+		}
+	}
+
+	if len(users) == 0 {
+		level.Error(logger).Log("msg", "please specify users to watch")
+		os.Exit(1)
+	}
+
+	adaptive, err := NewAdaptive(*adaptiveFlag, *minIntervalFlag, *maxIntervalFlag, *stableRunsFlag)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize adaptive sampling", "err", err)
+		os.Exit(1)
+	}
+
+	// In adaptive mode the scheduler ticks at the
+	// highest rate and users are only sampled when due.
+	interval := *intervalFlag
+	if adaptive.Enabled() {
+		interval = *minIntervalFlag
+	}
+
+	scheduler, err := NewScheduler(metrics, interval, *overrunPolicyFlag)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize scheduler", "err", err)
+		os.Exit(1)
+	}
+
+	watchdog, err := NewWatchdog(logger, metrics, *maildirRootPath, interval, *stallIntervalsFlag, *maxBacklogFlag, backlog, *exitOnStallFlag)
 	if err != nil {
-		level.Error(logger).Log("msg", "failed to open storage client", "err", err)
+		level.Error(logger).Log("msg", "failed to initialize watchdog", "err", err)
+		os.Exit(1)
+	}
+
+	var client *storage.Client
+	ctx := context.Background()
+
+	if *gcsBucketFlag != "" {
+		// Check that associated Google Cloud Project
+		// is set as environment variable.
+		projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+		if projectID == "" {
+			level.Error(logger).Log("msg", "env flag must be set", "env", "GOOGLE_CLOUD_PROJECT")
+			os.Exit(1)
+		}
+
+		// Make sure that we possess Application Default Credentials.
+		appCredentials := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if appCredentials == "" {
+			level.Error(logger).Log("msg", "env flag must be set", "env", "GOOGLE_APPLICATION_CREDENTIALS")
+			os.Exit(1)
+		}
+
+		// Connect to GCS for log file uploading.
+		client, err = storage.NewClient(ctx)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to open storage client", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Alerts can only be evaluated in peer mode
+	// as that is where lags are computed.
+	var rules []Rule
+	if *alertRulesFlag != "" {
+		if *peersFlag == "" || *alertWebhookFlag == "" {
+			level.Error(logger).Log("msg", "alerting rules require -peers and -alertWebhook")
+			os.Exit(1)
+		}
+
+		rules, err = LoadRules(*alertRulesFlag)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load alerting rules", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Measure the clock offset against the
+	// configured references or else the peers.
+	var clock *Clock
+	clockRefs := *clockRefsFlag
+	if clockRefs == "" {
+		clockRefs = *peersFlag
+	}
+	if clockRefs != "" {
+		clock = NewClock(logger, metrics, strings.Split(clockRefs, ","), *clockIntervalFlag)
+	}
+
+	timeout := *userTimeoutFlag
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	// Every user is measured by 'du -s', optionally
+	// followed by IMAP and the probes of the probes file.
+	if err := setPriority(*niceFlag, *ioniceFlag); err != nil {
+		level.Error(logger).Log("msg", "failed to lower priority", "err", err)
 		os.Exit(1)
 	}
 
+	var limiter *Limiter
+	if *ioBudgetFlag > 0 {
+		limiter = NewLimiter(*ioBudgetFlag)
+	}
+
+	probes := []Probe{
+		&fsProbe{
+			root:    *maildirRootPath,
+			timeout: timeout,
+			limiter: limiter,
+			metrics: metrics,
+		},
+	}
+
+	if *imapAddrFlag != "" {
+		var mailboxes []string
+		if *imapMailboxesFlag != "" {
+			mailboxes = strings.Split(*imapMailboxesFlag, ",")
+		}
+
+		imapProbe, err := NewIMAPProbe(*imapAddrFlag, *imapTLSFlag, timeout, *imapPasswordFileFlag, *imapPasswordFlag, mailboxes)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to set up IMAP probe", "err", err)
+			os.Exit(1)
+		}
+		probes = append(probes, imapProbe)
+	}
+
+	if *probesFlag != "" {
+		custom, err := LoadProbes(*probesFlag, timeout)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load probes", "err", err)
+			os.Exit(1)
+		}
+		probes = append(probes, custom...)
+	}
+
+	// Record resource usage of the host if requested.
+	var host *HostCollector
+	if *hostMetricsFlag {
+		host, err = NewHostCollector(*hostProcessFlag)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read host metrics", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Watch for canary messages whenever a canary user is set.
+	var canaryWatcher *CanaryWatcher
+	if *canaryUserFlag != "" {
+		canaryWatcher = NewCanaryWatcher(logger, metrics, filepath.Join(*maildirRootPath, *canaryUserFlag), *canaryPollFlag, *workerNameFlag, clock)
+	} else if *canaryInjectFlag {
+		level.Error(logger).Log("msg", "please specify the user to inject canaries for")
+		os.Exit(1)
+	}
+
+	// Keep the most recent samples in memory
+	// to serve them via the samples API.
+	history := NewHistory(*historySizeFlag)
+
+	// Mark dumps with the phase of the benchmark.
+	phases := NewPhases(logger, *phaseFlag)
+
+	// Every dump names its run and the start of this
+	// process, so restarts within a run can be stitched.
+	started := time.Now()
+
 	var g group.Group
 	{
 		stop := make(chan os.Signal, 1)
@@ -193,59 +579,195 @@ func main() {
 		}, func(error) {})
 	}
 	{
-		users := strings.Split(*usersFlag, ",")
-
 		ctx, cancel := context.WithCancel(context.Background())
-		g.Add(func() error {
-			for {
-				run := func(start time.Time) {
-					defer metrics.duration.Observe(time.Since(start).Seconds())
-
-					var combined []byte
-					for _, user := range users {
-						out, err := userDu(filepath.Join(*maildirRootPath, user))
-						if err != nil {
-							level.Warn(logger).Log(
-								"msg", "failed to run 'du -s'",
-								"user", user,
-								"err", err,
-							)
-							return
-						}
-						combined = append(combined, out...)
-					}
-
-					path := filepath.Join(*maildirDumpPath, fmt.Sprintf("%d", start.Unix()))
-					if err := ioutil.WriteFile(path, combined, 0777); err != nil {
-						level.Warn(logger).Log(
-							"msg", "failed to save dump",
-							"path", path,
-						)
-						return
-					}
+		run := func(start time.Time) {
+			defer func() {
+				metrics.duration.Observe(time.Since(start).Seconds())
+				watchdog.RunCompleted(time.Now())
+			}()
+
+			d := &dump.Dump{
+				Run: &dump.Run{
+					ID:      runID,
+					Started: started,
+				},
+				Phase: phases.Phase(),
+			}
+			if worker.Name != "" {
+				d.Worker = &dump.Worker{
+					Name:  worker.Name,
+					Role:  worker.Role,
+					Group: worker.Group,
+				}
+			}
+
+			samples := measureUsers(ctx, logger, metrics, probes, adaptive, users, start)
+			if len(samples) == 0 {
+				return
+			}
+
+			// Every sample records the interval the next
+			// one is scheduled at, as adapted to it.
+			adaptive.Observe(start, samples)
+
+			for _, sample := range samples {
+				ds := dumpSample(*maildirRootPath, sample)
+				if adaptive.Enabled() {
+					ds.Interval = adaptive.Interval(sample.User)
+					metrics.userInterval.WithLabelValues(sample.User).Set(ds.Interval.Seconds())
+				}
+				d.Samples = append(d.Samples, ds)
+			}
+			history.Add(samples)
+
+			if host != nil {
+				hostMetrics, err := host.Collect(start)
+				if err != nil {
+					level.Warn(logger).Log("msg", "failed to collect some host metrics", "err", err)
 				}
+				d.Host = hostMetrics
+			}
+
+			if clock != nil {
+				for _, m := range clock.Drain() {
+					d.Clock = append(d.Clock, dump.Clock{
+						Ref:    m.Ref,
+						Offset: m.Offset,
+						RTT:    m.RTT,
+					})
+				}
+			}
 
-				interval := int64(intervalFlag.Seconds())
-				tick := time.Tick(time.Second)
-				for {
-					select {
-					case timestamp := <-tick:
-						if timestamp.Unix()%interval == 0 {
-							run(timestamp)
-						}
-					case <-ctx.Done():
-						return nil
-					}
+			if canaryWatcher != nil {
+				for _, obs := range canaryWatcher.Drain() {
+					d.Canaries = append(d.Canaries, dump.Canary{
+						ID:      obs.ID,
+						Sent:    obs.Sent,
+						Latency: obs.Latency,
+					})
 				}
 			}
+
+			var buf bytes.Buffer
+			dw, _ := dump.NewWriter(&buf, *dumpVersionFlag)
+			if err := dw.WriteDump(d); err != nil {
+				level.Warn(logger).Log("msg", "failed to format dump", "err", err)
+				return
+			}
+			combined := buf.Bytes()
+
+			path := filepath.Join(*maildirDumpPath, dump.FormatName(start))
+			if err := ioutil.WriteFile(path, combined, 0777); err != nil {
+				level.Warn(logger).Log(
+					"msg", "failed to save dump",
+					"path", path,
+				)
+				return
+			}
+
+			if collector != nil {
+				collector.Push(dump.FormatName(start), combined)
+			}
+		}
+
+		g.Add(func() error {
+			return scheduler.Run(ctx, run)
 		}, func(err error) {
 			level.Info(logger).Log("msg", "shutting down 'du -s' loop")
 			cancel()
 		})
 	}
+	if collector != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return collector.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if canaryWatcher != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return canaryWatcher.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *canaryInjectFlag {
+		imapUser := *canaryIMAPUserFlag
+		if imapUser == "" {
+			imapUser = *canaryUserFlag
+		}
+
+		canaryWriter := &CanaryWriter{
+			logger:       logger,
+			metrics:      metrics,
+			worker:       *workerNameFlag,
+			maildir:      filepath.Join(*maildirRootPath, *canaryUserFlag),
+			interval:     *canaryIntervalFlag,
+			clock:        clock,
+			imapAddr:     *canaryIMAPAddrFlag,
+			imapTLS:      *canaryIMAPTLSFlag,
+			imapUser:     imapUser,
+			imapPassword: *canaryIMAPPasswordFlag,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return canaryWriter.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if clock != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return clock.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *peersFlag != "" {
+		peers := NewPeers(logger, metrics, history, adaptive, strings.Split(*peersFlag, ","), *peerIntervalFlag)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return peers.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+
+		if rules != nil {
+			alerter := NewAlerter(logger, peers, rules, *alertWebhookFlag, *workerNameFlag, *alertIntervalFlag, *alertResendFlag)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return alerter.Run(ctx)
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return watchdog.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		// Define where we want to expose metrics via HTTP.
 		http.Handle("/metrics", promhttp.Handler())
+
+		api := &API{
+			logger:  logger,
+			history: history,
+		}
+		api.Register(http.DefaultServeMux)
+		watchdog.Register(http.DefaultServeMux)
+		phases.Register(http.DefaultServeMux)
+
 		server := &http.Server{Addr: ":9275"}
 
 		g.Add(func() error {
@@ -284,15 +806,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	if client == nil {
+		return
+	}
+
 	// When gracefully shutting down, upload all dumps to GCS.
 
-	files, err := ioutil.ReadDir(*maildirDumpPath)
-	if err != nil {
-		level.Error(logger).Log("msg", "failed to read dump dir for uploading", "err", err)
-		os.Exit(1)
-	}
+	var zipFile bytes.Buffer
 
-	zipFile, err := ZipFiles(*maildirDumpPath, files)
+	aw := dump.NewArchiveWriter(&zipFile)
+	err = aw.AddDir(*maildirDumpPath)
+	if err == nil {
+		err = aw.Close()
+	}
 	if err != nil {
 		level.Error(logger).Log(
 			"msg", "failed to create zip file",
@@ -301,7 +827,7 @@ func main() {
 		os.Exit(3)
 	}
 
-	bucket := client.Bucket("pluto-benchmark")
+	bucket := client.Bucket(*gcsBucketFlag)
 	obj := bucket.Object(fmt.Sprintf("maildirs/%d-%s.zip", time.Now().Unix(), *workerNameFlag)).NewWriter(ctx)
 	defer func() {
 		if err = obj.Close(); err != nil {
@@ -309,7 +835,7 @@ func main() {
 		}
 	}()
 
-	_, err = io.Copy(obj, zipFile)
+	_, err = io.Copy(obj, &zipFile)
 	if err != nil {
 		level.Error(logger).Log(
 			"msg", "failed to upload zipfile to gcs",
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// PeerLag describes how far one user's
+// Maildir has diverged from a peer's.
+type PeerLag struct {
+	Peer       string        `json:"peer"`
+	User       string        `json:"user"`
+	Divergence int64         `json:"divergence"`
+	Since      time.Time     `json:"since,omitempty"`
+	Lag        time.Duration `json:"lag"`
+}
+
+// Peers periodically pulls the latest samples of other
+// dumpers and compares them to the local ones. A user
+// whose sizes differ is considered lagging for as long
+// as the difference persists.
+type Peers struct {
+	logger   log.Logger
+	metrics  *Metrics
+	history  *History
+	adaptive *Adaptive
+	client   *http.Client
+	addrs    []string
+	interval time.Duration
+
+	mu   sync.RWMutex
+	lags map[string]map[string]*PeerLag
+}
+
+// NewPeers returns Peers polling the dumpers
+// listening on addrs once per interval.
+func NewPeers(logger log.Logger, metrics *Metrics, history *History, adaptive *Adaptive, addrs []string, interval time.Duration) *Peers {
+
+	lags := make(map[string]map[string]*PeerLag)
+	for _, addr := range addrs {
+		lags[addr] = make(map[string]*PeerLag)
+	}
+
+	return &Peers{
+		logger:   logger,
+		metrics:  metrics,
+		history:  history,
+		adaptive: adaptive,
+		client: &http.Client{
+			Timeout: interval,
+		},
+		addrs:    addrs,
+		interval: interval,
+		lags:     lags,
+	}
+}
+
+// Run polls all peers once per interval until ctx is done.
+func (p *Peers) Run(ctx context.Context) error {
+
+	tick := time.NewTicker(p.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			var wg sync.WaitGroup
+			for _, addr := range p.addrs {
+				wg.Add(1)
+				go func(addr string) {
+					defer wg.Done()
+					p.poll(ctx, addr)
+				}(addr)
+			}
+			wg.Wait()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Lags returns the current state of
+// every user compared to every peer.
+func (p *Peers) Lags() []PeerLag {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var lags []PeerLag
+	for _, users := range p.lags {
+		for _, lag := range users {
+			lags = append(lags, *lag)
+		}
+	}
+
+	return lags
+}
+
+// poll fetches the latest samples of the peer at addr
+// and updates lag and divergence of all users. Users
+// that cannot be compared, as either side failed to
+// sample them or lacks them, are forgotten, all of
+// them if the peer is unreachable.
+func (p *Peers) poll(ctx context.Context, addr string) {
+
+	remote, err := p.fetch(ctx, addr)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to fetch samples from peer", "peer", addr, "err", err)
+		p.metrics.peerUp.WithLabelValues(addr).Set(0)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		for user := range p.lags[addr] {
+			p.forget(addr, user)
+		}
+		p.metrics.peerDivergedUsers.DeleteLabelValues(addr)
+		p.metrics.peerMaxLag.DeleteLabelValues(addr)
+
+		return
+	}
+	p.metrics.peerUp.WithLabelValues(addr).Set(1)
+
+	local := make(map[string]Sample)
+	for _, s := range p.history.Latest("") {
+		local[s.User] = s
+	}
+
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var diverged int
+	var maxLag time.Duration
+
+	compared := make(map[string]bool)
+
+	for _, r := range remote {
+
+		l, ok := local[r.User]
+		if !ok || l.Error != "" || r.Error != "" {
+			continue
+		}
+		compared[r.User] = true
+
+		lag, ok := p.lags[addr][r.User]
+		if !ok {
+			lag = &PeerLag{
+				Peer: addr,
+				User: r.User,
+			}
+			p.lags[addr][r.User] = lag
+		}
+
+		lag.Divergence = l.Size - r.Size
+
+		if lag.Divergence == 0 {
+			lag.Since = time.Time{}
+			lag.Lag = 0
+		} else {
+			if lag.Since.IsZero() {
+				lag.Since = now
+				p.adaptive.Hot(r.User, now)
+			}
+			lag.Lag = now.Sub(lag.Since)
+			diverged++
+		}
+
+		if lag.Lag > maxLag {
+			maxLag = lag.Lag
+		}
+
+		p.metrics.peerDivergence.WithLabelValues(addr, r.User).Set(float64(lag.Divergence))
+		p.metrics.peerLag.WithLabelValues(addr, r.User).Set(lag.Lag.Seconds())
+	}
+
+	for user := range p.lags[addr] {
+		if !compared[user] {
+			p.forget(addr, user)
+		}
+	}
+
+	p.metrics.peerDivergedUsers.WithLabelValues(addr).Set(float64(diverged))
+	p.metrics.peerMaxLag.WithLabelValues(addr).Set(maxLag.Seconds())
+}
+
+// forget drops the lag of user behind the peer at addr
+// and its gauges. p.mu must be held.
+func (p *Peers) forget(addr string, user string) {
+
+	delete(p.lags[addr], user)
+
+	p.metrics.peerDivergence.DeleteLabelValues(addr, user)
+	p.metrics.peerLag.DeleteLabelValues(addr, user)
+}
+
+// fetch requests the latest samples from the peer at addr.
+func (p *Peers) fetch(ctx context.Context, addr string) ([]Sample, error) {
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/v1/latest", addr), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var samples []Sample
+	if err := json.NewDecoder(resp.Body).Decode(&samples); err != nil {
+		return nil, fmt.Errorf("failed to decode samples: %v", err)
+	}
+
+	return samples, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newPeerMetrics returns Metrics holding the unregistered
+// gauges of peer mode, as every test creates its own.
+func newPeerMetrics() *Metrics {
+
+	gauge := func(name string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, labels)
+	}
+
+	return &Metrics{
+		peerUp:            gauge("up", "peer"),
+		peerDivergence:    gauge("divergence", "peer", "user"),
+		peerLag:           gauge("lag", "peer", "user"),
+		peerDivergedUsers: gauge("diverged", "peer"),
+		peerMaxLag:        gauge("max_lag", "peer"),
+	}
+}
+
+// gaugeValues returns the values of all series of c
+// by their label values, joined by '/'.
+func gaugeValues(t *testing.T, c prometheus.Collector) map[string]float64 {
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	values := make(map[string]float64)
+	for m := range ch {
+
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+
+		var labels []string
+		for _, pair := range metric.Label {
+			labels = append(labels, pair.GetValue())
+		}
+		values[strings.Join(labels, "/")] = metric.GetGauge().GetValue()
+	}
+
+	return values
+}
+
+// fakePeer serves samples as /api/v1/latest of a dumper,
+// failing with status while it is set.
+type fakePeer struct {
+	mu      sync.Mutex
+	samples []Sample
+	status  int
+}
+
+func (f *fakePeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.status != 0 {
+		http.Error(w, "unavailable", f.status)
+		return
+	}
+
+	json.NewEncoder(w).Encode(f.samples)
+}
+
+func (f *fakePeer) set(status int, samples ...Sample) {
+	f.mu.Lock()
+	f.status, f.samples = status, samples
+	f.mu.Unlock()
+}
+
+// compared returns the users compared to any peer, sorted.
+func compared(p *Peers) []string {
+
+	var users []string
+	for _, lag := range p.Lags() {
+		users = append(users, lag.User)
+	}
+	sort.Strings(users)
+
+	return users
+}
+
+func TestPeersForgetIncomparableUsers(t *testing.T) {
+
+	peer := &fakePeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	adaptive, err := NewAdaptive(adaptiveOff, time.Second, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := newPeerMetrics()
+	history := NewHistory(10)
+	p := NewPeers(log.NewNopLogger(), metrics, history, adaptive, []string{addr}, time.Second)
+
+	history.Add([]Sample{
+		{User: "u1", Size: 10},
+		{User: "u2", Size: 5},
+		{User: "u3", Size: 7},
+	})
+	peer.set(0, Sample{User: "u1", Size: 8}, Sample{User: "u2", Size: 5}, Sample{User: "u3", Size: 7})
+
+	p.poll(context.Background(), addr)
+
+	if users := compared(p); strings.Join(users, ",") != "u1,u2,u3" {
+		t.Fatalf("expected all users compared, got %v", users)
+	}
+	if v := gaugeValues(t, metrics.peerDivergence)[addr+"/u1"]; v != 2 {
+		t.Errorf("expected u1 to diverge by 2, got %v", v)
+	}
+
+	// u2 failed on the peer, u3 is gone from it
+	// and u1 fails locally while diverging.
+	history.Add([]Sample{
+		{User: "u1", Error: "du failed"},
+		{User: "u2", Size: 5},
+		{User: "u3", Size: 7},
+		{User: "u4", Size: 1},
+	})
+	peer.set(0, Sample{User: "u1", Size: 8}, Sample{User: "u2", Error: "du failed"}, Sample{User: "u4", Size: 1})
+
+	p.poll(context.Background(), addr)
+
+	if users := compared(p); strings.Join(users, ",") != "u4" {
+		t.Errorf("expected only u4 compared, got %v", users)
+	}
+	for _, gauge := range []*prometheus.GaugeVec{metrics.peerDivergence, metrics.peerLag} {
+		values := gaugeValues(t, gauge)
+		if _, ok := values[addr+"/u4"]; len(values) != 1 || !ok {
+			t.Errorf("expected gauges of u4 only, got %v", values)
+		}
+	}
+	if v := gaugeValues(t, metrics.peerDivergedUsers)[addr]; v != 0 {
+		t.Errorf("expected no user diverged, got %v", v)
+	}
+}
+
+func TestPeersForgetUnreachablePeer(t *testing.T) {
+
+	peer := &fakePeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	adaptive, err := NewAdaptive(adaptiveOff, time.Second, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := newPeerMetrics()
+	history := NewHistory(10)
+	p := NewPeers(log.NewNopLogger(), metrics, history, adaptive, []string{addr}, time.Second)
+
+	history.Add([]Sample{{User: "u1", Size: 10}})
+	peer.set(0, Sample{User: "u1", Size: 8})
+
+	p.poll(context.Background(), addr)
+	if len(p.Lags()) != 1 {
+		t.Fatalf("expected u1 to lag, got %+v", p.Lags())
+	}
+
+	peer.set(http.StatusServiceUnavailable)
+	p.poll(context.Background(), addr)
+
+	if lags := p.Lags(); len(lags) != 0 {
+		t.Errorf("expected lags of an unreachable peer to be dropped, got %+v", lags)
+	}
+
+	for _, gauge := range []*prometheus.GaugeVec{metrics.peerDivergence, metrics.peerLag, metrics.peerDivergedUsers, metrics.peerMaxLag} {
+		if values := gaugeValues(t, gauge); len(values) != 0 {
+			t.Errorf("expected gauges of an unreachable peer to be deleted, got %v", values)
+		}
+	}
+	if v := gaugeValues(t, metrics.peerUp)[addr]; v != 0 {
+		t.Errorf("expected peer to be down, got %v", v)
+	}
+
+	// The lag starts anew once the peer is back.
+	peer.set(0, Sample{User: "u1", Size: 8})
+	p.poll(context.Background(), addr)
+	if lags := p.Lags(); len(lags) != 1 || lags[0].Lag != 0 {
+		t.Errorf("expected u1 to lag anew, got %+v", lags)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Phases holds the phase of the benchmark, e.g. 'warmup',
+// that dumps are marked with. Benchmarks announce a new
+// phase via the API.
+type Phases struct {
+	logger log.Logger
+
+	mu    sync.RWMutex
+	phase string
+}
+
+// NewPhases returns Phases starting in phase.
+func NewPhases(logger log.Logger, phase string) *Phases {
+	return &Phases{
+		logger: logger,
+		phase:  phase,
+	}
+}
+
+// Phase returns the current phase, empty if unmarked.
+func (p *Phases) Phase() string {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.phase
+}
+
+// Set marks all dumps taken from now on with phase.
+func (p *Phases) Set(phase string) {
+
+	p.mu.Lock()
+	prev := p.phase
+	p.phase = phase
+	p.mu.Unlock()
+
+	if prev != phase {
+		level.Info(p.logger).Log(
+			"msg", "benchmark entered new phase",
+			"phase", phase,
+			"previous", prev,
+		)
+	}
+}
+
+// Register attaches the phase endpoint to mux.
+func (p *Phases) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/phase", p.handlePhase)
+}
+
+// handlePhase returns the current phase and sets
+// it to the one given via 'name' on PUT or POST.
+func (p *Phases) handlePhase(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		name := r.URL.Query().Get("name")
+		if strings.ContainsAny(name, "\t\n") {
+			http.Error(w, "invalid 'name': must not contain tabs or newlines", http.StatusBadRequest)
+			return
+		}
+		p.Set(name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Phase string `json:"phase"`
+	}{p.Phase()})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// I/O scheduling classes of ioprio_set(2).
+var ioClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// setPriority applies the CPU niceness nice, if not 0, and
+// the I/O scheduling class ioClass, e.g. 'idle' or
+// 'best-effort:7', if not empty, to all threads of the
+// dumper. Threads and commands started later inherit both.
+func setPriority(nice int, ioClass string) error {
+
+	ioprio := -1
+	if ioClass != "" {
+
+		parts := strings.SplitN(ioClass, ":", 2)
+
+		class, ok := ioClasses[parts[0]]
+		if !ok {
+			return fmt.Errorf("unknown I/O class %q", parts[0])
+		}
+
+		level := 0
+		if len(parts) == 2 {
+			var err error
+			level, err = strconv.Atoi(parts[1])
+			if err != nil || level < 0 || level > 7 {
+				return fmt.Errorf("I/O class level must be 0 to 7, got %q", parts[1])
+			}
+		}
+
+		ioprio = class<<13 | level
+	}
+
+	// Both niceness and I/O priority are set per thread.
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		if nice != 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+				return fmt.Errorf("failed to set niceness: %v", err)
+			}
+		}
+
+		if ioprio >= 0 {
+			// IOPRIO_WHO_PROCESS addresses a single thread.
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, 1, uintptr(tid), uintptr(ioprio)); errno != 0 {
+				return fmt.Errorf("failed to set I/O class: %v", errno)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// setPriority is only supported on Linux.
+func setPriority(nice int, ioClass string) error {
+
+	if nice != 0 || ioClass != "" {
+		return fmt.Errorf("setting niceness and I/O class is only supported on Linux")
+	}
+
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Kinds of probes configurable in the probes file.
+const (
+	probeExec = "exec"
+	probeHTTP = "http"
+)
+
+// Probe takes one kind of measurement of a user and
+// records it in the user's sample of the current run.
+type Probe interface {
+	// Name namespaces the fields and errors of the probe.
+	Name() string
+
+	// Timeout bounds a single measurement.
+	Timeout() time.Duration
+
+	// Measure measures user and records the result in
+	// sample. The returned error is accounted to the probe,
+	// a *probeError additionally carries the reason.
+	Measure(ctx context.Context, user string, sample *Sample) error
+}
+
+// probeError is a failed measurement
+// along with the reason it failed for.
+type probeError struct {
+	reason string
+	msg    string
+}
+
+func (e *probeError) Error() string {
+	return e.msg
+}
+
+// ProbeConfig is a single probe as read from the probes file.
+// '{user}' in Command and URL is replaced by the user probed.
+type ProbeConfig struct {
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	Command []string `json:"command,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// LoadProbes reads the JSON probes file at path and returns
+// its probes. Probes without timeout use defaultTimeout.
+func LoadProbes(path string, defaultTimeout time.Duration) ([]Probe, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var configs []ProbeConfig
+	if err := json.NewDecoder(f).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("failed to parse probes %s: %v", path, err)
+	}
+
+	names := map[string]bool{
+		fsProbeName:   true,
+		imapProbeName: true,
+	}
+
+	probes := make([]Probe, 0, len(configs))
+	for i, c := range configs {
+
+		if c.Name == "" || strings.ContainsAny(c.Name, ". \t\n") {
+			return nil, fmt.Errorf("probe %d needs a name without dots and whitespace", i)
+		}
+
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate probe %q", c.Name)
+		}
+		names[c.Name] = true
+
+		timeout := defaultTimeout
+		if c.Timeout != "" {
+			timeout, err = time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("probe %q has invalid timeout: %v", c.Name, err)
+			}
+		}
+
+		switch c.Kind {
+		case probeExec:
+			if len(c.Command) == 0 {
+				return nil, fmt.Errorf("probe %q needs a command", c.Name)
+			}
+			probes = append(probes, &execProbe{
+				name:    c.Name,
+				timeout: timeout,
+				command: c.Command,
+			})
+
+		case probeHTTP:
+			if c.URL == "" {
+				return nil, fmt.Errorf("probe %q needs a URL", c.Name)
+			}
+			probes = append(probes, &httpProbe{
+				name:    c.Name,
+				timeout: timeout,
+				url:     c.URL,
+				client:  &http.Client{},
+			})
+
+		default:
+			return nil, fmt.Errorf("probe %q has unknown kind %q", c.Name, c.Kind)
+		}
+	}
+
+	return probes, nil
+}
+
+// measure runs all probes on user, each within its own
+// timeout, and merges their results into one sample.
+// A failing probe does not keep the others from running.
+func measure(ctx context.Context, logger log.Logger, metrics *Metrics, probes []Probe, user string, timestamp time.Time) Sample {
+
+	sample := Sample{
+		Timestamp: timestamp,
+		User:      user,
+	}
+
+	for _, p := range probes {
+
+		pctx, cancel := context.WithTimeout(ctx, p.Timeout())
+		err := p.Measure(pctx, user, &sample)
+		timedOut := pctx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if err == nil {
+			continue
+		}
+
+		reason := reasonFailed
+		if perr, ok := err.(*probeError); ok {
+			reason = perr.reason
+		} else if timedOut {
+			reason = reasonTimeout
+		}
+
+		level.Warn(logger).Log(
+			"msg", "failed to sample user",
+			"user", user,
+			"probe", p.Name(),
+			"reason", reason,
+			"err", err,
+		)
+		metrics.userErrors.WithLabelValues(p.Name(), reason).Inc()
+
+		if sample.ProbeErrors == nil {
+			sample.ProbeErrors = make(map[string]string)
+		}
+		sample.ProbeErrors[p.Name()] = err.Error()
+	}
+
+	return sample
+}
+
+// setField records value under the field
+// name of probe in the sample.
+func (s *Sample) setField(probe string, name string, value float64) {
+
+	if s.Fields == nil {
+		s.Fields = make(map[string]float64)
+	}
+
+	s.Fields[probe+"."+name] = value
+}
+
+// execProbe runs a command per user. Each line of its
+// standard output is a field: '<name> <number>'.
+type execProbe struct {
+	name    string
+	timeout time.Duration
+	command []string
+}
+
+func (p *execProbe) Name() string {
+	return p.name
+}
+
+func (p *execProbe) Timeout() time.Duration {
+	return p.timeout
+}
+
+func (p *execProbe) Measure(ctx context.Context, user string, sample *Sample) error {
+
+	args := make([]string, len(p.command))
+	for i, arg := range p.command {
+		args[i] = strings.Replace(arg, "{user}", user, -1)
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return &probeError{reasonTimeout, fmt.Sprintf("%s timed out after %s", args[0], p.timeout)}
+		}
+		return fmt.Errorf("%s failed: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// Fields are only recorded once all lines parsed,
+	// so a failed measurement does not leave some behind.
+	values := make(map[string]float64)
+
+	for i, line := range strings.Split(stdout.String(), "\n") {
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return fmt.Errorf("%s printed malformed line %d: %q", args[0], i+1, line)
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("%s printed malformed line %d: %q", args[0], i+1, line)
+		}
+
+		values[fields[0]] = value
+	}
+
+	for name, value := range values {
+		sample.setField(p.name, name, value)
+	}
+
+	return nil
+}
+
+// httpProbe GETs a JSON object per user. All numbers and
+// booleans in it are fields, nested objects are flattened
+// with their keys joined by dots.
+type httpProbe struct {
+	name    string
+	timeout time.Duration
+	url     string
+	client  *http.Client
+}
+
+func (p *httpProbe) Name() string {
+	return p.name
+}
+
+func (p *httpProbe) Timeout() time.Duration {
+	return p.timeout
+}
+
+func (p *httpProbe) Measure(ctx context.Context, user string, sample *Sample) error {
+
+	req, err := http.NewRequest(http.MethodGet, strings.Replace(p.url, "{user}", url.PathEscape(user), -1), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	flattenFields(sample, p.name, "", body)
+
+	return nil
+}
+
+// flattenFields records all numbers and booleans of
+// obj as fields of probe, prefixing their keys.
+func flattenFields(sample *Sample, probe string, prefix string, obj map[string]interface{}) {
+
+	for key, value := range obj {
+		switch v := value.(type) {
+		case float64:
+			sample.setField(probe, prefix+key, v)
+		case bool:
+			sample.setField(probe, prefix+key, boolToFloat(v))
+		case map[string]interface{}:
+			flattenFields(sample, probe, prefix+key+".", v)
+		}
+	}
+}
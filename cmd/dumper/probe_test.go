@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecProbe(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		fields  map[string]float64
+		err     string
+		reason  string
+	}{
+		{
+			name:   "fields",
+			script: `printf 'used 12\n\nquota 1.5e3\n  inodes   7  \n'`,
+			fields: map[string]float64{"quota.used": 12, "quota.quota": 1500, "quota.inodes": 7},
+		},
+		{
+			name:   "user substituted",
+			script: `echo "$1 1"`,
+			fields: map[string]float64{"quota.user1": 1},
+		},
+		{
+			name:   "no output",
+			script: `true`,
+		},
+		{
+			name:   "malformed line after fields",
+			script: `printf 'used 12\nquota\n'`,
+			err:    `sh printed malformed line 2: "quota"`,
+		},
+		{
+			name:   "value not a number",
+			script: `printf 'used 12\nquota many\n'`,
+			err:    `sh printed malformed line 2: "quota many"`,
+		},
+		{
+			name:   "failing command",
+			script: `echo 'used 12'; echo 'no such user' >&2; exit 3`,
+			err:    "sh failed: exit status 3: no such user",
+		},
+		{
+			name:    "timeout",
+			script:  `echo 'used 12'; exec sleep 10`,
+			timeout: 50 * time.Millisecond,
+			err:     "sh timed out after 50ms",
+			reason:  reasonTimeout,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+
+			p := &execProbe{
+				name:    "quota",
+				timeout: timeout,
+				command: []string{"sh", "-c", test.script, "sh", "{user}"},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.Timeout())
+			defer cancel()
+
+			var sample Sample
+			err := p.Measure(ctx, "user1", &sample)
+
+			if test.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+			if perr, ok := err.(*probeError); test.reason != "" && (!ok || perr.reason != test.reason) {
+				t.Errorf("expected reason %s, got %v", test.reason, err)
+			}
+
+			// Failed measurements leave no fields behind.
+			if !reflect.DeepEqual(sample.Fields, test.fields) {
+				t.Errorf("expected fields %v, got %v", test.fields, sample.Fields)
+			}
+		})
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if accept := r.Header.Get("Accept"); accept != "application/json" {
+			http.Error(w, "expected JSON to be accepted, got "+accept, http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/users/user%201":
+			w.Write([]byte(`{"messages": 12, "active": true, "locked": false, "name": "user 1", "quota": {"used": 3, "limit": {"soft": 10}}, "tags": [1, 2]}`))
+		case "/users/unknown":
+			http.Error(w, "no such user", http.StatusNotFound)
+		case "/users/invalid":
+			w.Write([]byte(`{"messages": 12,`))
+		case "/users/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		default:
+			http.Error(w, "unexpected path "+r.URL.EscapedPath(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	p := &httpProbe{
+		name:    "admin",
+		timeout: 10 * time.Second,
+		url:     server.URL + "/users/{user}",
+		client:  &http.Client{},
+	}
+
+	tests := []struct {
+		user    string
+		timeout time.Duration
+		fields  map[string]float64
+		err     string
+	}{
+		{
+			user: "user 1",
+			fields: map[string]float64{
+				"admin.messages":         12,
+				"admin.active":           1,
+				"admin.locked":           0,
+				"admin.quota.used":       3,
+				"admin.quota.limit.soft": 10,
+			},
+		},
+		{
+			user: "unknown",
+			err:  "unexpected status 404 Not Found",
+		},
+		{
+			user: "invalid",
+			err:  "failed to parse response: unexpected EOF",
+		},
+		{
+			user:    "slow",
+			timeout: 50 * time.Millisecond,
+			err:     "context deadline exceeded",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = p.Timeout()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			var sample Sample
+			err := p.Measure(ctx, test.user, &sample)
+
+			if test.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(sample.Fields, test.fields) {
+				t.Errorf("expected fields %v, got %v", test.fields, sample.Fields)
+			}
+		})
+	}
+}
+
+func TestLoadProbes(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		config string
+		probes []Probe
+		err    string
+	}{
+		{
+			name: "valid",
+			config: `[
+				{"name": "quota", "kind": "exec", "command": ["quota-of", "{user}"], "timeout": "2s"},
+				{"name": "admin", "kind": "http", "url": "http://localhost/users/{user}"}
+			]`,
+			probes: []Probe{
+				&execProbe{name: "quota", timeout: 2 * time.Second, command: []string{"quota-of", "{user}"}},
+				&httpProbe{name: "admin", timeout: 5 * time.Second, url: "http://localhost/users/{user}", client: &http.Client{}},
+			},
+		},
+		{
+			name:   "not JSON",
+			config: `[{"name": "quota",`,
+			err:    "failed to parse probes",
+		},
+		{
+			name:   "name with dot",
+			config: `[{"name": "quota.used", "kind": "exec", "command": ["quota-of"]}]`,
+			err:    "probe 0 needs a name without dots and whitespace",
+		},
+		{
+			name:   "reserved name",
+			config: `[{"name": "du", "kind": "exec", "command": ["du"]}]`,
+			err:    `duplicate probe "du"`,
+		},
+		{
+			name:   "duplicate name",
+			config: `[{"name": "quota", "kind": "exec", "command": ["a"]}, {"name": "quota", "kind": "exec", "command": ["b"]}]`,
+			err:    `duplicate probe "quota"`,
+		},
+		{
+			name:   "invalid timeout",
+			config: `[{"name": "quota", "kind": "exec", "command": ["a"], "timeout": "2"}]`,
+			err:    `probe "quota" has invalid timeout`,
+		},
+		{
+			name:   "missing command",
+			config: `[{"name": "quota", "kind": "exec"}]`,
+			err:    `probe "quota" needs a command`,
+		},
+		{
+			name:   "missing URL",
+			config: `[{"name": "admin", "kind": "http"}]`,
+			err:    `probe "admin" needs a URL`,
+		},
+		{
+			name:   "unknown kind",
+			config: `[{"name": "admin", "kind": "grpc"}]`,
+			err:    `probe "admin" has unknown kind "grpc"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			path := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1)+".json")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			probes, err := LoadProbes(path, 5*time.Second)
+
+			if test.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+			if test.err == "" && !reflect.DeepEqual(probes, test.probes) {
+				t.Errorf("expected probes %+v, got %+v", test.probes, probes)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runFile names the file in the dump folder holding the ID
+// of the run its dumps belong to. It is hidden, so that
+// it is neither uploaded nor read as a dump.
+const runFile = ".run"
+
+// loadRunID returns the ID of the run dumps into dir belong
+// to: id if given, else the one recorded by a previous start,
+// else a new one named after started. The result is recorded,
+// so that restarts with the same folder continue the run.
+func loadRunID(dir string, id string, started time.Time) (string, error) {
+
+	p := filepath.Join(dir, runFile)
+
+	if id == "" {
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		id = strings.TrimSpace(string(data))
+		if id != "" {
+			return id, nil
+		}
+
+		id = fmt.Sprintf("%d", started.Unix())
+	}
+
+	if err := ioutil.WriteFile(p, []byte(id+"\n"), 0666); err != nil {
+		return "", fmt.Errorf("failed to record run ID: %v", err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// Reasons recorded for failed samples.
+const (
+	reasonTimeout  = "timeout"
+	reasonVanished = "vanished"
+	reasonFailed   = "failed"
+)
+
+// userDu runs 'du -s' on path and returns
+// its standard output and error separately.
+func userDu(ctx context.Context, path string) ([]byte, []byte, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "/usr/bin/du", "-s", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// fsProbeName names the filesystem probe.
+const fsProbeName = "du"
+
+// fsProbe measures the size of a user's Maildir via
+// 'du -s'. Its result is the size of the sample, a
+// failure is recorded as the sample's error. Given a
+// limiter, the Maildir is walked by the dumper itself
+// within the limiter's I/O budget instead.
+type fsProbe struct {
+	root    string
+	timeout time.Duration
+	limiter *Limiter
+	metrics *Metrics
+}
+
+func (p *fsProbe) Name() string {
+	return fsProbeName
+}
+
+func (p *fsProbe) Timeout() time.Duration {
+	return p.timeout
+}
+
+func (p *fsProbe) Measure(ctx context.Context, user string, sample *Sample) error {
+
+	err := p.measure(ctx, user, sample)
+	if err != nil {
+		sample.Error = err.Error()
+	}
+
+	return err
+}
+
+func (p *fsProbe) measure(ctx context.Context, user string, sample *Sample) error {
+
+	path := filepath.Join(p.root, user)
+
+	// A user whose Maildir is gone is not an
+	// error of 'du -s' and reported as such.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &probeError{reasonVanished, "maildir vanished"}
+	}
+
+	if p.limiter != nil {
+		return p.walk(ctx, path, sample)
+	}
+
+	stdout, stderr, err := userDu(ctx, path)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &probeError{reasonTimeout, fmt.Sprintf("'du -s' timed out after %s", p.timeout)}
+	}
+
+	// Messages moving from new/ to cur/ while 'du -s' walks
+	// the Maildir make it exit non-zero, yet the total it
+	// reports is still valid. Only treat the run as failed
+	// if no total was reported or the Maildir is gone now.
+	size, parseErr := parseDu(stdout)
+
+	if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+		return &probeError{reasonVanished, "maildir vanished during 'du -s'"}
+	}
+
+	if parseErr != nil {
+		if err != nil {
+			return &probeError{reasonFailed, fmt.Sprintf("'du -s' failed: %v: %s", err, bytes.TrimSpace(stderr))}
+		}
+		return &probeError{reasonFailed, parseErr.Error()}
+	}
+
+	sample.Size = size
+
+	return nil
+}
+
+// walk measures path by walkDu and records the number of
+// I/O operations and time spent throttled as fields.
+func (p *fsProbe) walk(ctx context.Context, path string, sample *Sample) error {
+
+	size, stats, err := walkDu(ctx, path, p.limiter)
+
+	p.metrics.walkerOps.Add(float64(stats.ops))
+	p.metrics.walkerThrottled.Add(stats.throttled.Seconds())
+	sample.setField(fsProbeName, "ops", float64(stats.ops))
+	sample.setField(fsProbeName, "throttled_seconds", stats.throttled.Seconds())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &probeError{reasonTimeout, fmt.Sprintf("walk timed out after %s", p.timeout)}
+	}
+
+	if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+		return &probeError{reasonVanished, "maildir vanished during walk"}
+	}
+
+	if err != nil {
+		return &probeError{reasonFailed, fmt.Sprintf("walk failed: %v", err)}
+	}
+
+	sample.Size = size
+
+	return nil
+}
+
+// measureUsers measures all users due at start one after
+// the other. Users failing to be measured are recorded with
+// their errors and never keep the others from being measured.
+func measureUsers(ctx context.Context, logger log.Logger, metrics *Metrics, probes []Probe, adaptive *Adaptive, users []string, start time.Time) []Sample {
+
+	samples := make([]Sample, 0, len(users))
+	for _, user := range users {
+		if !adaptive.Due(user, start) {
+			continue
+		}
+
+		samples = append(samples, measure(ctx, logger, metrics, probes, user, start))
+	}
+
+	return samples
+}
+
+// dumpSample converts sample into what a dump records
+// about the user's Maildir. Failures of the 'du' and IMAP
+// probes are recorded as such, those of others by probe.
+func dumpSample(root string, sample Sample) dump.Sample {
+
+	ds := dump.Sample{
+		Path:      filepath.Join(root, sample.User),
+		Size:      sample.Size,
+		Error:     sample.Error,
+		Mailboxes: sample.Mailboxes,
+		IMAPError: sample.ProbeErrors[imapProbeName],
+		Fields:    sample.Fields,
+	}
+
+	for probe, msg := range sample.ProbeErrors {
+		if probe == fsProbeName || probe == imapProbeName {
+			continue
+		}
+
+		if ds.ProbeErrors == nil {
+			ds.ProbeErrors = make(map[string]string)
+		}
+		ds.ProbeErrors[probe] = msg
+	}
+
+	return ds
+}
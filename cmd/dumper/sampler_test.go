@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// funcProbe is a probe measuring by a function.
+type funcProbe struct {
+	name    string
+	timeout time.Duration
+	measure func(ctx context.Context, user string, sample *Sample) error
+}
+
+func (p *funcProbe) Name() string {
+	return p.name
+}
+
+func (p *funcProbe) Timeout() time.Duration {
+	return p.timeout
+}
+
+func (p *funcProbe) Measure(ctx context.Context, user string, sample *Sample) error {
+	return p.measure(ctx, user, sample)
+}
+
+func TestMeasureUsersIsolatesFailures(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "maildirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// user2 vanished since the users were listed.
+	for _, user := range []string{"user1", "user3"} {
+		if err := os.MkdirAll(filepath.Join(root, user, "cur"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, user, "cur", "1"), make([]byte, 64*1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics := &Metrics{
+		userErrors: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"probe", "reason"}),
+	}
+
+	adaptive, err := NewAdaptive(adaptiveOff, time.Second, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probes := []Probe{
+		&fsProbe{
+			root:    root,
+			timeout: 10 * time.Second,
+		},
+		&funcProbe{
+			name:    "custom",
+			timeout: 50 * time.Millisecond,
+			measure: func(ctx context.Context, user string, sample *Sample) error {
+				switch user {
+				case "user1":
+					<-ctx.Done()
+					return ctx.Err()
+				case "user3":
+					return errors.New("exit status 2")
+				}
+				sample.setField("custom", "value", 1)
+				return nil
+			},
+		},
+	}
+
+	start := time.Unix(1500000000, 0)
+	samples := measureUsers(context.Background(), log.NewNopLogger(), metrics, probes, adaptive, []string{"user1", "user2", "user3"}, start)
+
+	if len(samples) != 3 {
+		t.Fatalf("expected a sample of each of 3 users, got %+v", samples)
+	}
+
+	for i, user := range []string{"user1", "user2", "user3"} {
+		if samples[i].User != user || !samples[i].Timestamp.Equal(start) {
+			t.Errorf("expected sample %d of %s at %s, got %+v", i, user, start, samples[i])
+		}
+	}
+
+	// Timing out in one probe keeps the size.
+	if s := samples[0]; s.Size < 64 || s.Error != "" || !reflect.DeepEqual(s.ProbeErrors, map[string]string{"custom": "context deadline exceeded"}) {
+		t.Errorf("expected size of user1 and timeout of custom probe, got %+v", s)
+	}
+
+	// Vanishing does not keep other probes from running.
+	expected := Sample{
+		Timestamp:   start,
+		User:        "user2",
+		Error:       "maildir vanished",
+		Fields:      map[string]float64{"custom.value": 1},
+		ProbeErrors: map[string]string{"du": "maildir vanished"},
+	}
+	if !reflect.DeepEqual(samples[1], expected) {
+		t.Errorf("expected %+v, got %+v", expected, samples[1])
+	}
+
+	if s := samples[2]; s.Size < 64 || s.Error != "" || !reflect.DeepEqual(s.ProbeErrors, map[string]string{"custom": "exit status 2"}) {
+		t.Errorf("expected size of user3 and failure of custom probe, got %+v", s)
+	}
+
+	for labels, count := range map[[2]string]float64{
+		{"du", reasonVanished}:     1,
+		{"du", reasonTimeout}:      0,
+		{"du", reasonFailed}:       0,
+		{"custom", reasonTimeout}:  1,
+		{"custom", reasonFailed}:   1,
+		{"custom", reasonVanished}: 0,
+	} {
+		if v := counterValue(t, metrics.userErrors.WithLabelValues(labels[0], labels[1])); v != count {
+			t.Errorf("expected %v errors of %s with reason %s, got %v", count, labels[0], labels[1], v)
+		}
+	}
+}
+
+func TestFSProbeTimeout(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "maildirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.Mkdir(filepath.Join(root, "user1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fsProbe{
+		root:    root,
+		timeout: time.Nanosecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	<-ctx.Done()
+
+	var sample Sample
+	err = p.Measure(ctx, "user1", &sample)
+
+	perr, ok := err.(*probeError)
+	if !ok || perr.reason != reasonTimeout || sample.Error != "'du -s' timed out after 1ns" {
+		t.Errorf("expected timeout recorded as error, got %v and %+v", err, sample)
+	}
+}
+
+func TestDumpSample(t *testing.T) {
+
+	ds := dumpSample("/maildirs", Sample{
+		User:  "user1",
+		Size:  12,
+		Error: "maildir vanished",
+		ProbeErrors: map[string]string{
+			fsProbeName:   "maildir vanished",
+			imapProbeName: "connection refused",
+			"custom":      "exit status 2",
+		},
+	})
+
+	if ds.Path != "/maildirs/user1" || ds.Size != 12 || ds.Error != "maildir vanished" || ds.IMAPError != "connection refused" {
+		t.Errorf("expected path, size and errors of du and IMAP, got %+v", ds)
+	}
+	if !reflect.DeepEqual(ds.ProbeErrors, map[string]string{"custom": "exit status 2"}) {
+		t.Errorf("expected only error of custom probe by probe, got %v", ds.ProbeErrors)
+	}
+}
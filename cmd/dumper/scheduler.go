@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Policies for runs that take longer than one interval.
+const (
+	// policySkip drops all ticks that passed during an
+	// overrun and continues at the next aligned tick.
+	policySkip = "skip"
+
+	// policyQueue runs all ticks that passed during an
+	// overrun back-to-back until the schedule caught up.
+	policyQueue = "queue"
+
+	// policyStretch starts the next run one interval
+	// after an overrunning run finished, giving up the
+	// alignment to wall-clock boundaries.
+	policyStretch = "stretch"
+)
+
+// Scheduler invokes a function at every multiple of an
+// interval since the Unix epoch, so that dumpers with
+// synchronized clocks sample at the same instants.
+type Scheduler struct {
+	metrics  *Metrics
+	interval time.Duration
+	policy   string
+
+	// now and sleep are the clock of the
+	// scheduler, replaced by tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) bool
+}
+
+// NewScheduler validates interval and policy.
+func NewScheduler(metrics *Metrics, interval time.Duration, policy string) (*Scheduler, error) {
+
+	if interval < time.Millisecond {
+		return nil, fmt.Errorf("interval must be at least 1ms, got %s", interval)
+	}
+
+	switch policy {
+	case policySkip, policyQueue, policyStretch:
+	default:
+		return nil, fmt.Errorf("unknown overrun policy %q", policy)
+	}
+
+	return &Scheduler{
+		metrics:  metrics,
+		interval: interval,
+		policy:   policy,
+		now:      time.Now,
+		sleep:    sleep,
+	}, nil
+}
+
+// Run calls run with the scheduled time of every
+// tick until ctx is done. Ticks are never drifting
+// as each one is computed from the previous scheduled
+// time instead of from when the previous run ended.
+func (s *Scheduler) Run(ctx context.Context, run func(time.Time)) error {
+
+	next := nextBoundary(s.now(), s.interval)
+
+	for {
+		if !s.sleep(ctx, next.Sub(s.now())) {
+			return nil
+		}
+
+		// A tick we woke up for more than one interval
+		// late is missed, unless we are catching up.
+		if s.policy != policyQueue {
+			if late := s.now().Sub(next); late >= s.interval {
+				skip := nextBoundary(s.now(), s.interval)
+				s.metrics.missedTicks.Add(float64(skip.Sub(next) / s.interval))
+				next = skip
+				continue
+			}
+		}
+
+		run(next)
+
+		due := next.Add(s.interval)
+		done := s.now()
+
+		if !done.After(due) {
+			next = due
+			continue
+		}
+
+		s.metrics.overruns.Inc()
+
+		switch s.policy {
+		case policySkip:
+			skip := nextBoundary(done, s.interval)
+			s.metrics.missedTicks.Add(float64(skip.Sub(due) / s.interval))
+			next = skip
+		case policyQueue:
+			next = due
+		case policyStretch:
+			s.metrics.missedTicks.Add(float64(done.Sub(next) / s.interval))
+			next = done.Add(s.interval)
+		}
+	}
+}
+
+// sleep blocks for d and reports whether
+// it did so without ctx being done.
+func sleep(ctx context.Context, d time.Duration) bool {
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// nextBoundary returns the first multiple
+// of interval since the Unix epoch after t.
+func nextBoundary(t time.Time, interval time.Duration) time.Time {
+	n := t.UnixNano() / int64(interval)
+	return time.Unix(0, (n+1)*int64(interval))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeClock stands in for the wall clock of a Scheduler.
+// Sleeping advances it immediately, the i-th wake-up
+// additionally by late[i] to simulate a stalled process.
+type fakeClock struct {
+	t      time.Time
+	late   map[int]time.Duration
+	wakeUp int
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) bool {
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if d > 0 {
+		c.t = c.t.Add(d)
+	}
+	c.t = c.t.Add(c.late[c.wakeUp])
+	c.wakeUp++
+
+	return true
+}
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+
+	var metric dto.Metric
+	if err := c.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
+func TestNextBoundary(t *testing.T) {
+
+	at := func(secs int64, nsecs int64) time.Time {
+		return time.Unix(secs, nsecs)
+	}
+
+	tests := []struct {
+		name     string
+		t        time.Time
+		interval time.Duration
+		expected time.Time
+	}{
+		{"within interval", at(1500000003, 0), 10 * time.Second, at(1500000010, 0)},
+		{"just before boundary", at(1500000009, 999999999), 10 * time.Second, at(1500000010, 0)},
+		{"on boundary", at(1500000010, 0), 10 * time.Second, at(1500000020, 0)},
+		{"just after boundary", at(1500000010, 1), 10 * time.Second, at(1500000020, 0)},
+		{"minute", at(1500000003, 0), time.Minute, at(1500000060, 0)},
+		{"sub-second", at(1500000003, 260000000), 250 * time.Millisecond, at(1500000003, 500000000)},
+		{"odd interval", at(1500000003, 0), 7 * time.Second, at(1500000005, 0)},
+		{"epoch", at(0, 0), time.Second, at(1, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			next := nextBoundary(test.t, test.interval)
+			if !next.Equal(test.expected) {
+				t.Errorf("expected %s, got %s", test.expected.UTC(), next.UTC())
+			}
+		})
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+
+	start := time.Unix(1500000003, 0)
+	at := func(secs int) time.Time {
+		return start.Add(time.Duration(secs-3) * time.Second)
+	}
+
+	tests := []struct {
+		name string
+
+		policy string
+		// Durations of the runs, all others take 1s.
+		durations map[int]time.Duration
+		late      map[int]time.Duration
+
+		ticks       []time.Time
+		started     []time.Time
+		missedTicks float64
+		overruns    float64
+	}{
+		{
+			name:    "aligned",
+			policy:  policySkip,
+			ticks:   []time.Time{at(10), at(20), at(30), at(40)},
+			started: []time.Time{at(10), at(20), at(30), at(40)},
+		},
+		{
+			name:   "run of exactly one interval",
+			policy: policySkip,
+			durations: map[int]time.Duration{
+				0: 10 * time.Second,
+			},
+			ticks:   []time.Time{at(10), at(20), at(30), at(40)},
+			started: []time.Time{at(10), at(20), at(30), at(40)},
+		},
+		{
+			name:   "skip overrun",
+			policy: policySkip,
+			durations: map[int]time.Duration{
+				0: 25 * time.Second,
+			},
+			ticks:       []time.Time{at(10), at(40), at(50), at(60)},
+			started:     []time.Time{at(10), at(40), at(50), at(60)},
+			missedTicks: 2,
+			overruns:    1,
+		},
+		{
+			name:   "queue overrun",
+			policy: policyQueue,
+			durations: map[int]time.Duration{
+				0: 25 * time.Second,
+			},
+			ticks:    []time.Time{at(10), at(20), at(30), at(40)},
+			started:  []time.Time{at(10), at(35), at(36), at(40)},
+			overruns: 2,
+		},
+		{
+			name:   "stretch overrun",
+			policy: policyStretch,
+			durations: map[int]time.Duration{
+				0: 25 * time.Second,
+			},
+			ticks:       []time.Time{at(10), at(45), at(55), at(65)},
+			started:     []time.Time{at(10), at(45), at(55), at(65)},
+			missedTicks: 2,
+			overruns:    1,
+		},
+		{
+			name:   "skip late wake-up",
+			policy: policySkip,
+			late: map[int]time.Duration{
+				1: 15 * time.Second,
+			},
+			ticks:       []time.Time{at(10), at(40), at(50), at(60)},
+			started:     []time.Time{at(10), at(40), at(50), at(60)},
+			missedTicks: 2,
+		},
+		{
+			name:   "stretch late wake-up",
+			policy: policyStretch,
+			late: map[int]time.Duration{
+				1: 15 * time.Second,
+			},
+			ticks:       []time.Time{at(10), at(40), at(50), at(60)},
+			started:     []time.Time{at(10), at(40), at(50), at(60)},
+			missedTicks: 2,
+		},
+		{
+			name:   "slightly late wake-up",
+			policy: policySkip,
+			late: map[int]time.Duration{
+				1: 9 * time.Second,
+			},
+			ticks:   []time.Time{at(10), at(20), at(30), at(40)},
+			started: []time.Time{at(10), at(29), at(30), at(40)},
+		},
+		{
+			name:   "queue late wake-up",
+			policy: policyQueue,
+			late: map[int]time.Duration{
+				1: 15 * time.Second,
+			},
+			ticks:    []time.Time{at(10), at(20), at(30), at(40)},
+			started:  []time.Time{at(10), at(35), at(36), at(40)},
+			overruns: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			clock := &fakeClock{
+				t:    start,
+				late: test.late,
+			}
+
+			metrics := &Metrics{
+				missedTicks: prometheus.NewCounter(prometheus.CounterOpts{Name: "missed"}),
+				overruns:    prometheus.NewCounter(prometheus.CounterOpts{Name: "overruns"}),
+			}
+
+			s, err := NewScheduler(metrics, 10*time.Second, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = clock.now
+			s.sleep = clock.sleep
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var ticks, started []time.Time
+			s.Run(ctx, func(tick time.Time) {
+
+				duration, ok := test.durations[len(ticks)]
+				if !ok {
+					duration = time.Second
+				}
+
+				ticks = append(ticks, tick)
+				started = append(started, clock.now())
+				clock.t = clock.t.Add(duration)
+
+				if len(ticks) == len(test.ticks) {
+					cancel()
+				}
+			})
+
+			if !reflect.DeepEqual(ticks, test.ticks) {
+				t.Errorf("expected ticks %v, got %v", test.ticks, ticks)
+			}
+			if !reflect.DeepEqual(started, test.started) {
+				t.Errorf("expected runs started at %v, got %v", test.started, started)
+			}
+			if missed := counterValue(t, metrics.missedTicks); missed != test.missedTicks {
+				t.Errorf("expected %v missed ticks, got %v", test.missedTicks, missed)
+			}
+			if overruns := counterValue(t, metrics.overruns); overruns != test.overruns {
+				t.Errorf("expected %v overruns, got %v", test.overruns, overruns)
+			}
+		})
+	}
+}
+
+func TestNewSchedulerValidates(t *testing.T) {
+
+	if _, err := NewScheduler(&Metrics{}, time.Microsecond, policySkip); err == nil {
+		t.Errorf("expected error for interval below 1ms")
+	}
+
+	if _, err := NewScheduler(&Metrics{}, time.Second, "drop"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
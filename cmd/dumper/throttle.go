@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Limiter is a token bucket handing out rate
+// operations per second with bursts of up to
+// one second's worth of operations.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate operations per second.
+func NewLimiter(rate float64) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until one operation may be performed
+// or ctx is done and returns how long it blocked.
+func (l *Limiter) Wait(ctx context.Context) (time.Duration, error) {
+
+	l.mu.Lock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	// Reserve the token right away, so that concurrent
+	// callers queue up behind each other.
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		return wait, ctx.Err()
+	}
+}
+
+// walkStats accounts the work done by walkDu.
+type walkStats struct {
+	ops       int
+	throttled time.Duration
+}
+
+// walkDu sums the disk usage of path in 1K blocks like
+// 'du -s' does, counting hard-linked files only once.
+// Every directory read and stat call first waits for
+// limiter. Entries vanishing during the walk are skipped.
+func walkDu(ctx context.Context, path string, limiter *Limiter) (int64, walkStats, error) {
+
+	w := &walker{
+		ctx:     ctx,
+		limiter: limiter,
+		links:   make(map[[2]uint64]bool),
+	}
+
+	info, err := w.lstat(path)
+	if err != nil {
+		return 0, w.stats, err
+	}
+
+	if err := w.walk(path, info); err != nil {
+		return 0, w.stats, err
+	}
+
+	// du reports 512 byte blocks rounded up to 1K blocks.
+	return (w.blocks + 1) / 2, w.stats, nil
+}
+
+// walker holds the state of one walkDu.
+type walker struct {
+	ctx     context.Context
+	limiter *Limiter
+	links   map[[2]uint64]bool
+	blocks  int64
+	stats   walkStats
+}
+
+// wait takes one operation from the budget.
+func (w *walker) wait() error {
+
+	w.stats.ops++
+
+	waited, err := w.limiter.Wait(w.ctx)
+	w.stats.throttled += waited
+
+	return err
+}
+
+func (w *walker) lstat(path string) (os.FileInfo, error) {
+
+	if err := w.wait(); err != nil {
+		return nil, err
+	}
+
+	return os.Lstat(path)
+}
+
+// walk adds the blocks of path and, if it is a
+// directory, of everything below it.
+func (w *walker) walk(path string, info os.FileInfo) error {
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if st.Nlink > 1 && !info.IsDir() {
+			if w.links[key] {
+				return nil
+			}
+			w.links[key] = true
+		}
+		w.blocks += int64(st.Blocks)
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	if err := w.wait(); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+
+		child := filepath.Join(path, name)
+
+		info, err := w.lstat(child)
+		if os.IsNotExist(err) {
+			// Moved from new/ to cur/ or expunged meanwhile.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := w.walk(child, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
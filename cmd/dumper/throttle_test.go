@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLimiterPacing(t *testing.T) {
+
+	l := NewLimiter(200)
+	ctx := context.Background()
+
+	// A full bucket allows a burst of one second's worth.
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		if waited, err := l.Wait(ctx); err != nil || waited != 0 {
+			t.Fatalf("expected operation %d of burst to pass, waited %s: %v", i, waited, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected burst to pass at once, took %s", elapsed)
+	}
+
+	// Afterwards concurrent callers queue up behind each
+	// other, 100 operations taking half a second in total.
+	var mu sync.Mutex
+	var throttled time.Duration
+	var wg sync.WaitGroup
+
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				waited, err := l.Wait(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				throttled += waited
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected 100 operations at 200/s to take 500ms, took %s", elapsed)
+	}
+	if throttled < 450*time.Millisecond {
+		t.Errorf("expected operations to be throttled, waited %s", throttled)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+
+	l := NewLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	waited, err := l.Wait(ctx)
+	if err != context.Canceled || waited < 900*time.Millisecond {
+		t.Errorf("expected cancellation while waiting 1s, waited %s: %v", waited, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected wait to end on cancellation, took %s", elapsed)
+	}
+}
+
+// maildirFixture creates a Maildir below root with files
+// of various sizes, a hard link and a symbolic link.
+func maildirFixture(t *testing.T, root string) {
+
+	files := map[string]int{
+		"cur/1:2,S":           0,
+		"cur/2:2,S":           1,
+		"cur/3:2,RS":          4097,
+		"new/4":               100000,
+		"tmp/5":               12345,
+		".Sent/cur/6:2,S":     2 * 1024 * 1024,
+		".Sent/dovecot.index": 512,
+		"dovecot-uidlist":     80,
+	}
+
+	for name, size := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, ".Drafts", "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hard links are counted once, as by 'du -s'.
+	if err := os.Link(filepath.Join(root, ".Sent", "cur", "6:2,S"), filepath.Join(root, "cur", "6:2,S")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(root, "new", "4"), filepath.Join(root, "latest")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkDuMatchesDu(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	maildirFixture(t, root)
+
+	stdout, stderr, err := userDu(context.Background(), root)
+	if err != nil {
+		t.Fatalf("'du -s' failed: %v: %s", err, stderr)
+	}
+
+	expected, err := parseDu(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, stats, err := walkDu(context.Background(), root, NewLimiter(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != expected {
+		t.Errorf("expected %d blocks as reported by 'du -s', got %d", expected, size)
+	}
+
+	// 8 directories read and 17 entries and the root statted.
+	if stats.ops != 8+17+1 {
+		t.Errorf("expected 26 operations, got %d", stats.ops)
+	}
+	if stats.throttled != 0 {
+		t.Errorf("expected no throttling, got %s", stats.throttled)
+	}
+}
+
+func TestWalkDuThrottled(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	maildirFixture(t, root)
+
+	// 26 operations at 20/s, of which 20 pass at once.
+	start := time.Now()
+	_, stats, err := walkDu(context.Background(), root, NewLimiter(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected walk to take 300ms, took %s", elapsed)
+	}
+	if stats.throttled < 250*time.Millisecond {
+		t.Errorf("expected walk to be throttled, waited %s", stats.throttled)
+	}
+
+	// Cancelling aborts the walk.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := walkDu(ctx, root, NewLimiter(5)); err != context.DeadlineExceeded {
+		t.Errorf("expected walk to time out, got %v", err)
+	}
+}
+
+func TestFSProbeWalk(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "maildirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	maildirFixture(t, filepath.Join(root, "user1"))
+
+	metrics := &Metrics{
+		walkerOps:       prometheus.NewCounter(prometheus.CounterOpts{Name: "ops"}),
+		walkerThrottled: prometheus.NewCounter(prometheus.CounterOpts{Name: "throttled"}),
+	}
+
+	du := &fsProbe{root: root, timeout: 10 * time.Second}
+	walk := &fsProbe{root: root, timeout: 10 * time.Second, limiter: NewLimiter(1e6), metrics: metrics}
+
+	var duSample, walkSample Sample
+	if err := du.Measure(context.Background(), "user1", &duSample); err != nil {
+		t.Fatal(err)
+	}
+	if err := walk.Measure(context.Background(), "user1", &walkSample); err != nil {
+		t.Fatal(err)
+	}
+
+	if walkSample.Size != duSample.Size {
+		t.Errorf("expected walk to measure %d blocks like 'du -s', got %d", duSample.Size, walkSample.Size)
+	}
+	if walkSample.Fields["du.ops"] != 26 || counterValue(t, metrics.walkerOps) != 26 {
+		t.Errorf("expected 26 operations recorded, got %v", walkSample.Fields)
+	}
+	if _, ok := walkSample.Fields["du.throttled_seconds"]; !ok {
+		t.Errorf("expected time throttled recorded, got %v", walkSample.Fields)
+	}
+
+	var vanished Sample
+	err = walk.Measure(context.Background(), "user2", &vanished)
+	if perr, ok := err.(*probeError); !ok || perr.reason != reasonVanished || vanished.Error != "maildir vanished" {
+		t.Errorf("expected vanished user, got %v and %+v", err, vanished)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// WatchdogStatus is the outcome of the most
+// recent self-check of the dumper.
+type WatchdogStatus struct {
+	CheckedAt   time.Time `json:"checkedAt"`
+	LastRun     time.Time `json:"lastRun"`
+	Stalled     bool      `json:"stalled"`
+	RootPathOK  bool      `json:"rootPathOK"`
+	Backlog     int       `json:"backlog"`
+	BacklogFull bool      `json:"backlogFull"`
+	Problems    []string  `json:"problems"`
+}
+
+// Watchdog periodically verifies that the 'du -s' loop
+// keeps completing runs, that the Maildir root path is
+// still the mount we started on and that the number of
+// dumps waiting for upload stays within bounds.
+type Watchdog struct {
+	logger         log.Logger
+	metrics        *Metrics
+	rootPath       string
+	rootDev        uint64
+	interval       time.Duration
+	stallIntervals int
+	maxBacklog     int
+	backlog        func() int
+	exitOnStall    bool
+
+	// stat returns the device of a path,
+	// replaced by tests to simulate mounts.
+	stat func(path string) (uint64, error)
+
+	// statting is set while a stat of the root
+	// path hangs, so hung stats do not pile up.
+	statting int32
+
+	mu      sync.RWMutex
+	lastRun time.Time
+	status  WatchdogStatus
+}
+
+// NewWatchdog records the device of rootPath. backlog,
+// if not nil, returns the number of dumps awaiting upload.
+func NewWatchdog(logger log.Logger, metrics *Metrics, rootPath string, interval time.Duration, stallIntervals int, maxBacklog int, backlog func() int, exitOnStall bool) (*Watchdog, error) {
+
+	dev, err := deviceID(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &Watchdog{
+		logger:         logger,
+		metrics:        metrics,
+		rootPath:       rootPath,
+		rootDev:        dev,
+		interval:       interval,
+		stallIntervals: stallIntervals,
+		maxBacklog:     maxBacklog,
+		backlog:        backlog,
+		exitOnStall:    exitOnStall,
+		stat:           deviceID,
+		lastRun:        now,
+		status: WatchdogStatus{
+			CheckedAt:  now,
+			LastRun:    now,
+			RootPathOK: true,
+			Problems:   []string{},
+		},
+	}, nil
+}
+
+// RunCompleted marks that the 'du -s' loop finished a run.
+func (wd *Watchdog) RunCompleted(t time.Time) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	wd.lastRun = t
+}
+
+// Status returns the outcome of the most recent check.
+func (wd *Watchdog) Status() WatchdogStatus {
+	wd.mu.RLock()
+	defer wd.mu.RUnlock()
+
+	return wd.status
+}
+
+// Run checks the dumper once per interval, but
+// at most once per second, until ctx is done.
+func (wd *Watchdog) Run(ctx context.Context) error {
+
+	period := wd.interval
+	if period < time.Second {
+		period = time.Second
+	}
+
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			wd.check(time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// check evaluates all conditions, logs every change
+// compared to the previous check and exits the process
+// on a stalled loop if configured to do so.
+func (wd *Watchdog) check(now time.Time) {
+
+	// Stat and ask for the backlog before taking the
+	// lock, so a hung mount cannot block the endpoints.
+	dev, err := wd.statRoot()
+
+	backlog := 0
+	if wd.backlog != nil {
+		backlog = wd.backlog()
+	}
+
+	wd.mu.Lock()
+
+	prev := wd.status
+	status := WatchdogStatus{
+		CheckedAt:  now,
+		LastRun:    wd.lastRun,
+		RootPathOK: true,
+		Backlog:    backlog,
+		Problems:   []string{},
+	}
+
+	stallAfter := time.Duration(wd.stallIntervals) * wd.interval
+	if wd.stallIntervals > 0 && now.Sub(wd.lastRun) > stallAfter {
+		status.Stalled = true
+		status.Problems = append(status.Problems, fmt.Sprintf("no run completed for %s", now.Sub(wd.lastRun)))
+	}
+
+	if err != nil {
+		status.RootPathOK = false
+		status.Problems = append(status.Problems, err.Error())
+	} else if dev != wd.rootDev {
+		status.RootPathOK = false
+		status.Problems = append(status.Problems, fmt.Sprintf("device of %s changed from %d to %d", wd.rootPath, wd.rootDev, dev))
+	}
+
+	if wd.maxBacklog > 0 && backlog > wd.maxBacklog {
+		status.BacklogFull = true
+		status.Problems = append(status.Problems, fmt.Sprintf("%d dumps awaiting upload, limit is %d", backlog, wd.maxBacklog))
+	}
+
+	wd.status = status
+
+	wd.mu.Unlock()
+
+	wd.metrics.stalled.Set(boolToFloat(status.Stalled))
+	wd.metrics.rootPathOK.Set(boolToFloat(status.RootPathOK))
+	wd.metrics.backlog.Set(float64(status.Backlog))
+
+	if status.Stalled != prev.Stalled {
+		if status.Stalled {
+			level.Error(wd.logger).Log("msg", "'du -s' loop stalled", "lastRun", status.LastRun)
+		} else {
+			level.Info(wd.logger).Log("msg", "'du -s' loop recovered", "lastRun", status.LastRun)
+		}
+	}
+
+	if status.RootPathOK != prev.RootPathOK {
+		if status.RootPathOK {
+			level.Info(wd.logger).Log("msg", "maildirRootPath is back", "path", wd.rootPath)
+		} else {
+			level.Error(wd.logger).Log("msg", "maildirRootPath vanished or changed device", "path", wd.rootPath, "err", err)
+		}
+	}
+
+	if status.BacklogFull != prev.BacklogFull {
+		if status.BacklogFull {
+			level.Warn(wd.logger).Log("msg", "upload backlog exceeds limit", "backlog", status.Backlog, "limit", wd.maxBacklog)
+		} else {
+			level.Info(wd.logger).Log("msg", "upload backlog within limit", "backlog", status.Backlog, "limit", wd.maxBacklog)
+		}
+	}
+
+	if status.Stalled && wd.exitOnStall {
+		// A 'du -s' hanging on a stuck mount cannot be
+		// interrupted, so waiting for a graceful shutdown
+		// of the group would block forever.
+		level.Error(wd.logger).Log("msg", "exiting due to stalled 'du -s' loop")
+		os.Exit(4)
+	}
+}
+
+// Register attaches /healthz and /readyz to mux. The dumper
+// is healthy as long as its loop is not stalled and ready
+// if additionally no other problem has been detected.
+func (wd *Watchdog) Register(mux *http.ServeMux) {
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := wd.Status()
+		writeStatus(w, status, !status.Stalled)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := wd.Status()
+		writeStatus(w, status, len(status.Problems) == 0)
+	})
+}
+
+// writeStatus responds with status as JSON
+// and a 503 status code unless ok is set.
+func writeStatus(w http.ResponseWriter, status WatchdogStatus, ok bool) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// statRoot returns the device of the root path. A stat
+// not returning within the check period, e.g. on a hung
+// NFS or FUSE mount, counts as failed and no other stat
+// is started until it returns.
+func (wd *Watchdog) statRoot() (uint64, error) {
+
+	timeout := wd.interval
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+
+	if !atomic.CompareAndSwapInt32(&wd.statting, 0, 1) {
+		return 0, fmt.Errorf("stat of %s still hangs", wd.rootPath)
+	}
+
+	type result struct {
+		dev uint64
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		dev, err := wd.stat(wd.rootPath)
+		atomic.StoreInt32(&wd.statting, 0)
+		done <- result{dev, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.dev, r.err
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("stat of %s timed out after %s", wd.rootPath, timeout)
+	}
+}
+
+// deviceID returns the ID of the device path resides on.
+func deviceID(path string) (uint64, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device information available for %s", path)
+	}
+
+	return uint64(stat.Dev), nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
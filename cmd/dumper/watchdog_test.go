@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newWatchdogMetrics returns Metrics holding the
+// unregistered gauges of the watchdog.
+func newWatchdogMetrics() *Metrics {
+	return &Metrics{
+		stalled:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "stalled"}),
+		rootPathOK: prometheus.NewGauge(prometheus.GaugeOpts{Name: "root_path_ok"}),
+		backlog:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "backlog"}),
+	}
+}
+
+// probeStatus requests path from server and
+// returns the status code and decoded body.
+func probeStatus(t *testing.T, server *httptest.Server, path string) (int, WatchdogStatus) {
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var status WatchdogStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, status
+}
+
+func TestWatchdogEndpoints(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "watchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	backlog := 0
+	metrics := newWatchdogMetrics()
+
+	wd, err := NewWatchdog(log.NewNopLogger(), metrics, root, time.Second, 3, 10, func() int { return backlog }, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := wd.rootDev
+	wd.stat = func(path string) (uint64, error) {
+		if path != root {
+			t.Errorf("expected stat of %s, got %s", root, path)
+		}
+		return dev, nil
+	}
+
+	mux := http.NewServeMux()
+	wd.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	start := time.Unix(1500000000, 0)
+	wd.RunCompleted(start)
+
+	expect := func(step string, healthy bool, ready bool, problem string) {
+
+		code, status := probeStatus(t, server, "/healthz")
+		if (code == http.StatusOK) != healthy {
+			t.Errorf("%s: expected healthy %v, got status %d: %+v", step, healthy, code, status)
+		}
+
+		code, status = probeStatus(t, server, "/readyz")
+		if (code == http.StatusOK) != ready {
+			t.Errorf("%s: expected ready %v, got status %d: %+v", step, ready, code, status)
+		}
+
+		if problem == "" && len(status.Problems) != 0 {
+			t.Errorf("%s: expected no problems, got %v", step, status.Problems)
+		}
+		if problem != "" && (len(status.Problems) != 1 || !strings.Contains(status.Problems[0], problem)) {
+			t.Errorf("%s: expected problem %q, got %v", step, problem, status.Problems)
+		}
+	}
+
+	wd.check(start.Add(time.Second))
+	expect("initial", true, true, "")
+
+	if v := gaugeValues(t, metrics.rootPathOK)[""]; v != 1 {
+		t.Errorf("expected root path gauge 1, got %v", v)
+	}
+
+	// Another filesystem mounted over the root
+	// path, or the root path on the mount point
+	// after the mount vanished, has another device.
+	dev = wd.rootDev + 1
+	wd.check(start.Add(2 * time.Second))
+	expect("device changed", true, false, fmt.Sprintf("device of %s changed from %d to %d", root, wd.rootDev, dev))
+
+	if v := gaugeValues(t, metrics.rootPathOK)[""]; v != 0 {
+		t.Errorf("expected root path gauge 0, got %v", v)
+	}
+
+	dev = wd.rootDev
+	wd.check(start.Add(3 * time.Second))
+	expect("device back", true, true, "")
+
+	wd.RunCompleted(start.Add(3 * time.Second))
+
+	backlog = 11
+	wd.check(start.Add(4 * time.Second))
+	expect("backlog full", true, false, "11 dumps awaiting upload, limit is 10")
+
+	if v := gaugeValues(t, metrics.backlog)[""]; v != 11 {
+		t.Errorf("expected backlog gauge 11, got %v", v)
+	}
+
+	backlog = 10
+	wd.check(start.Add(5 * time.Second))
+	expect("backlog within limit", true, true, "")
+
+	// Stalled after more than 3 intervals without run.
+	wd.check(start.Add(6*time.Second + time.Millisecond))
+	expect("stalled", false, false, "no run completed for 3.001s")
+
+	if v := gaugeValues(t, metrics.stalled)[""]; v != 1 {
+		t.Errorf("expected stalled gauge 1, got %v", v)
+	}
+
+	wd.RunCompleted(start.Add(7 * time.Second))
+	wd.check(start.Add(8 * time.Second))
+	expect("recovered", true, true, "")
+}
+
+func TestWatchdogStatTimeout(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "watchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	wd, err := NewWatchdog(log.NewNopLogger(), newWatchdogMetrics(), root, 100*time.Millisecond, 0, 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := wd.rootDev
+	hang := make(chan struct{})
+	wd.stat = func(path string) (uint64, error) {
+		<-hang
+		return dev, nil
+	}
+
+	// Timeouts are at least one second, so that
+	// busy filesystems are not taken for hung.
+	start := time.Now()
+	_, err = wd.statRoot()
+	if err == nil || err.Error() != fmt.Sprintf("stat of %s timed out after 1s", root) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("expected stat to time out after 1s, took %s", elapsed)
+	}
+
+	// No further stat is started while the first hangs.
+	_, err = wd.statRoot()
+	if err == nil || err.Error() != fmt.Sprintf("stat of %s still hangs", root) {
+		t.Errorf("expected stat to still hang, got %v", err)
+	}
+
+	wd.check(time.Now())
+	if status := wd.Status(); status.RootPathOK || len(status.Problems) != 1 || !strings.Contains(status.Problems[0], "still hangs") {
+		t.Errorf("expected root path problem of hanging stat, got %+v", status)
+	}
+
+	// The next stat is started once the hanging one returned.
+	close(hang)
+
+	for i := 0; i < 100; i++ {
+		if dev, err := wd.statRoot(); err == nil {
+			if dev != wd.rootDev {
+				t.Errorf("expected device %d, got %d", wd.rootDev, dev)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("expected stat to succeed once the hanging one returned")
+}
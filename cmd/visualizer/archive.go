@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// isRemote reports whether p is fetched over the network.
+func isRemote(p string) bool {
+	for _, scheme := range []string{"http://", "https://", "gs://", "s3://"} {
+		if strings.HasPrefix(p, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// openArchive opens the archive at p: '-' for stdin, an
+// HTTP(S), GCS or S3 URL, a directory of dumps or a file.
+// The format of files is detected by their content. Only
+// the list of dumps is read, the dumps themselves when
+// needed; downloads are spooled to a temporary file.
+func openArchive(p string) (*dump.Archive, error) {
+
+	switch {
+	case p == "-":
+		return dump.SpoolArchive("stdin", os.Stdin)
+
+	case strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://"):
+		body, err := fetchHTTP(p)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		return dump.SpoolArchive(dump.ArchiveName(p), body)
+
+	case strings.HasPrefix(p, "gs://") || strings.HasPrefix(p, "s3://"):
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		body, err := fetchObject(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		return dump.SpoolArchive(dump.ArchiveName(p), body)
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return dump.ReadDir(p)
+	}
+
+	return dump.OpenArchive(dump.ArchiveName(p), p)
+}
+
+// fetchHTTP requests the file at url, e.g. a
+// run served by the collector, for download.
+func fetchHTTP(url string) (io.ReadCloser, error) {
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// archiveFilter selects archives listed from globs
+// and object stores by the worker and time in their
+// name, '<unix>-<worker>' as uploaded by the dumper
+// or '<run>-<worker>' as served by the collector.
+type archiveFilter struct {
+	workers  []string
+	from, to time.Time
+}
+
+// match reports whether the archive at p passes the filter.
+// Archives not named that way only pass without filters.
+func (f archiveFilter) match(p string) bool {
+
+	if len(f.workers) == 0 && f.from.IsZero() && f.to.IsZero() {
+		return true
+	}
+
+	parts := strings.SplitN(dump.ArchiveName(p), "-", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	if len(f.workers) > 0 {
+		matched := false
+		for _, pattern := range f.workers {
+			if ok, _ := path.Match(pattern, parts[1]); ok {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if !f.from.IsZero() || !f.to.IsZero() {
+		secs, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return false
+		}
+
+		t := time.Unix(secs, 0)
+		if (!f.from.IsZero() && t.Before(f.from)) || (!f.to.IsZero() && t.After(f.to)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expandArchives expands the glob patterns and object
+// store prefixes among args to the sorted paths of all
+// archives they contain that pass filter. Other paths
+// and URLs are kept as they are.
+func expandArchives(args []string, filter archiveFilter) ([]string, error) {
+
+	var files []string
+
+	for _, arg := range args {
+
+		var matches []string
+
+		switch {
+		case strings.HasPrefix(arg, "gs://") || strings.HasPrefix(arg, "s3://"):
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			objects, err := listObjects(ctx, arg)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s: %v", arg, err)
+			}
+			matches = objects
+
+		case isRemote(arg) || arg == "-" || !strings.ContainsAny(arg, "*?["):
+			files = append(files, arg)
+			continue
+
+		default:
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+		}
+
+		var selected []string
+		for _, match := range matches {
+			if filter.match(match) {
+				selected = append(selected, match)
+			}
+		}
+
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("no archives match %q", arg)
+		}
+
+		sort.Strings(selected)
+		files = append(files, selected...)
+	}
+
+	return files, nil
+}
+
+// parseTime parses s as RFC 3339 or Unix seconds.
+// Empty yields the zero time.
+func parseTime(s string) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// clockMeasurement is a clock offset measured by a
+// dumper against a reference clock at time t.
+type clockMeasurement struct {
+	t      float64
+	offset float64
+	rtt    float64
+}
+
+// clockCorrection maps the timestamps of one cluster
+// onto the clock of the reference it measured against.
+type clockCorrection struct {
+	ref          string
+	measurements []clockMeasurement
+}
+
+// clockRef returns the reference to correct all sources
+// against: ref if given, else the one most archives were
+// measured against, SNTP servers first on ties and then by
+// name. Correcting every cluster onto the same clock keeps
+// dumpers measuring each other from mirroring their skew.
+// A dumper serving as reference has no measurements
+// against itself, so its own cluster stays uncorrected.
+func clockRef(sources []*source, ref string) string {
+
+	if ref != "" {
+		return ref
+	}
+
+	counts := make(map[string]int)
+	for _, src := range sources {
+		for r := range src.clocks {
+			counts[r]++
+		}
+	}
+
+	refs := make([]string, 0, len(counts))
+	for r := range counts {
+		refs = append(refs, r)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if counts[refs[i]] != counts[refs[j]] {
+			return counts[refs[i]] > counts[refs[j]]
+		}
+		if ntp := strings.HasPrefix(refs[i], "ntp://"); ntp != strings.HasPrefix(refs[j], "ntp://") {
+			return ntp
+		}
+		return refs[i] < refs[j]
+	})
+
+	if len(refs) == 0 {
+		return ""
+	}
+
+	return refs[0]
+}
+
+// correctClocks sets the clock correction of all sources
+// onto the common reference, see clockRef. Measurements
+// with an uncertainty above opts.ClockMaxUncertainty are
+// left out if it is set.
+func correctClocks(sources []*source, opts Options) {
+
+	ref := clockRef(sources, opts.ClockRef)
+	if ref == "" {
+		return
+	}
+
+	for _, src := range sources {
+
+		var measurements []clockMeasurement
+		for _, m := range src.clocks[ref] {
+			if opts.ClockMaxUncertainty <= 0 || m.rtt/2 <= opts.ClockMaxUncertainty {
+				measurements = append(measurements, m)
+			}
+		}
+
+		if dropped := len(src.clocks[ref]) - len(measurements); dropped > 0 {
+			log.Printf("ignored %d clock offsets of %s against %s as too uncertain", dropped, src.archive.Name, ref)
+		}
+
+		if len(measurements) == 0 {
+			if len(src.clocks) > 0 {
+				log.Printf("not correcting clock of %s: no usable offsets measured against %s", src.archive.Name, ref)
+			}
+			continue
+		}
+
+		src.clock = &clockCorrection{
+			ref:          ref,
+			measurements: measurements,
+		}
+		src.clock.report(src.archive.Name)
+	}
+}
+
+// at returns the offset to add to a timestamp t, linearly
+// interpolated between the surrounding measurements, and
+// its uncertainty, i.e. half the larger round trip time.
+func (c *clockCorrection) at(t float64) (float64, float64) {
+
+	m := c.measurements
+
+	i := sort.Search(len(m), func(i int) bool {
+		return m[i].t >= t
+	})
+
+	switch {
+	case i == 0:
+		return m[0].offset, m[0].rtt / 2
+	case i == len(m):
+		return m[i-1].offset, m[i-1].rtt / 2
+	}
+
+	prev, next := m[i-1], m[i]
+	frac := (t - prev.t) / (next.t - prev.t)
+
+	return prev.offset + frac*(next.offset-prev.offset), math.Max(prev.rtt, next.rtt) / 2
+}
+
+// correct returns the timestamp t of a dump in the
+// reference's clock, rounded to milliseconds, and
+// its uncertainty.
+func (c *clockCorrection) correct(t float64) (float64, float64) {
+
+	offset, uncertainty := c.at(t)
+
+	return math.Floor((t+offset)*1000+0.5) / 1000, uncertainty
+}
+
+// report logs the range of offsets applied to a
+// cluster together with the largest uncertainty.
+func (c *clockCorrection) report(cluster string) {
+
+	minOffset, maxOffset := math.Inf(1), math.Inf(-1)
+	var uncertainty float64
+
+	for _, m := range c.measurements {
+		minOffset = math.Min(minOffset, m.offset)
+		maxOffset = math.Max(maxOffset, m.offset)
+		uncertainty = math.Max(uncertainty, m.rtt/2)
+	}
+
+	log.Printf("corrected clock of %s against %s by %+.3fs to %+.3fs, uncertainty ±%.3fs",
+		cluster, c.ref, minOffset, maxOffset, uncertainty)
+}
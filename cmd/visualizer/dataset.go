@@ -0,0 +1,788 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// parseBatch is the number of dumps parsed in parallel
+// before merging them into the columns of their source,
+// bounding the memory held by parsed but not yet merged
+// dumps.
+const parseBatch = 256
+
+// Dataset holds the data read from dumps column by column:
+// per cluster and user the sizes, errors and adaptive sampling
+// intervals in seconds, per cluster and metric the host
+// metrics, each keyed by '<cluster>/<user or metric>' and
+// indexed by the dumps of the cluster. Names lists all
+// clusters in the order they were read, Clusters their
+// place in the topology if known, Dumps the sorted times
+// of each cluster's dumps in Unix seconds and Restarts
+// those of dumps following a dumper restart.
+type Dataset struct {
+	Sizes     map[string]*column
+	Errors    map[string]map[int]string
+	Intervals map[string]*column
+	Host      map[string]*column
+	Clusters  map[string]topology.Worker
+	Restarts  map[string][]float64
+	Names     []string
+	Dumps     map[string][]float64
+
+	// Diagnostics sums up the problems
+	// found in the dumps read.
+	Diagnostics *Diagnostics
+}
+
+// NewDataset returns an empty Dataset.
+func NewDataset() *Dataset {
+	return &Dataset{
+		Sizes:     make(map[string]*column),
+		Errors:    make(map[string]map[int]string),
+		Intervals: make(map[string]*column),
+		Host:      make(map[string]*column),
+		Clusters:  make(map[string]topology.Worker),
+		Restarts:  make(map[string][]float64),
+		Dumps:     make(map[string][]float64),
+
+		Diagnostics: NewDiagnostics(),
+	}
+}
+
+// hasCluster reports whether cluster was read already.
+func (d *Dataset) hasCluster(cluster string) bool {
+
+	for _, name := range d.Names {
+		if name == cluster {
+			return true
+		}
+	}
+
+	return false
+}
+
+// column holds one value per dump of a cluster, NaN where
+// missing. Sizes and intervals rarely change from one dump
+// to the next, so values are stored run-length encoded,
+// unless they change about every other dump: runs then
+// take more room than the values, stored one by one.
+type column struct {
+	runs   []valueRun
+	values []float64
+	n      int
+
+	// hint is the number of dumps expected, if
+	// known, to make room for values at once.
+	hint int
+}
+
+// denseRuns is the number of runs from which a column
+// stores its values one by one if they outnumber half
+// of its dumps.
+const denseRuns = 64
+
+// valueRun is a run of equal values starting at dump start.
+type valueRun struct {
+	start int
+	value float64
+}
+
+// sameValue reports whether a and b are equal or both missing.
+func sameValue(a float64, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+// set records v at dump i. Dumps are set in ascending
+// order, setting the last one again replaces its value
+// and dumps skipped are missing.
+func (c *column) set(i int, v float64) {
+
+	if i < c.n-1 {
+		return
+	}
+
+	if c.values != nil {
+		if i == c.n-1 {
+			c.values[i] = v
+			return
+		}
+
+		for len(c.values) < i {
+			c.values = append(c.values, math.NaN())
+		}
+		c.values = append(c.values, v)
+		c.n = i + 1
+		return
+	}
+
+	if i == c.n-1 {
+		last := c.runs[len(c.runs)-1]
+		if last.start == i {
+			c.runs = c.runs[:len(c.runs)-1]
+		} else if sameValue(last.value, v) {
+			return
+		}
+		c.n = i
+	}
+
+	if i > c.n {
+		c.push(c.n, math.NaN())
+	}
+	c.push(i, v)
+	c.n = i + 1
+
+	if len(c.runs) >= denseRuns && 2*len(c.runs) > c.n {
+		c.densify()
+	}
+}
+
+func (c *column) push(i int, v float64) {
+
+	if len(c.runs) > 0 && sameValue(c.runs[len(c.runs)-1].value, v) {
+		return
+	}
+
+	c.runs = append(c.runs, valueRun{i, v})
+}
+
+// densify stores the values of c one by one.
+func (c *column) densify() {
+
+	size := c.hint
+	if size < c.n {
+		size = 2 * c.n
+	}
+
+	values := make([]float64, c.n, size)
+	for k, r := range c.runs {
+		end := c.n
+		if k+1 < len(c.runs) {
+			end = c.runs[k+1].start
+		}
+
+		for i := r.start; i < end; i++ {
+			values[i] = r.value
+		}
+	}
+
+	c.values, c.runs = values, nil
+}
+
+// truncate drops the values from dump n on.
+func (c *column) truncate(n int) {
+
+	if n >= c.n {
+		return
+	}
+	c.n = n
+
+	if c.values != nil {
+		c.values = c.values[:n]
+		return
+	}
+
+	k := sort.Search(len(c.runs), func(k int) bool {
+		return c.runs[k].start >= n
+	})
+	c.runs = c.runs[:k]
+}
+
+// at returns the value at dump i.
+func (c *column) at(i int) float64 {
+
+	if c == nil || i < 0 || i >= c.n {
+		return math.NaN()
+	}
+
+	if c.values != nil {
+		return c.values[i]
+	}
+
+	k := sort.Search(len(c.runs), func(k int) bool {
+		return c.runs[k].start > i
+	})
+
+	return c.runs[k-1].value
+}
+
+// spans calls fn for every run of values present,
+// covering the dumps from start up to excluding end.
+func (c *column) spans(fn func(start int, end int, v float64)) {
+
+	if c.values != nil {
+		start := 0
+		for i := 1; i <= c.n; i++ {
+			if i < c.n && sameValue(c.values[i], c.values[start]) {
+				continue
+			}
+			if !math.IsNaN(c.values[start]) {
+				fn(start, i, c.values[start])
+			}
+			start = i
+		}
+		return
+	}
+
+	for k, r := range c.runs {
+		if math.IsNaN(r.value) {
+			continue
+		}
+
+		end := c.n
+		if k+1 < len(c.runs) {
+			end = c.runs[k+1].start
+		}
+
+		fn(r.start, end, r.value)
+	}
+}
+
+// columnReader reads a column at ascending dumps
+// without searching its runs for every one.
+type columnReader struct {
+	c *column
+	k int
+}
+
+// at returns the value at dump i.
+func (r *columnReader) at(i int) float64 {
+
+	c := r.c
+	if c.values != nil || i < 0 || i >= c.n {
+		return c.at(i)
+	}
+
+	if r.k >= len(c.runs) || c.runs[r.k].start > i {
+		r.k = sort.Search(len(c.runs), func(k int) bool {
+			return c.runs[k].start > i
+		}) - 1
+	}
+
+	for r.k+1 < len(c.runs) && c.runs[r.k+1].start <= i {
+		r.k++
+	}
+
+	return c.runs[r.k].value
+}
+
+// columns holds the values of users and host metrics,
+// keyed by user or metric and indexed by dump.
+type columns struct {
+	sizes     map[string]*column
+	errors    map[string]map[int]string
+	intervals map[string]*column
+	host      map[string]*column
+}
+
+func newColumns() *columns {
+	return &columns{
+		sizes:     make(map[string]*column),
+		errors:    make(map[string]map[int]string),
+		intervals: make(map[string]*column),
+		host:      make(map[string]*column),
+	}
+}
+
+// parsedDump is what one dump holds: the records of its
+// users and host metrics, the run, worker and clock offsets
+// recorded, its phase and the problems found in it, failed
+// samples grouped as by addFailed.
+type parsedDump struct {
+	sizes     []*dump.Size
+	errors    []*dump.Error
+	intervals []*dump.Interval
+	host      []*dump.HostMetric
+
+	run    *dump.Run
+	worker *dump.Worker
+	clocks []*dump.Clock
+	phase  string
+
+	samples    int
+	skipped    []Problem
+	unparsable []Problem
+	failed     []FailedGroup
+}
+
+// parseDump reads the dump file of the archive at path.
+// Malformed lines fail it unless opts.Lenient is set,
+// the rest of it is read and returned all the same.
+func parseDump(file dump.File, path string, opts Options) (*parsedDump, error) {
+
+	f, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: failed to open: %v", path, file.Name, err)
+	}
+	defer f.Close()
+
+	at := func(line int, text string) Problem {
+		return Problem{
+			Archive: path,
+			Member:  file.Name,
+			Line:    line,
+			Text:    text,
+		}
+	}
+
+	p := &parsedDump{}
+	failed := make(map[string]int)
+
+	var malformed error
+
+	dr := dump.NewReader(f)
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if serr, ok := err.(*dump.SyntaxError); ok && opts.Lenient {
+			pr := at(serr.Line, serr.Text)
+			pr.Error = serr.Err.Error()
+			p.unparsable = append(p.unparsable, pr)
+			continue
+		} else if _, ok := err.(*dump.SyntaxError); ok {
+			if malformed == nil {
+				malformed = fmt.Errorf("%s: %s: %v", path, file.Name, err)
+			}
+			continue
+		} else if err != nil {
+			return p, fmt.Errorf("%s: %s: %v", path, file.Name, err)
+		}
+
+		switch rec := rec.(type) {
+		case *dump.Size:
+			p.samples++
+			p.sizes = append(p.sizes, rec)
+		case *dump.Error:
+			p.samples++
+			p.errors = append(p.errors, rec)
+
+			pr := at(dr.Line(), rec.Path)
+			pr.Error = rec.Message
+			g := failedGroup(pr)
+			if k, ok := failed[g.Message]; ok {
+				p.failed[k].Count++
+			} else {
+				failed[g.Message] = len(p.failed)
+				p.failed = append(p.failed, g)
+			}
+		case *dump.Interval:
+			p.intervals = append(p.intervals, rec)
+		case *dump.HostMetric:
+			p.host = append(p.host, rec)
+		case *dump.Run:
+			p.run = rec
+		case *dump.Worker:
+			p.worker = rec
+		case *dump.Clock:
+			p.clocks = append(p.clocks, rec)
+		case *dump.Phase:
+			p.phase = rec.Name
+		case *dump.Unknown:
+			p.skipped = append(p.skipped, at(dr.Line(), rec.Line))
+		default:
+			// The rest is not plotted.
+		}
+	}
+
+	return p, malformed
+}
+
+// sourceDump is what was read from one dump of a source
+// besides the values of its users and host metrics: the
+// run it records, its phase, the problems found in it and
+// err if it could not be read.
+type sourceDump struct {
+	run        *dump.Run
+	phase      string
+	samples    int
+	skipped    []Problem
+	unparsable []Problem
+	failed     []FailedGroup
+	err        error
+}
+
+// readSource reads every dump of src once, parsed in parallel
+// batches and merged in order: the values of the users selected
+// into src.values, keyed relative to the worker src stems from,
+// and the run, phase, problems and clock offsets of each dump
+// into src.dumps and src.clocks. The dumper labels either all
+// of its dumps or none, so the first batch determines the
+// worker. Dumps that cannot be read fail once selected,
+// what was read of them still counts.
+func readSource(src *source, opts Options) {
+
+	a := src.archive
+
+	src.dumps = make([]sourceDump, len(a.Files))
+	src.clocks = make(map[string][]clockMeasurement)
+	src.values = newColumns()
+
+	var base string
+
+	// Users not selected are left out right away.
+	key := func(path string) (string, bool) {
+		user, ok := opts.Users.Key(base, path)
+		return user, ok && opts.UserFilter.Match(user)
+	}
+
+	set := func(columns map[string]*column, key string, i int, v float64) {
+		c, ok := columns[key]
+		if !ok {
+			c = &column{hint: len(a.Files)}
+			columns[key] = c
+		}
+		c.set(i, v)
+	}
+
+	parsed := make([]*parsedDump, parseBatch)
+	errs := make([]error, parseBatch)
+	times := make([]float64, parseBatch)
+
+	for start := 0; start < len(a.Files); start += parseBatch {
+
+		batch := a.Files[start:]
+		if len(batch) > parseBatch {
+			batch = batch[:parseBatch]
+		}
+
+		parallel(len(batch), func(i int) error {
+			t, err := dump.ParseName(batch[i].Name)
+			if err != nil {
+				return nil
+			}
+			times[i] = t
+			parsed[i], errs[i] = parseDump(batch[i], src.path, opts)
+			return nil
+		})
+
+		if start == 0 {
+			var label *dump.Worker
+			for _, p := range parsed[:len(batch)] {
+				if p != nil && p.worker != nil {
+					label = p.worker
+					break
+				}
+			}
+
+			src.worker, src.hasWorker, base = keyBase(label, a.Name, opts)
+		}
+
+		for i, p := range parsed[:len(batch)] {
+
+			d := &src.dumps[start+i]
+			d.err = errs[i]
+			parsed[i], errs[i] = nil, nil
+
+			if p == nil {
+				continue
+			}
+
+			d.run, d.phase, d.samples = p.run, p.phase, p.samples
+			d.skipped, d.unparsable, d.failed = p.skipped, p.unparsable, p.failed
+
+			for _, rec := range p.sizes {
+				if user, ok := key(rec.Path); ok {
+					set(src.values.sizes, user, start+i, float64(rec.Blocks))
+				}
+			}
+
+			for _, rec := range p.errors {
+				if user, ok := key(rec.Path); ok {
+					if src.values.errors[user] == nil {
+						src.values.errors[user] = make(map[int]string)
+					}
+					src.values.errors[user][start+i] = rec.Message
+				}
+			}
+
+			for _, rec := range p.intervals {
+				if user, ok := key(rec.Path); ok {
+					set(src.values.intervals, user, start+i, rec.Interval.Seconds())
+				}
+			}
+
+			for _, rec := range p.host {
+				set(src.values.host, rec.Name, start+i, rec.Value)
+			}
+
+			for _, c := range p.clocks {
+				src.clocks[c.Ref] = append(src.clocks[c.Ref], clockMeasurement{
+					t:      times[i],
+					offset: c.Offset.Seconds(),
+					rtt:    c.RTT.Seconds(),
+				})
+			}
+		}
+	}
+
+	for _, measurements := range src.clocks {
+		sort.Slice(measurements, func(i, j int) bool {
+			return measurements[i].t < measurements[j].t
+		})
+	}
+}
+
+// keyBase returns the worker the dumps of the archive
+// called name stem from, if labelled by label or known
+// by opts.Topology, and the cluster to key its users by.
+func keyBase(label *dump.Worker, name string, opts Options) (topology.Worker, bool, string) {
+
+	w, ok := workerOf(label, name, opts.Topology)
+
+	base := name
+	if ok {
+		base = w.Name
+	} else if worker, _, ok := dump.ArchiveWorker(name); ok {
+		base = worker
+	}
+
+	return w, ok, base
+}
+
+// problem locates the dump d.
+func problem(d seriesDump) Problem {
+	return Problem{
+		Archive: d.src.path,
+		Member:  d.src.archive.Files[d.i].Name,
+	}
+}
+
+// readSeries reads the dumps of s into data as one cluster,
+// leaving out dumps outside the time window and phases of
+// opts and the cluster itself if none remain. Dumps that
+// could not be read abort once selected.
+func readSeries(s *series, data *Dataset, opts Options) error {
+
+	defer s.release()
+
+	// Archives of the same name from different
+	// directories must not end up in one series.
+	cluster := s.name
+	for i := 2; data.hasCluster(cluster); i++ {
+		cluster = fmt.Sprintf("%s (%d)", s.name, i)
+	}
+
+	from, to := opts.From.at(s.started), opts.To.at(s.started)
+
+	var dumps []float64
+	var kept []seriesDump
+
+	for _, d := range s.dumps {
+
+		if !inWindow(d.t, from, to) {
+			continue
+		}
+
+		sd := &d.src.dumps[d.i]
+		if sd.err != nil {
+			return sd.err
+		}
+
+		diag := data.Diagnostics
+		diag.Dumps++
+
+		for _, pr := range sd.skipped {
+			log.Printf("skipping unknown line %s", pr)
+			diag.Skipped.add(pr)
+		}
+
+		for _, pr := range sd.unparsable {
+			log.Printf("skipping malformed line %s", pr)
+			diag.Unparsable.add(pr)
+		}
+
+		for _, g := range sd.failed {
+			diag.addFailedGroup(g)
+		}
+
+		if sd.samples == 0 {
+			diag.Empty.add(problem(d))
+		}
+
+		if !inPhase(sd.phase, opts) {
+			continue
+		}
+
+		dumps = append(dumps, d.t)
+		kept = append(kept, d)
+	}
+
+	if len(dumps) == 0 {
+		log.Printf("skipping %s: no dumps selected", s.name)
+		return nil
+	}
+
+	data.Names = append(data.Names, cluster)
+	data.Dumps[cluster] = dumps
+
+	if src := takeOver(kept); src != nil {
+		move(data.Sizes, cluster, src.values.sizes, len(kept))
+		move(data.Intervals, cluster, src.values.intervals, len(kept))
+		move(data.Host, cluster, src.values.host, len(kept))
+
+		for user, msgs := range src.values.errors {
+			for i := range msgs {
+				if i >= len(kept) {
+					delete(msgs, i)
+				}
+			}
+			if len(msgs) > 0 {
+				data.Errors[cluster+"/"+user] = msgs
+			}
+		}
+	} else {
+		copyColumns(data.Sizes, cluster, kept, func(v *columns) map[string]*column { return v.sizes })
+		copyColumns(data.Intervals, cluster, kept, func(v *columns) map[string]*column { return v.intervals })
+		copyColumns(data.Host, cluster, kept, func(v *columns) map[string]*column { return v.host })
+
+		for j, d := range kept {
+			for user, msgs := range d.src.values.errors {
+				if msg, ok := msgs[d.i]; ok {
+					key := cluster + "/" + user
+					if data.Errors[key] == nil {
+						data.Errors[key] = make(map[int]string)
+					}
+					data.Errors[key][j] = msg
+				}
+			}
+		}
+	}
+
+	if s.hasWorker {
+		worker := s.worker
+		worker.Name = cluster
+		data.Clusters[cluster] = worker
+	}
+
+	for _, t := range s.restarts {
+		if t > dumps[0] && t <= dumps[len(dumps)-1] {
+			data.Restarts[cluster] = append(data.Restarts[cluster], t)
+		}
+	}
+
+	return nil
+}
+
+// takeOver returns the source of the dumps kept if they are
+// its first ones in order and no other series reads from it,
+// the common case of an archive per run, so that its values
+// are taken over rather than copied, or nil.
+func takeOver(kept []seriesDump) *source {
+
+	src := kept[0].src
+	if src.readers != 1 {
+		return nil
+	}
+
+	for j, d := range kept {
+		if d.src != src || d.i != j {
+			return nil
+		}
+	}
+
+	return src
+}
+
+// move takes over the columns from of a source as those of
+// cluster in to, dropping the values beyond the n dumps kept.
+func move(to map[string]*column, cluster string, from map[string]*column, n int) {
+
+	for key, c := range from {
+		c.truncate(n)
+		to[cluster+"/"+key] = c
+	}
+}
+
+// copyColumns copies the values of the dumps kept, read from
+// the columns of their sources picked by get, into those of
+// cluster in to, the j-th dump kept becoming dump j.
+func copyColumns(to map[string]*column, cluster string, kept []seriesDump, get func(*columns) map[string]*column) {
+
+	type copier struct {
+		key  string
+		from columnReader
+		to   *column
+	}
+
+	copiers := make(map[*source][]*copier)
+
+	for j, d := range kept {
+
+		cs, ok := copiers[d.src]
+		if !ok {
+			for key, c := range get(d.src.values) {
+				cs = append(cs, &copier{
+					key:  cluster + "/" + key,
+					from: columnReader{c: c},
+				})
+			}
+			copiers[d.src] = cs
+		}
+
+		for _, c := range cs {
+			v := c.from.at(d.i)
+			if math.IsNaN(v) {
+				continue
+			}
+
+			if c.to == nil {
+				if c.to = to[c.key]; c.to == nil {
+					c.to = &column{hint: len(kept)}
+					to[c.key] = c.to
+				}
+			}
+			c.to.set(j, v)
+		}
+	}
+}
+
+// parallel calls fn for all 0 <= i < n on one goroutine
+// per CPU and returns the first error encountered.
+func parallel(n int, fn func(i int) error) error {
+
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	var failed int32
+	next := int64(-1)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+
+				if err := fn(i); err != nil {
+					once.Do(func() {
+						first = err
+						atomic.StoreInt32(&failed, 1)
+					})
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return first
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// Dimensions of the run read by BenchmarkReadSeries: a day of
+// dumps taken every second of 1000 users.
+const (
+	benchmarkDumps = 24 * 60 * 60
+	benchmarkUsers = 1000
+)
+
+// syntheticSeries reads a series of dumps generated when opened,
+// so that only what is read takes memory, from an archive called
+// name. The Maildirs of users change in size every change dumps.
+func syntheticSeries(name string, dumps int, users int, change int) *series {
+
+	a := &dump.Archive{
+		Name: name,
+	}
+
+	for i := 0; i < dumps; i++ {
+		i := i
+		a.Files = append(a.Files, dump.File{
+			Name: strconv.Itoa(1500000000 + i),
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(syntheticDump(i, users, change))), nil
+			},
+		})
+	}
+
+	src := &source{
+		path:    "synthetic",
+		archive: a,
+	}
+	readSource(src, Options{})
+
+	stitched, err := stitch([]*source{src})
+	if err != nil {
+		panic(err)
+	}
+
+	return stitched[0]
+}
+
+// syntheticDump returns dump i of users, each of which
+// changes in size every change dumps.
+func syntheticDump(i int, users int, change int) []byte {
+
+	buf := make([]byte, 0, users*32)
+	buf = append(buf, "version\t2\n"...)
+
+	for u := 0; u < users; u++ {
+		size := 1000000 + u*1000 + (i+u)/change
+		buf = strconv.AppendInt(buf, int64(size), 10)
+		buf = append(buf, "\t/maildirs/user"...)
+		buf = strconv.AppendInt(buf, int64(u), 10)
+		buf = append(buf, '\n')
+	}
+
+	return buf
+}
+
+// heapInUse returns the bytes of heap in use after a GC.
+func heapInUse() uint64 {
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapInuse
+}
+
+// BenchmarkReadSeries reads a day of dumps of 1000 users
+// whose Maildirs change about once a minute, the common
+// case, or with every dump, the worst case: values are
+// then stored one by one rather than in runs, 8 bytes per
+// user and dump, 660 MB in total. Each case is bound to a
+// budget for the heap retained by the dataset and one for
+// the heap in use while reading, garbage not yet collected
+// included, which the default GOGC lets grow to twice the
+// heap retained.
+func BenchmarkReadSeries(b *testing.B) {
+
+	for _, bc := range []struct {
+		name     string
+		change   int
+		retained uint64
+		peak     uint64
+	}{
+		{"change=60", 60, 64 << 20, 256 << 20},
+		{"change=1", 1, 768 << 20, 1536 << 20},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchmarkReadSeries(b, bc.change, bc.retained, bc.peak)
+		})
+	}
+}
+
+func benchmarkReadSeries(b *testing.B, change int, retainedBudget uint64, peakBudget uint64) {
+
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+
+		b.StopTimer()
+		base := heapInUse()
+		b.StartTimer()
+
+		// Sample the heap while reading to catch its peak.
+		var peak uint64
+		done := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			var stats runtime.MemStats
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > atomic.LoadUint64(&peak) {
+					atomic.StoreUint64(&peak, stats.HeapInuse)
+				}
+			}
+		}()
+
+		s := syntheticSeries("worker-1", benchmarkDumps, benchmarkUsers, change)
+
+		data := NewDataset()
+		if err := readSeries(s, data, Options{}); err != nil {
+			b.Fatal(err)
+		}
+
+		close(done)
+		<-sampled
+
+		b.StopTimer()
+
+		if got := len(data.Dumps["worker-1"]); got != benchmarkDumps {
+			b.Fatalf("expected %d dumps read, got %d", benchmarkDumps, got)
+		}
+		if got := len(data.Sizes); got != benchmarkUsers {
+			b.Fatalf("expected %d users read, got %d", benchmarkUsers, got)
+		}
+
+		retained := heapInUse()
+		if retained < base {
+			retained = base
+		}
+		if peak < retained {
+			peak = retained
+		}
+
+		b.Logf("heap peaked at %d MB, dataset retains %d MB", (peak-base)>>20, (retained-base)>>20)
+
+		if retained-base > retainedBudget {
+			b.Errorf("dataset retains %d MB, budget is %d MB", (retained-base)>>20, retainedBudget>>20)
+		}
+		if peak-base > peakBudget {
+			b.Errorf("heap peaked at %d MB while reading, budget is %d MB", (peak-base)>>20, peakBudget>>20)
+		}
+
+		runtime.KeepAlive(data)
+
+		b.StartTimer()
+	}
+}
+
+func TestReadSeriesRelativeBounds(t *testing.T) {
+
+	// Series of 10 dumps starting at different times, one
+	// of them taken by a run started 3s before its first.
+	a := syntheticSeries("worker-1", 10, 1, 1)
+	a.started = a.dumps[0].t
+
+	b := syntheticSeries("worker-2", 10, 1, 1)
+	for i := range b.dumps {
+		b.dumps[i].t += 1000
+	}
+	b.started = b.dumps[0].t - 3
+
+	opts := Options{
+		From: bound{5, true},
+		To:   bound{7, true},
+	}
+
+	data := NewDataset()
+	for _, s := range []*series{a, b} {
+		if err := readSeries(s, data, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string][]float64{
+		"worker-1": {1500000005, 1500000006, 1500000007},
+		"worker-2": {1500001002, 1500001003, 1500001004},
+	}
+	for cluster, dumps := range expected {
+		if got := data.Dumps[cluster]; !reflect.DeepEqual(got, dumps) {
+			t.Errorf("%s: expected dumps at %v, got %v", cluster, dumps, got)
+		}
+	}
+}
+
+func TestColumnValuesOneByOne(t *testing.T) {
+
+	// Changing with every dump but for one gap,
+	// beyond the runs kept before going dense.
+	n := 4 * denseRuns
+	c := &column{}
+	for i := 0; i < n; i++ {
+		if i != 100 {
+			c.set(i, float64(i/2*2))
+		}
+	}
+
+	if c.values == nil {
+		t.Fatalf("expected values stored one by one after %d runs", len(c.runs))
+	}
+
+	r := columnReader{c: c}
+	for i := 0; i < n; i++ {
+		expected := float64(i / 2 * 2)
+		if i == 100 {
+			expected = math.NaN()
+		}
+		if got := c.at(i); !sameValue(got, expected) {
+			t.Fatalf("dump %d: expected %g, got %g", i, expected, got)
+		}
+		if got := r.at(i); !sameValue(got, expected) {
+			t.Fatalf("dump %d: expected reader to give %g, got %g", i, expected, got)
+		}
+	}
+
+	// Spans of pairs of equal values, the one
+	// of dump 100 cut short by the gap.
+	var spans, covered int
+	c.spans(func(start int, end int, v float64) {
+		if v != float64(start/2*2) {
+			t.Errorf("unexpected span of %g from %d to %d", v, start, end)
+		}
+		spans++
+		covered += end - start
+	})
+	if spans != n/2 || covered != n-1 {
+		t.Errorf("expected %d spans covering %d dumps, got %d covering %d", n/2, n-1, spans, covered)
+	}
+
+	c.truncate(10)
+	if c.n != 10 || len(c.values) != 10 || !math.IsNaN(c.at(10)) {
+		t.Errorf("expected 10 values left, got %d", c.n)
+	}
+}
+
+func TestReadSourceOnce(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Dumps of two runs of one worker, the second one
+	// restarted, each measuring its clock offset.
+	var opened int32
+	a := &dump.Archive{
+		Name: "1500000000-w1",
+	}
+	for i := 0; i < 6; i++ {
+		run := "r1"
+		if i >= 3 {
+			run = "r2"
+		}
+		data := fmt.Sprintf("version\t2\nrun\t%s\t1500000000\nworker\tw1\tprimary\tg1\n%d\t/maildirs/user1\n%d\t/maildirs/user2\nclock\tntp://ref\t0.5\t0.01\n", run, 1000+i, 2000)
+
+		a.Files = append(a.Files, dump.File{
+			Name: strconv.Itoa(1500000000 + i),
+			Open: func() (io.ReadCloser, error) {
+				atomic.AddInt32(&opened, 1)
+				return ioutil.NopCloser(strings.NewReader(data)), nil
+			},
+		})
+	}
+
+	src := &source{
+		path:    "test.zip",
+		archive: a,
+	}
+	readSource(src, Options{})
+
+	if !src.hasWorker || src.worker.Name != "w1" {
+		t.Errorf("expected worker w1, got %+v", src.worker)
+	}
+	if got := len(src.clocks["ntp://ref"]); got != 6 {
+		t.Errorf("expected 6 clock offsets, got %d", got)
+	}
+
+	correctClocks([]*source{src}, Options{})
+
+	stitched, err := stitch([]*source{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := NewDataset()
+	for _, s := range stitched {
+		if err := readSeries(s, data, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if opened != 6 {
+		t.Errorf("expected every dump opened once, got %d opens", opened)
+	}
+
+	if src.values != nil {
+		t.Errorf("expected the values of the source dropped once read")
+	}
+
+	// Offsets are added to the times the dumps were taken.
+	times := map[string][]float64{
+		"w1 (run r1)": {1500000000.5, 1500000001.5, 1500000002.5},
+		"w1 (run r2)": {1500000003.5, 1500000004.5, 1500000005.5},
+	}
+	for cluster, dumps := range times {
+		if got := data.Dumps[cluster]; !reflect.DeepEqual(got, dumps) {
+			t.Errorf("%s: expected dumps at %v, got %v", cluster, dumps, got)
+		}
+	}
+
+	sizes := map[string][]float64{
+		"w1 (run r1)/user1": {1000, 1001, 1002},
+		"w1 (run r2)/user1": {1003, 1004, 1005},
+		"w1 (run r2)/user2": {2000, 2000, 2000},
+	}
+	for key, values := range sizes {
+		for j, v := range values {
+			if got := data.Sizes[key].at(j); got != v {
+				t.Errorf("%s: expected %g at dump %d, got %g", key, v, j, got)
+			}
+		}
+	}
+}
+
+// testSource returns a source at path of an archive called
+// name holding dumps taken a second apart, not yet read.
+func testSource(path string, name string, dumps ...string) *source {
+
+	a := &dump.Archive{
+		Name: name,
+	}
+	for i, data := range dumps {
+		data := data
+		a.Files = append(a.Files, dump.File{
+			Name: strconv.Itoa(1500000000 + i),
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(data)), nil
+			},
+		})
+	}
+
+	return &source{
+		path:    path,
+		archive: a,
+	}
+}
+
+// readDumps reads the dumps of an archive test.zip, taken a
+// second apart, into a new Dataset.
+func readDumps(t *testing.T, opts Options, dumps ...string) (*Dataset, error) {
+
+	src := testSource("test.zip", "1500000000-w1", dumps...)
+	readSource(src, opts)
+
+	stitched, err := stitch([]*source{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := NewDataset()
+	for _, s := range stitched {
+		if err := readSeries(s, data, opts); err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
+
+func TestReadSeriesMalformed(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dumps := []string{
+		"version\t2\n1000\t/maildirs/user1\n",
+		"version\t2\n1001\t/maildirs/user1\n12x\t/maildirs/user1\n2000\t/maildirs/user2\n",
+		"version\t2\n1002\t/maildirs/user1\n",
+	}
+
+	// By default a malformed line aborts, naming where it is.
+	_, err := readDumps(t, Options{}, dumps...)
+	expected := `test.zip: 1500000001: line 3: invalid size: "12x\t/maildirs/user1"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+
+	// Unless the malformed dump is not selected.
+	if _, err := readDumps(t, Options{To: bound{1500000000, false}}, dumps...); err != nil {
+		t.Errorf("expected malformed dump outside the time window to be ignored, got %v", err)
+	}
+
+	// With -lenient it is skipped and reported instead.
+	data, err := readDumps(t, Options{Lenient: true}, dumps...)
+	if err != nil {
+		t.Fatalf("expected malformed line to be skipped, got %v", err)
+	}
+
+	unparsable := Problems{
+		Count: 1,
+		Examples: []Problem{{
+			Archive: "test.zip",
+			Member:  "1500000001",
+			Line:    3,
+			Text:    "12x\t/maildirs/user1",
+			Error:   "invalid size",
+		}},
+	}
+	if !reflect.DeepEqual(data.Diagnostics.Unparsable, unparsable) {
+		t.Errorf("expected diagnostics %+v, got %+v", unparsable, data.Diagnostics.Unparsable)
+	}
+
+	// The rest of the dump is read all the same.
+	sizes := map[string][]float64{
+		"1500000000-w1/user1": {1000, 1001, 1002},
+		"1500000000-w1/user2": {math.NaN(), 2000, math.NaN()},
+	}
+	for key, values := range sizes {
+		for j, v := range values {
+			if got := data.Sizes[key].at(j); !sameValue(got, v) {
+				t.Errorf("%s: expected %g at dump %d, got %g", key, v, j, got)
+			}
+		}
+	}
+}
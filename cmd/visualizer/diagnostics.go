@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Formats of the diagnostics report.
+const (
+	diagnosticsText = "text"
+	diagnosticsJSON = "json"
+)
+
+// maxExamples bounds the lines kept as example per kind
+// of problem and the groups of failed samples reported,
+// keeping reports of bad runs readable.
+const maxExamples = 10
+
+// maxFailedGroups bounds the groups of failed samples
+// kept while reading, later errors count as other.
+const maxFailedGroups = 1000
+
+// pathPattern matches the absolute paths in the error output
+// of du, quoted or not, up to a trailing colon, and those
+// below the sample's path already replaced.
+var pathPattern = regexp.MustCompile(`(^|[\s'"‘])(?:/|<path>)(?:[^\s'"’]*[^\s'"’:])?`)
+
+// Diagnostics sums up the problems found in the dumps read:
+// lines of unknown kind skipped, malformed lines whose values
+// could not be parsed, dumps without any sample and samples
+// that failed, grouped by the error output of du with the
+// paths in it left out. If resampled, the alignment error
+// of every cluster is given as well.
+type Diagnostics struct {
+	Dumps      int            `json:"dumps"`
+	Skipped    Problems       `json:"skipped_lines"`
+	Unparsable Problems       `json:"unparsable_values"`
+	Empty      Problems       `json:"empty_dumps"`
+	Failed     []*FailedGroup `json:"failed_samples"`
+
+	// FailedOther counts the failed samples
+	// of the groups not reported, the least
+	// frequent beyond maxExamples.
+	FailedOther int `json:"failed_samples_other,omitempty"`
+
+	Alignment []Alignment `json:"alignment,omitempty"`
+
+	failed map[string]*FailedGroup
+}
+
+// Problems counts one kind of problem and keeps
+// the first of them as examples.
+type Problems struct {
+	Count    int       `json:"count"`
+	Examples []Problem `json:"examples,omitempty"`
+}
+
+// Problem locates a problem in a dump and gives the line
+// at fault and what is wrong with it, if known.
+type Problem struct {
+	Archive string `json:"archive"`
+	Member  string `json:"member"`
+	Line    int    `json:"line,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (p Problem) String() string {
+
+	s := fmt.Sprintf("%s: %s", p.Archive, p.Member)
+	if p.Line > 0 {
+		s += fmt.Sprintf(": line %d", p.Line)
+	}
+	if p.Error != "" {
+		s += ": " + p.Error
+	}
+	if p.Text != "" {
+		s += fmt.Sprintf(": %q", p.Text)
+	}
+
+	return s
+}
+
+// FailedGroup counts the samples that failed with the
+// same error output of du, paths replaced by '<path>',
+// giving the first as example.
+type FailedGroup struct {
+	Message string  `json:"message"`
+	Count   int     `json:"count"`
+	Example Problem `json:"example"`
+}
+
+// Alignment gives how far the values of a cluster resampled
+// onto Points grid points Step seconds apart by Method lie
+// from the dumps they stem from, in seconds.
+type Alignment struct {
+	Cluster string  `json:"cluster"`
+	Method  string  `json:"method"`
+	Step    float64 `json:"step"`
+	Points  int     `json:"points"`
+	Mean    float64 `json:"mean_error"`
+	Max     float64 `json:"max_error"`
+}
+
+// NewDiagnostics returns empty Diagnostics.
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		failed: make(map[string]*FailedGroup),
+	}
+}
+
+func (ps *Problems) add(p Problem) {
+
+	ps.Count++
+	if len(ps.Examples) < maxExamples {
+		ps.Examples = append(ps.Examples, p)
+	}
+}
+
+// addFailed records the sample p that failed with
+// the error output p.Error, p.Text being its path.
+func (d *Diagnostics) addFailed(p Problem) {
+	d.addFailedGroup(failedGroup(p))
+}
+
+// addFailedGroup records the failed samples of g.
+func (d *Diagnostics) addFailedGroup(g FailedGroup) {
+
+	group, ok := d.failed[g.Message]
+	if !ok {
+		if len(d.failed) >= maxFailedGroups {
+			d.FailedOther += g.Count
+			return
+		}
+
+		group = &FailedGroup{
+			Message: g.Message,
+			Example: g.Example,
+		}
+		d.failed[g.Message] = group
+		d.Failed = append(d.Failed, group)
+	}
+
+	group.Count += g.Count
+}
+
+// failedGroup returns the group of the sample p that
+// failed, see addFailed, counting p alone.
+func failedGroup(p Problem) FailedGroup {
+
+	message := failedMessage(p.Error, p.Text)
+	p.Error = ""
+
+	return FailedGroup{
+		Message: message,
+		Count:   1,
+		Example: p,
+	}
+}
+
+// failedMessage returns the error output of du for the
+// sample of path with all paths replaced by '<path>'.
+func failedMessage(message string, path string) string {
+
+	if path != "" {
+		message = strings.Replace(message, path, "<path>", -1)
+	}
+
+	return pathPattern.ReplaceAllString(message, "${1}<path>")
+}
+
+// Problems returns the number of lines skipped, values
+// unparsable and dumps empty.
+func (d *Diagnostics) Problems() int {
+	return d.Skipped.Count + d.Unparsable.Count + d.Empty.Count
+}
+
+// Write writes the report to w as text or JSON.
+func (d *Diagnostics) Write(w io.Writer, format string) error {
+
+	// Report the most frequent errors only.
+	report := *d
+	report.Failed = append([]*FailedGroup{}, d.Failed...)
+
+	sort.SliceStable(report.Failed, func(i, j int) bool {
+		return report.Failed[i].Count > report.Failed[j].Count
+	})
+
+	if len(report.Failed) > maxExamples {
+		for _, g := range report.Failed[maxExamples:] {
+			report.FailedOther += g.Count
+		}
+		report.Failed = report.Failed[:maxExamples]
+	}
+
+	if format == diagnosticsJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(report)
+	}
+
+	fmt.Fprintf(w, "%d dumps read\n", d.Dumps)
+
+	for _, kind := range []struct {
+		name     string
+		problems Problems
+	}{
+		{"lines skipped", d.Skipped},
+		{"values unparsable", d.Unparsable},
+		{"dumps empty", d.Empty},
+	} {
+		fmt.Fprintf(w, "%d %s\n", kind.problems.Count, kind.name)
+		for _, p := range kind.problems.Examples {
+			fmt.Fprintf(w, "\t%s\n", p)
+		}
+		if more := kind.problems.Count - len(kind.problems.Examples); more > 0 {
+			fmt.Fprintf(w, "\t... and %d more\n", more)
+		}
+	}
+
+	failed := report.FailedOther
+	for _, g := range report.Failed {
+		failed += g.Count
+	}
+
+	fmt.Fprintf(w, "%d samples failed\n", failed)
+	for _, g := range report.Failed {
+		fmt.Fprintf(w, "\t%dx %q, e.g. %s\n", g.Count, g.Message, g.Example)
+	}
+	if report.FailedOther > 0 {
+		fmt.Fprintf(w, "\t... and %d more with other errors\n", report.FailedOther)
+	}
+
+	if len(d.Alignment) > 0 {
+		fmt.Fprintf(w, "%d clusters resampled\n", len(d.Alignment))
+	}
+	for _, a := range d.Alignment {
+		fmt.Fprintf(w, "\t%s: %d points every %.3fs by %s, alignment error mean %.3fs, max %.3fs\n",
+			a.Cluster, a.Points, a.Step, a.Method, a.Mean, a.Max)
+	}
+
+	return nil
+}
+
+// writeDiagnostics writes the report in format to the file
+// at path or stderr. Without format, problems are only
+// counted in the log.
+func writeDiagnostics(d *Diagnostics, format string, path string) error {
+
+	if format == "" {
+		if d.Problems() > 0 {
+			log.Printf("%d lines skipped, %d values unparsable, %d dumps empty, see -diagnostics",
+				d.Skipped.Count, d.Unparsable.Count, d.Empty.Count)
+		}
+		return nil
+	}
+
+	if path == "" {
+		return d.Write(os.Stderr, format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create diagnostics file: %v", err)
+	}
+
+	if err := d.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFailedMessage(t *testing.T) {
+
+	for _, test := range []struct {
+		message, path, expected string
+	}{
+		{
+			"du: cannot access '/data/maildirs/alice': No such file or directory",
+			"/data/maildirs/alice",
+			"du: cannot access '<path>': No such file or directory",
+		},
+		{
+			"du: cannot read directory '/data/maildirs/alice/cur': Permission denied",
+			"/data/maildirs/alice",
+			"du: cannot read directory '<path>': Permission denied",
+		},
+		{
+			"du: cannot access '/data/maildirs/bob/new/1500000000.x:2,S': No such file or directory",
+			"/data/maildirs/bob",
+			"du: cannot access '<path>': No such file or directory",
+		},
+		{
+			"du: /data/maildirs/alice/tmp: Input/output error",
+			"/data/maildirs/alice",
+			"du: <path>: Input/output error",
+		},
+		{
+			"du: cannot access 'maildirs/carol': No such file or directory",
+			"maildirs/carol",
+			"du: cannot access '<path>': No such file or directory",
+		},
+		{
+			"timed out after 5s",
+			"/data/maildirs/alice",
+			"timed out after 5s",
+		},
+	} {
+		if got := failedMessage(test.message, test.path); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.message, test.expected, got)
+		}
+	}
+}
+
+func TestDiagnosticsFailedGroups(t *testing.T) {
+
+	d := NewDiagnostics()
+
+	// The same error of many users forms one group,
+	// errors of their own a group each.
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/data/maildirs/user%d", i)
+		d.addFailed(Problem{
+			Archive: "w1.zip",
+			Member:  "1500000000",
+			Text:    path,
+			Error:   fmt.Sprintf("du: cannot access '%s': No such file or directory", path),
+		})
+		d.addFailed(Problem{
+			Archive: "w1.zip",
+			Member:  "1500000000",
+			Text:    path,
+			Error:   fmt.Sprintf("du: error %d", i),
+		})
+	}
+
+	var text bytes.Buffer
+	if err := d.Write(&text, diagnosticsText); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"200 samples failed\n",
+		"\t100x \"du: cannot access '<path>': No such file or directory\", e.g. w1.zip: 1500000000: \"/data/maildirs/user0\"\n",
+		"\t... and 91 more with other errors\n",
+	} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("expected report to contain %q, got\n%s", expected, text.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := d.Write(&out, diagnosticsJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var report Diagnostics
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Failed) != maxExamples || report.Failed[0].Count != 100 || report.FailedOther != 91 {
+		t.Errorf("expected %d groups led by 100 samples and 91 other, got %d led by %+v and %d other",
+			maxExamples, len(report.Failed), report.Failed[0], report.FailedOther)
+	}
+}
+
+func TestDiagnosticsAlignment(t *testing.T) {
+
+	data := NewDataset()
+	data.Names = []string{"w1", "w2"}
+	data.Dumps["w1"] = []float64{100, 110, 120}
+	data.Dumps["w2"] = []float64{104, 114, 124}
+	data.Sizes["w1/u1"] = testColumn(1, 2, 3)
+	data.Sizes["w2/u1"] = testColumn(1, 2, 3)
+
+	if err := data.resample(Options{Resample: resampleHold, Step: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err := data.Diagnostics.Write(&text, diagnosticsText); err != nil {
+		t.Fatal(err)
+	}
+
+	// w2 is held 6s past each of its dumps.
+	for _, expected := range []string{
+		"2 clusters resampled\n",
+		"\tw1: 3 points every 10.000s by hold, alignment error mean 0.000s, max 0.000s\n",
+		"\tw2: 2 points every 10.000s by hold, alignment error mean 6.000s, max 6.000s\n",
+	} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("expected report to contain %q, got\n%s", expected, text.String())
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+)
+
+// UserFilter selects the users to plot by name or pattern.
+type UserFilter struct {
+	include        map[string]bool
+	exclude        map[string]bool
+	includePattern *regexp.Regexp
+	excludePattern *regexp.Regexp
+
+	// sample, if set, holds the only users
+	// passing, see sampleUsers.
+	sample map[string]bool
+}
+
+// NewUserFilter returns a UserFilter passing the users listed
+// in include, separated by comma, or matching includePattern,
+// all if both are empty, unless listed in exclude or matching
+// excludePattern.
+func NewUserFilter(include string, exclude string, includePattern string, excludePattern string) (*UserFilter, error) {
+
+	f := &UserFilter{
+		include: userSet(include),
+		exclude: userSet(exclude),
+	}
+
+	var err error
+
+	if includePattern != "" {
+		if f.includePattern, err = regexp.Compile(includePattern); err != nil {
+			return nil, fmt.Errorf("invalid include pattern: %v", err)
+		}
+	}
+
+	if excludePattern != "" {
+		if f.excludePattern, err = regexp.Compile(excludePattern); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+func userSet(list string) map[string]bool {
+
+	if list == "" {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, user := range strings.Split(list, ",") {
+		set[strings.TrimSpace(user)] = true
+	}
+
+	return set
+}
+
+// Match reports whether user passes the filter.
+func (f *UserFilter) Match(user string) bool {
+
+	if f == nil {
+		return true
+	}
+
+	if f.exclude[user] || (f.excludePattern != nil && f.excludePattern.MatchString(user)) {
+		return false
+	}
+
+	if f.sample != nil && !f.sample[user] {
+		return false
+	}
+
+	if f.include == nil && f.includePattern == nil {
+		return true
+	}
+
+	return f.include[user] || (f.includePattern != nil && f.includePattern.MatchString(user))
+}
+
+// bound limits the dumps to read: a time in Unix seconds,
+// or seconds since the start of each series if relative.
+type bound struct {
+	t        float64
+	relative bool
+}
+
+// parseBound parses s as RFC 3339, Unix seconds or a
+// duration like '5m' since the start of each series.
+// Empty yields the zero bound, which is unset.
+func parseBound(s string) (bound, error) {
+
+	if s == "" {
+		return bound{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return bound{d.Seconds(), true}, nil
+	}
+
+	t, err := parseTime(s)
+	if err != nil {
+		return bound{}, fmt.Errorf("neither a time nor a duration: %q", s)
+	}
+
+	return bound{float64(t.UnixNano()) / float64(time.Second), false}, nil
+}
+
+// at returns b in Unix seconds for a series started
+// at start, zero if unset.
+func (b bound) at(start float64) float64 {
+
+	if b.relative {
+		return start + b.t
+	}
+
+	return b.t
+}
+
+// inWindow reports whether t lies within
+// from and to, each unset if zero.
+func inWindow(t float64, from float64, to float64) bool {
+	return (from == 0 || t >= from) && (to == 0 || t <= to)
+}
+
+// inPhase reports whether phase is among those to read.
+func inPhase(phase string, opts Options) bool {
+
+	if len(opts.Phases) == 0 {
+		return true
+	}
+
+	for _, p := range opts.Phases {
+		if p == phase {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sampleUsers returns opts.UserFilter passing only n of
+// the users it passes, picked at random by seed among those
+// in the first dump of any source, so that the others are
+// never read. The same users are kept in every cluster.
+// Users not in any first dump are only kept along with all
+// others, if n is not less than the users found.
+func sampleUsers(sources []*source, opts Options, n int, seed int64) *UserFilter {
+
+	found := make([][]string, len(sources))
+	parallel(len(sources), func(i int) error {
+		found[i] = firstUsers(sources[i], opts)
+		return nil
+	})
+
+	byUser := make(map[string]bool)
+	for _, users := range found {
+		for _, user := range users {
+			byUser[user] = true
+		}
+	}
+
+	if n >= len(byUser) {
+		return opts.UserFilter
+	}
+
+	users := make([]string, 0, len(byUser))
+	for user := range byUser {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	keep := make(map[string]bool)
+	for _, i := range rand.New(rand.NewSource(seed)).Perm(len(users))[:n] {
+		keep[users[i]] = true
+	}
+
+	log.Printf("sampled %d of %d users", n, len(users))
+
+	var f UserFilter
+	if opts.UserFilter != nil {
+		f = *opts.UserFilter
+	}
+	f.sample = keep
+
+	return &f
+}
+
+// firstUsers returns the users of the first dump
+// of src passing opts.UserFilter. Problems with the
+// dump are left to be reported once it is read.
+func firstUsers(src *source, opts Options) []string {
+
+	for _, file := range src.archive.Files {
+
+		if _, err := dump.ParseName(file.Name); err != nil {
+			continue
+		}
+
+		p, _ := parseDump(file, src.path, opts)
+		if p == nil {
+			return nil
+		}
+
+		_, _, base := keyBase(p.worker, src.archive.Name, opts)
+
+		var paths []string
+		for _, rec := range p.sizes {
+			paths = append(paths, rec.Path)
+		}
+		for _, rec := range p.errors {
+			paths = append(paths, rec.Path)
+		}
+		for _, rec := range p.intervals {
+			paths = append(paths, rec.Path)
+		}
+
+		var users []string
+		for _, path := range paths {
+			if user, ok := opts.Users.Key(base, path); ok && opts.UserFilter.Match(user) {
+				users = append(users, user)
+			}
+		}
+
+		return users
+	}
+
+	return nil
+}
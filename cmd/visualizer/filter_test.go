@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// sampledUsers returns the users f passes among users.
+func sampledUsers(f *UserFilter, users []string) []string {
+
+	var passed []string
+	for _, user := range users {
+		if f.Match(user) {
+			passed = append(passed, user)
+		}
+	}
+
+	return passed
+}
+
+func TestSampleUsers(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Two workers sharing some of their users, one
+	// more user showing up after the first dumps.
+	first := func(users ...int) string {
+		data := "version\t2\n"
+		for _, u := range users {
+			data += fmt.Sprintf("%d\t/maildirs/user%d\n", 1000+u, u)
+		}
+		return data
+	}
+
+	sources := func() []*source {
+		return []*source{
+			testSource("w1.zip", "1500000000-w1", first(1, 2, 3, 4, 5, 6), first(1, 2, 3, 4, 5, 6, 9)),
+			testSource("w2.zip", "1500000000-w2", first(4, 5, 6, 7, 8), first(4, 5, 6, 7, 8, 9)),
+		}
+	}
+
+	all := []string{"user1", "user2", "user3", "user4", "user5", "user6", "user7", "user8", "user9"}
+
+	filter, err := NewUserFilter("", "user1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{UserFilter: filter}
+
+	// Sampling among the users of the first dumps
+	// the filter passes, the same for the same seed.
+	srcs := sources()
+	sampled := sampleUsers(srcs, opts, 3, 1)
+
+	picked := sampledUsers(sampled, all)
+	if len(picked) != 3 {
+		t.Fatalf("expected 3 users picked, got %v", picked)
+	}
+	for _, user := range picked {
+		if user == "user1" || user == "user9" {
+			t.Errorf("expected only users selected in the first dumps picked, got %v", picked)
+		}
+	}
+
+	if again := sampledUsers(sampleUsers(sources(), opts, 3, 1), all); !reflect.DeepEqual(again, picked) {
+		t.Errorf("expected the same seed to pick %v again, got %v", picked, again)
+	}
+
+	if !reflect.DeepEqual(sampledUsers(filter, all), all[1:]) {
+		t.Errorf("expected the filter sampled from to be left alone")
+	}
+
+	// The users not picked are never read.
+	opts.UserFilter = sampled
+	var read []string
+	for _, src := range srcs {
+		readSource(src, opts)
+		for user := range src.values.sizes {
+			if !sampled.Match(user) {
+				t.Errorf("%s: expected only users picked read, got %s", src.path, user)
+			}
+			read = append(read, user)
+		}
+	}
+
+	if len(read) < len(picked) {
+		t.Errorf("expected the users picked read, got %v", read)
+	}
+
+	// Sampling no fewer than there are keeps all,
+	// users showing up later included.
+	opts.UserFilter = filter
+	if kept := sampledUsers(sampleUsers(sources(), opts, 8, 1), all); !reflect.DeepEqual(kept, all[1:]) {
+		t.Errorf("expected all users but user1 kept, got %v", kept)
+	}
+}
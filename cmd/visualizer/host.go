@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostWriter plots the host metrics matching any of
+// patterns in subplot row of rows below the sizes, sharing
+// their time axis. One labelled line is drawn per
+// cluster and metric.
+func hostWriter(w io.Writer, data *Dataset, opts Options, patterns []string, row int, rows int) error {
+
+	series := make(map[string]bool)
+
+	for key := range data.Host {
+		metric := strings.SplitN(key, "/", 2)[1]
+		for _, pattern := range patterns {
+			if ok, err := path.Match(pattern, metric); err != nil {
+				return fmt.Errorf("invalid host metric pattern %q: %v", pattern, err)
+			} else if ok {
+				series[key] = true
+			}
+		}
+	}
+
+	var keys []string
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "plot.subplot(%d, 1, %d, sharex=plot.gca())\n", rows, row)
+
+	origin := data.origin()
+	gaps := newGaps(data, opts.Gap)
+
+	for i, key := range keys {
+		cluster := strings.SplitN(key, "/", 2)[0]
+		dumps := data.Dumps[cluster]
+
+		values := data.Host[key]
+
+		var ts, vals []float64
+		for j, t := range dumps {
+			value := values.at(j)
+			if math.IsNaN(value) {
+				continue
+			}
+
+			if len(ts) > 0 && gaps.before(cluster, j) {
+				ts = append(ts, (dumps[j-1]+t)/2)
+				vals = append(vals, math.NaN())
+			}
+
+			ts = append(ts, t)
+			vals = append(vals, value)
+		}
+
+		fmt.Fprintf(w, "h%d = ", i)
+		writeTimeList(w, ts, origin, opts)
+		fmt.Fprintf(w, "\nv%d = ", i)
+		writeValueList(w, vals, 'g')
+		fmt.Fprintf(w, "\nplot.plot(h%d, v%d, label=%s)\n", i, i, strconv.Quote(key))
+	}
+
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "plot.legend(loc='upper left')\n")
+	}
+
+	return nil
+}
@@ -1,91 +1,311 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
-	"bytes"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
+
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// Options control how dumps are read.
+type Options struct {
+	// ClockCorrection shifts the timestamps of every
+	// cluster by the clock offset its dumper measured.
+	ClockCorrection bool
+
+	// ClockRef selects the reference clock to correct
+	// all clusters against. Empty selects the one most
+	// archives were measured against.
+	ClockRef string
+
+	// ClockMaxUncertainty, if set, ignores clock offsets
+	// less certain than that many seconds.
+	ClockMaxUncertainty float64
+
+	// Topology, if set, names the worker each archive
+	// stems from if its dumps do not say so themselves.
+	Topology *topology.Topology
+
+	// Users extracts the user keys from Maildir paths.
+	// Nil takes the last path element.
+	Users *UserKeys
+
+	// Axis is axisRelative to plot seconds since the
+	// first dump or axisAbsolute for wall-clock time.
+	Axis string
+
+	// Gap is the spacing of two dumps of a cluster beyond
+	// which its lines are broken. Zero breaks them once the
+	// spacing exceeds twice the one expected.
+	Gap float64
+
+	// Resample, if set, aligns all clusters onto a common
+	// grid spaced Step seconds apart by resampleHold,
+	// resampleLinear or resampleNearest, the latter taking
+	// values up to Tolerance seconds away.
+	Resample  string
+	Step      float64
+	Tolerance float64
+
+	// Lenient skips malformed lines of dumps
+	// rather than aborting, noting them in
+	// the diagnostics.
+	Lenient bool
+
+	// UserFilter selects the users to read, nil all.
+	UserFilter *UserFilter
+
+	// From and To, if set, bound the dumps
+	// to read, Phases to those marked with
+	// one of them if set.
+	From   bound
+	To     bound
+	Phases []string
+}
+
+// Kinds of time axes.
+const (
+	axisRelative = "relative"
+	axisAbsolute = "absolute"
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatal("You must provide two files to compare")
-	}
+	clockCorrectionFlag := flag.Bool("clockCorrection", true, "Correct timestamps by the clock offsets recorded in the dumps.")
+	clockRefFlag := flag.String("clockRef", "", "Reference clock to correct the timestamps of all archives against. Defaults to the one most archives recorded offsets to.")
+	clockMaxUncertaintyFlag := flag.Duration("clockMaxUncertainty", 0, "Ignore clock offsets uncertain by more than this, i.e. half their round trip time. 0 keeps all.")
+	topologyFlag := flag.String("topology", "", "Specify path to a topology file to group and style lines by replica group and role.")
+	axisFlag := flag.String("axis", axisRelative, "Time axis to plot: 'relative' in seconds since the first dump or 'absolute' wall-clock time.")
+	gapFlag := flag.Duration("gap", 0, "Spacing of two dumps beyond which lines are broken. Defaults to twice the expected interval.")
+	userPrefixFlag := flag.String("userPrefix", "", "Prefix to strip from Maildir paths to obtain the user, e.g. '/data/maildirs/'. Paths without it are skipped.")
+	userPatternFlag := flag.String("userPattern", "", "Regular expression extracting the user from Maildir paths via the group named 'user' or the first group. Paths not matching are skipped.")
+	userMapFlag := flag.String("userMap", "", "Specify path to a JSON file mapping the users of each cluster to the logical users to compare.")
+	archiveWorkerFlag := flag.String("archiveWorker", "", "Worker names of archives to read from globs and object store prefixes, separated by comma. Accepts patterns like 'worker-*'.")
+	archiveFromFlag := flag.String("archiveFrom", "", "Skip archives from globs and object store prefixes started before this time, in RFC 3339 or Unix seconds.")
+	archiveToFlag := flag.String("archiveTo", "", "Skip archives from globs and object store prefixes started after this time, in RFC 3339 or Unix seconds.")
+	s3EndpointFlag := flag.String("s3Endpoint", "", "Endpoint of an S3-compatible store to read s3:// URLs from, e.g. 'http://localhost:9000'. Defaults to AWS.")
+	resampleFlag := flag.String("resample", "", "Align all clusters onto a common time grid by 'hold' (previous value), 'linear' (interpolation) or 'nearest' (within -tolerance).")
+	stepFlag := flag.Duration("step", 0, "Spacing of the grid to resample onto. Defaults to the median spacing of all dumps.")
+	toleranceFlag := flag.Duration("tolerance", 0, "Distance up to which -resample nearest takes values and held values survive missing dumps. Defaults to half the step.")
+	lenientFlag := flag.Bool("lenient", false, "Skip malformed lines of dumps instead of aborting.")
+	diagnosticsFlag := flag.String("diagnostics", "", "Report problems found in the dumps as 'text' or 'json': lines skipped, values unparsable, empty dumps and failed samples.")
+	diagnosticsFileFlag := flag.String("diagnosticsFile", "", "Specify path to write the diagnostics report to. Defaults to stderr.")
+	fromFlag := flag.String("from", "", "Skip dumps taken before this time, in RFC 3339, Unix seconds or as duration since the start of each run like '5m'.")
+	toFlag := flag.String("to", "", "Skip dumps taken after this time, in RFC 3339, Unix seconds or as duration since the start of each run like '1h'.")
+	phaseFlag := flag.String("phase", "", "Phases of the benchmark to plot, separated by comma, as marked by the dumpers. Defaults to all dumps.")
+	includeUsersFlag := flag.String("includeUsers", "", "Users to plot, separated by comma. Defaults to all.")
+	excludeUsersFlag := flag.String("excludeUsers", "", "Users not to plot, separated by comma.")
+	includeUserPatternFlag := flag.String("includeUserPattern", "", "Regular expression of users to plot in addition to -includeUsers.")
+	excludeUserPatternFlag := flag.String("excludeUserPattern", "", "Regular expression of users not to plot.")
+	sampleUsersFlag := flag.Int("sampleUsers", 0, "Number of users to plot, picked at random among those selected in the first dump of any archive. 0 plots all.")
+	sampleSeedFlag := flag.Int64("sampleSeed", 1, "Seed to pick -sampleUsers by, the same seed picking the same users.")
+	hostFlag := flag.String("host", "", "Host metrics to plot below the sizes, separated by comma. Accepts patterns like 'disk.*.util'.")
+	referenceFlag := flag.Bool("reference", false, "Plot below the sizes how many KiB, as counted by 'du -s', every user of a replica trails the primary of its replica group. Roles are taken from -topology or the dumps.")
+	flag.Parse()
 
-	files := os.Args[1:3]
+	if flag.NArg() == 0 {
+		log.Fatal("You must provide at least one archive to plot")
+	}
 
-	data := make(map[string]map[string]int)
+	s3Endpoint = *s3EndpointFlag
 
-	for _, file := range files {
-		if err := readZip(file, data); err != nil {
-			log.Fatal(err)
-		}
+	var filter archiveFilter
+	if *archiveWorkerFlag != "" {
+		filter.workers = strings.Split(*archiveWorkerFlag, ",")
 	}
 
-	header := "import matplotlib.pyplot as plot\n\n"
-	buf := bytes.NewBufferString(header)
+	var err error
+	if filter.from, err = parseTime(*archiveFromFlag); err != nil {
+		log.Fatalf("invalid archiveFrom: %v", err)
+	}
+	if filter.to, err = parseTime(*archiveToFlag); err != nil {
+		log.Fatalf("invalid archiveTo: %v", err)
+	}
 
-	if err := matplotlibWriter(buf, data); err != nil {
+	files, err := expandArchives(flag.Args(), filter)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	//if err := matplotlibLegendWriter(buf, results); err != nil {
-	//	return err
-	//}
+	opts := Options{
+		ClockCorrection:     *clockCorrectionFlag,
+		ClockRef:            *clockRefFlag,
+		ClockMaxUncertainty: clockMaxUncertaintyFlag.Seconds(),
+		Axis:                *axisFlag,
+		Gap:                 gapFlag.Seconds(),
+		Resample:            *resampleFlag,
+		Step:                stepFlag.Seconds(),
+		Tolerance:           toleranceFlag.Seconds(),
+		Lenient:             *lenientFlag,
+	}
 
-	footer := "plot.grid(True)\n" +
-		fmt.Sprintf("plot.title('%s')\n", "foo") +
-		"plot.show()\n"
+	if opts.Axis != axisRelative && opts.Axis != axisAbsolute {
+		log.Fatalf("unknown axis %q", opts.Axis)
+	}
 
-	buf.WriteString(footer)
+	switch opts.Resample {
+	case "", resampleHold, resampleLinear, resampleNearest:
+	default:
+		log.Fatalf("unknown resampling method %q", opts.Resample)
+	}
 
-	_, err := fmt.Fprint(os.Stdout, buf.String())
+	switch *diagnosticsFlag {
+	case "", diagnosticsText, diagnosticsJSON:
+	default:
+		log.Fatalf("unknown diagnostics format %q", *diagnosticsFlag)
+	}
+
+	opts.Users, err = NewUserKeys(*userPrefixFlag, *userPatternFlag, *userMapFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func readZip(path string, data map[string]map[string]int) error {
-	zr, err := zip.OpenReader(path)
+	opts.UserFilter, err = NewUserFilter(*includeUsersFlag, *excludeUsersFlag, *includeUserPatternFlag, *excludeUserPatternFlag)
 	if err != nil {
-		return fmt.Errorf("failed to open zip: %v", err)
+		log.Fatal(err)
 	}
 
-	cluster := filepath.Base(path)
-	cluster = strings.TrimSuffix(cluster, ".zip")
+	if *phaseFlag != "" {
+		opts.Phases = strings.Split(*phaseFlag, ",")
+	}
 
-	for _, file := range zr.File {
-		f, err := file.Open()
+	if *topologyFlag != "" {
+		topo, err := topology.Load(*topologyFlag)
 		if err != nil {
-			return fmt.Errorf("failed to open file in zip: %v", err)
+			log.Fatal(err)
+		}
+		opts.Topology = topo
+	}
+
+	// Archives are opened and scanned in parallel.
+	sources := make([]*source, len(files))
+	err = parallel(len(files), func(i int) error {
+		src, err := openSource(files[i])
+		sources[i] = src
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Users are sampled before any are read,
+	// so that the others take no memory.
+	if *sampleUsersFlag > 0 {
+		opts.UserFilter = sampleUsers(sources, opts, *sampleUsersFlag, *sampleSeedFlag)
+	}
+
+	parallel(len(sources), func(i int) error {
+		readSource(sources[i], opts)
+		return nil
+	})
+
+	if opts.ClockCorrection {
+		correctClocks(sources, opts)
+	}
+
+	stitched, err := stitch(sources)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.From, err = parseBound(*fromFlag); err != nil {
+		log.Fatalf("invalid from: %v", err)
+	}
+	if opts.To, err = parseBound(*toFlag); err != nil {
+		log.Fatalf("invalid to: %v", err)
+	}
+
+	data := NewDataset()
+
+	for _, s := range stitched {
+		if err := readSeries(s, data, opts); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		if _, ok := data[file.Name]; !ok {
-			data[file.Name] = make(map[string]int)
+	if len(data.Names) == 0 && (opts.From != bound{} || opts.To != bound{} || len(opts.Phases) > 0) {
+		log.Fatal("no dumps within the time window and phases given")
+	}
+
+	if opts.Resample != "" {
+		if err := data.resample(opts); err != nil {
+			log.Fatal(err)
 		}
+	}
+
+	if err := writeDiagnostics(data.Diagnostics, *diagnosticsFlag, *diagnosticsFileFlag); err != nil {
+		log.Fatal(err)
+	}
+
+	var hostPatterns []string
+	if *hostFlag != "" {
+		hostPatterns = strings.Split(*hostFlag, ",")
+	}
+
+	// Lists are written as they are built rather than
+	// holding the whole script in memory.
+	out := bufio.NewWriter(os.Stdout)
+
+	fmt.Fprintf(out, "import matplotlib.pyplot as plot\n")
+	if opts.Axis == axisAbsolute {
+		fmt.Fprintf(out, "import datetime\n")
+	}
+	fmt.Fprintf(out, "\n")
 
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			line := scanner.Text()
-			tabs := strings.Split(line, "\t")
-			if len(tabs) == 2 {
-				bytes, err := strconv.Atoi(tabs[0])
-				if err != nil {
-					return fmt.Errorf(err.Error())
-				}
-
-				user := strings.Replace(tabs[1], "/data/maildir/", "", -1)
-				data[file.Name][fmt.Sprintf("%s/%s", cluster, user)] = bytes
-			} else {
-				log.Println(line)
-			}
+	// Host metrics and the comparison with the primaries
+	// get a subplot each below the sizes.
+	rows := 1
+	if len(hostPatterns) > 0 {
+		rows++
+	}
+	if *referenceFlag {
+		rows++
+	}
+
+	if rows > 1 {
+		fmt.Fprintf(out, "plot.subplot(%d, 1, 1)\n", rows)
+	}
+
+	if err := matplotlibWriter(out, data, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	row := 1
+	if len(hostPatterns) > 0 {
+		row++
+		fmt.Fprintf(out, "plot.grid(True)\n")
+		if err := hostWriter(out, data, opts, hostPatterns, row, rows); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *referenceFlag {
+		row++
+		fmt.Fprintf(out, "plot.grid(True)\n")
+		if err := referenceWriter(out, data, opts, row, rows); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	return nil
+	//if err := matplotlibLegendWriter(buf, results); err != nil {
+	//	return err
+	//}
+
+	if opts.Axis == axisAbsolute {
+		fmt.Fprintf(out, "plot.xlabel('wall-clock time')\n")
+		fmt.Fprintf(out, "plot.gcf().autofmt_xdate()\n")
+	} else {
+		fmt.Fprintf(out, "plot.xlabel('seconds since first dump')\n")
+	}
+
+	fmt.Fprintf(out, "plot.grid(True)\n")
+	fmt.Fprintf(out, "plot.title('%s')\n", "foo")
+	fmt.Fprintf(out, "plot.show()\n")
+
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// s3Endpoint overrides the S3 endpoint, e.g. to
+// read from an S3-compatible store like Minio.
+var s3Endpoint string
+
+// splitObjectURL splits 'gs://bucket/key'
+// or 's3://bucket/key' into bucket and key.
+func splitObjectURL(u string) (string, string) {
+
+	rest := u[strings.Index(u, "://")+3:]
+
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// listObjects returns the URLs of all archives below the
+// prefix of a GCS or S3 URL, e.g. 'gs://bucket/maildirs/'.
+func listObjects(ctx context.Context, u string) ([]string, error) {
+
+	bucket, prefix := splitObjectURL(u)
+	scheme := u[:strings.Index(u, "://")+3]
+
+	var keys []string
+	var err error
+
+	if scheme == "gs://" {
+		keys, err = listGCS(ctx, bucket, prefix)
+	} else {
+		keys, err = listS3(ctx, bucket, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			urls = append(urls, scheme+bucket+"/"+key)
+		}
+	}
+
+	return urls, nil
+}
+
+// fetchObject requests the object at a GCS
+// or S3 URL for download.
+func fetchObject(ctx context.Context, u string) (io.ReadCloser, error) {
+
+	bucket, key := splitObjectURL(u)
+
+	if strings.HasPrefix(u, "gs://") {
+		return fetchGCS(ctx, bucket, key)
+	}
+
+	return fetchS3(ctx, bucket, key)
+}
+
+func listGCS(ctx context.Context, bucket string, prefix string) ([]string, error) {
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var keys []string
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, attrs.Name)
+	}
+
+	return keys, nil
+}
+
+func fetchGCS(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := client.Bucket(bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return gcsReader{r, client}, nil
+}
+
+// gcsReader closes the client along with the object.
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r gcsReader) Close() error {
+	r.Reader.Close()
+	return r.client.Close()
+}
+
+// s3ListResult is the relevant part of a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func listS3(ctx context.Context, bucket string, prefix string) ([]string, error) {
+
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		body, err := s3Get(ctx, bucket, "", query)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse listing: %v", err)
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func fetchS3(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return s3Open(ctx, bucket, key, nil)
+}
+
+// s3Get GETs key of bucket, or the bucket itself if
+// key is empty, and reads the whole body, see s3Open.
+func s3Get(ctx context.Context, bucket string, key string, query url.Values) ([]byte, error) {
+
+	body, err := s3Open(ctx, bucket, key, query)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// s3Open GETs key of bucket, or the bucket itself if key is
+// empty, via path-style requests. Requests are signed with
+// AWS Signature Version 4 if AWS_ACCESS_KEY_ID is set.
+func s3Open(ctx context.Context, bucket string, key string, query url.Values) (io.ReadCloser, error) {
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	escapedPath := "/" + s3Escape(bucket, false)
+	if key != "" {
+		escapedPath += "/" + s3Escape(key, true)
+	}
+
+	rawQuery := s3Query(query)
+
+	u, err := url.Parse(endpoint + escapedPath)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		s3Sign(req, u.Host, escapedPath, rawQuery, region, accessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), time.Now())
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		// The error message is in the body.
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp.Body, nil
+}
+
+// emptySHA256 is the hash of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Sign adds the headers of AWS Signature Version 4 to req.
+func s3Sign(req *http.Request, host string, escapedPath string, rawQuery string, region string, accessKey string, secretKey string, sessionToken string, now time.Time) {
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": emptySHA256,
+		"x-amz-date":           stamp,
+	}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+		headers["x-amz-security-token"] = sessionToken
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		escapedPath,
+		rawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	signingKey := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query encodes query sorted by key as required for signing.
+func s3Query(query url.Values) string {
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes all but the unreserved
+// characters of RFC 3986 and, if keepSlash, '/'.
+func s3Escape(s string, keepSlash bool) string {
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
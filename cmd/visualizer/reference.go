@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// topology returns the topology of the clusters read
+// and the clusters each of its workers was read as,
+// e.g. one per run.
+func (d *Dataset) topology() (*topology.Topology, map[string][]string) {
+
+	topo := &topology.Topology{}
+	clusters := make(map[string][]string)
+
+	for _, cluster := range d.Names {
+
+		w, ok := d.Clusters[cluster]
+		if !ok {
+			continue
+		}
+
+		if len(clusters[w.Name]) == 0 {
+			topo.Workers = append(topo.Workers, w)
+		}
+		clusters[w.Name] = append(clusters[w.Name], cluster)
+	}
+
+	return topo, clusters
+}
+
+// overlap returns the seconds the dumps of
+// clusters a and b have in common.
+func (d *Dataset) overlap(a string, b string) float64 {
+
+	da, db := d.Dumps[a], d.Dumps[b]
+	if len(da) == 0 || len(db) == 0 {
+		return 0
+	}
+
+	return math.Min(da[len(da)-1], db[len(db)-1]) - math.Max(da[0], db[0])
+}
+
+// referenceWriter plots in subplot row of rows how many KiB
+// every user of a replica trails the primary of its replica
+// group, which serves as the group's reference: the size of
+// the primary at its last dump up to the replica's minus the
+// replica's size, both in the 1K blocks of 'du -s'. Where the primary was read as several
+// clusters, the one overlapping the replica most is taken.
+func referenceWriter(w io.Writer, data *Dataset, opts Options, row int, rows int) error {
+
+	topo, workerClusters := data.topology()
+
+	fmt.Fprintf(w, "plot.subplot(%d, 1, %d, sharex=plot.gca())\n", rows, row)
+
+	groups := groupIndices(data)
+	clusters := clusterIndices(data, groups)
+
+	origin := data.origin()
+	gaps := newGaps(data, opts.Gap)
+
+	i := 0
+	for _, group := range topo.Groups() {
+
+		primary, ok := topo.Primary(group)
+		if !ok {
+			log.Printf("Not comparing replica group %q: no primary read", group)
+			continue
+		}
+
+		for _, replica := range topo.Workers {
+
+			if replica.Role != topology.RoleReplica || replica.Group != group {
+				continue
+			}
+
+			for _, cluster := range workerClusters[replica.Name] {
+
+				ref, best := "", 0.0
+				for _, c := range workerClusters[primary.Name] {
+					if o := data.overlap(cluster, c); o >= best {
+						ref, best = c, o
+					}
+				}
+
+				if ref == "" {
+					log.Printf("Not comparing %s: no dumps of primary %s at the same time", cluster, primary.Name)
+					continue
+				}
+
+				n := writeTrailing(w, data, gaps, origin, opts, cluster, ref, i)
+
+				for k := i; k < i+n; k++ {
+					fmt.Fprintf(w, "plot.plot(r%d, d%d, color=%s, linestyle='--')\n", k, k, clusterColour(data, groups, clusters, cluster))
+				}
+				i += n
+			}
+		}
+	}
+
+	if i == 0 {
+		log.Printf("No replica to compare with its primary, roles are taken from -topology or the dumps")
+	}
+
+	fmt.Fprintf(w, "plot.ylabel('KiB behind primary')\n")
+
+	return nil
+}
+
+// writeTrailing writes how many bytes each user of cluster
+// trails the same user in ref as lists r<i> and d<i> on,
+// one pair per user read from both, and returns the
+// number of pairs written.
+func writeTrailing(w io.Writer, data *Dataset, gaps *gaps, origin float64, opts Options, cluster string, ref string, i int) int {
+
+	var users []string
+	for key := range data.Sizes {
+		if user := strings.TrimPrefix(key, cluster+"/"); user != key {
+			if _, ok := data.Sizes[ref+"/"+user]; ok {
+				users = append(users, user)
+			}
+		}
+	}
+	sort.Strings(users)
+
+	dumps, refDumps := data.Dumps[cluster], data.Dumps[ref]
+
+	for n, user := range users {
+
+		sizes, refSizes := data.Sizes[cluster+"/"+user], data.Sizes[ref+"/"+user]
+
+		var ts, vals []float64
+		for j, t := range dumps {
+
+			if len(ts) > 0 && gaps.before(cluster, j) {
+				ts = append(ts, (dumps[j-1]+t)/2)
+				vals = append(vals, math.NaN())
+			}
+
+			ts = append(ts, t)
+			vals = append(vals, refSizes.at(heldAt(refDumps, gaps, ref, t))-sizes.at(j))
+		}
+
+		fmt.Fprintf(w, "r%d = ", i+n)
+		writeTimeList(w, ts, origin, opts)
+		fmt.Fprintf(w, "\nd%d = ", i+n)
+		writeValueList(w, vals, 'f')
+		io.WriteString(w, "\n")
+	}
+
+	return len(users)
+}
+
+// heldAt returns the index of the last of the dumps of
+// cluster taken up to t, allowing for rounding of corrected
+// timestamps, or -1 if there is none or the cluster's line
+// is broken after it.
+func heldAt(dumps []float64, gaps *gaps, cluster string, t float64) int {
+
+	j := sort.Search(len(dumps), func(j int) bool {
+		return dumps[j] > t+0.001
+	}) - 1
+
+	switch {
+	case j < 0:
+		return -1
+	case j+1 < len(dumps) && gaps.before(cluster, j+1) && t > dumps[j]+0.001:
+		return -1
+	case j+1 == len(dumps) && j > 0 && t-dumps[j] > dumps[j]-dumps[j-1]:
+		return -1
+	}
+
+	return j
+}
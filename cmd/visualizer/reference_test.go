@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// testColumn returns a column of values, NaN where missing.
+func testColumn(values ...float64) *column {
+
+	c := &column{}
+	for i, v := range values {
+		c.set(i, v)
+	}
+
+	return c
+}
+
+func TestReferenceWriter(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	data := NewDataset()
+	data.Names = []string{"w1", "w2", "w3"}
+	data.Clusters["w1"] = topology.Worker{Name: "w1", Group: "a", Role: topology.RolePrimary}
+	data.Clusters["w2"] = topology.Worker{Name: "w2", Group: "a", Role: topology.RoleReplica}
+	data.Clusters["w3"] = topology.Worker{Name: "w3", Group: "b", Role: topology.RoleReplica}
+
+	// The replica dumps in between the primary's, and on
+	// past the primary's last dump after a gap.
+	data.Dumps["w1"] = []float64{100, 110, 120}
+	data.Dumps["w2"] = []float64{105, 115, 125, 160}
+	data.Dumps["w3"] = []float64{100}
+
+	data.Sizes["w1/u1"] = testColumn(10, 20, 30)
+	data.Sizes["w2/u1"] = testColumn(5, 20, 25, 30)
+	data.Sizes["w2/u2"] = testColumn(1, 1, 1, 1)
+	data.Sizes["w3/u1"] = testColumn(1)
+
+	var out bytes.Buffer
+	if err := referenceWriter(&out, data, Options{}, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only u1 is read from both primary and replica, w3
+	// belongs to a group without primary.
+	expected := strings.Join([]string{
+		"plot.subplot(2, 1, 2, sharex=plot.gca())",
+		"r0 = [5.000, 15.000, 25.000, 42.500, 60.000]",
+		"d0 = [5, 0, 5, None, None]",
+		"plot.plot(r0, d0, color='C0', linestyle='--')",
+		"plot.ylabel('KiB behind primary')",
+		"",
+	}, "\n")
+
+	if got := out.String(); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Methods of resampling onto a common time grid.
+const (
+	resampleHold    = "hold"
+	resampleLinear  = "linear"
+	resampleNearest = "nearest"
+)
+
+// alignment sums up how far the values resampled
+// onto the grid lie from the dumps they stem from.
+type alignment struct {
+	points int
+	sum    float64
+	max    float64
+}
+
+func (a *alignment) add(err float64) {
+	a.points++
+	a.sum += err
+	a.max = math.Max(a.max, err)
+}
+
+// resample moves the dumps of all clusters onto one grid
+// spaced opts.Step apart from the first dump of all, the
+// median spacing of all dumps if zero. Sizes and host
+// metrics are taken by opts.Resample, intervals held unless
+// taking the nearest and errors moved to the nearest grid
+// point. Values are not carried across missing dumps. The
+// alignment error of each cluster is logged and added to
+// the diagnostics.
+func (d *Dataset) resample(opts Options) error {
+
+	step := opts.Step
+	if step <= 0 {
+		step = d.medianSpacing()
+	}
+	if step <= 0 {
+		return fmt.Errorf("no cluster has two dumps to derive the grid step from, set -step")
+	}
+
+	tolerance := opts.Tolerance
+	if tolerance <= 0 {
+		tolerance = step / 2
+	}
+
+	origin := d.origin()
+	gaps := newGaps(d, opts.Gap)
+
+	for _, cluster := range d.Names {
+
+		dumps := d.Dumps[cluster]
+		if len(dumps) == 0 {
+			continue
+		}
+
+		// The grid covers the dumps of the cluster, reaching out
+		// by the tolerance when taking the nearest value.
+		margin := 0.0
+		if opts.Resample == resampleNearest {
+			margin = tolerance
+		}
+
+		first := math.Ceil((dumps[0] - margin - origin) / step)
+		last := math.Floor((dumps[len(dumps)-1] + margin - origin) / step)
+
+		var grid []float64
+		for k := first; k <= last; k++ {
+			grid = append(grid, origin+k*step)
+		}
+
+		r := newResampler(dumps, grid, gaps.breaks[cluster], tolerance)
+
+		var align alignment
+
+		for _, cols := range []map[string]*column{d.Sizes, d.Host} {
+			for key, c := range cols {
+				if strings.HasPrefix(key, cluster+"/") {
+					cols[key] = r.column(c, opts.Resample, &align)
+				}
+			}
+		}
+
+		// Intervals have to be known wherever values are.
+		intervals := resampleHold
+		if opts.Resample == resampleNearest {
+			intervals = resampleNearest
+		}
+
+		for key, c := range d.Intervals {
+			if strings.HasPrefix(key, cluster+"/") {
+				d.Intervals[key] = r.column(c, intervals, nil)
+			}
+		}
+
+		for key, errs := range d.Errors {
+			if !strings.HasPrefix(key, cluster+"/") {
+				continue
+			}
+
+			moved := make(map[int]string)
+			for i, msg := range errs {
+				if len(grid) > 0 {
+					moved[r.nearest(dumps[i])] = msg
+				}
+			}
+			d.Errors[key] = moved
+		}
+
+		d.Dumps[cluster] = grid
+
+		if align.points > 0 {
+			a := Alignment{
+				Cluster: cluster,
+				Method:  opts.Resample,
+				Step:    step,
+				Points:  len(grid),
+				Mean:    align.sum / float64(align.points),
+				Max:     align.max,
+			}
+			d.Diagnostics.Alignment = append(d.Diagnostics.Alignment, a)
+
+			log.Printf("resampled %s onto %d points every %.3fs by %s, alignment error mean %.3fs, max %.3fs",
+				a.Cluster, a.Points, a.Step, a.Method, a.Mean, a.Max)
+		}
+	}
+
+	return nil
+}
+
+// medianSpacing returns the median spacing of the dumps of
+// all clusters, or zero if no cluster has two dumps.
+func (d *Dataset) medianSpacing() float64 {
+
+	var spacings []float64
+	for _, dumps := range d.Dumps {
+		for i := 1; i < len(dumps); i++ {
+			spacings = append(spacings, dumps[i]-dumps[i-1])
+		}
+	}
+
+	if len(spacings) == 0 {
+		return 0
+	}
+	sort.Float64s(spacings)
+
+	return spacings[len(spacings)/2]
+}
+
+// resampler maps the columns of one cluster onto its grid.
+type resampler struct {
+	dumps     []float64
+	grid      []float64
+	tolerance float64
+
+	// breaks counts the breaks up to each dump.
+	breaks []int
+}
+
+func newResampler(dumps []float64, grid []float64, breaks []bool, tolerance float64) *resampler {
+
+	r := &resampler{
+		dumps:     dumps,
+		grid:      grid,
+		tolerance: tolerance,
+		breaks:    make([]int, len(dumps)),
+	}
+
+	for i := 1; i < len(dumps); i++ {
+		r.breaks[i] = r.breaks[i-1]
+		if i < len(breaks) && breaks[i] {
+			r.breaks[i]++
+		}
+	}
+
+	return r
+}
+
+// broken reports whether dumps are missing
+// anywhere between the dumps a and b.
+func (r *resampler) broken(a int, b int) bool {
+	return r.breaks[b] > r.breaks[a]
+}
+
+// nearest returns the grid point closest to t.
+func (r *resampler) nearest(t float64) int {
+
+	j := 0
+	if len(r.grid) > 1 {
+		j = int(math.Floor((t-r.grid[0])/(r.grid[1]-r.grid[0]) + 0.5))
+	}
+
+	if j < 0 {
+		return 0
+	} else if j >= len(r.grid) {
+		return len(r.grid) - 1
+	}
+
+	return j
+}
+
+// column resamples c by method, adding the
+// alignment error of every value to align.
+func (r *resampler) column(c *column, method string, align *alignment) *column {
+
+	n := len(r.dumps)
+
+	// Index of the dump last and next
+	// having a value, -1 and n if none.
+	values := make([]float64, n)
+	prev := make([]int, n)
+	next := make([]int, n)
+
+	for i := range values {
+		values[i] = c.at(i)
+		prev[i] = -1
+		if i > 0 {
+			prev[i] = prev[i-1]
+		}
+		if !math.IsNaN(values[i]) {
+			prev[i] = i
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		next[i] = n
+		if i < n-1 {
+			next[i] = next[i+1]
+		}
+		if !math.IsNaN(values[i]) {
+			next[i] = i
+		}
+	}
+
+	out := &column{}
+	p := -1
+
+	for j, g := range r.grid {
+
+		// p is the last dump at or before g.
+		for p+1 < n && r.dumps[p+1] <= g {
+			p++
+		}
+
+		a, b := -1, n
+		if p >= 0 {
+			a = prev[p]
+		}
+		if p+1 < n {
+			b = next[p+1]
+		}
+		if a >= 0 && r.dumps[a] == g {
+			b = a
+		}
+
+		v, err := math.NaN(), 0.0
+
+		switch method {
+		case resampleHold:
+			// Within missing dumps values are only
+			// held up to the tolerance.
+			inGap := p >= 0 && p+1 < n && r.broken(p, p+1) && g-r.dumps[p] > r.tolerance
+			if a >= 0 && !r.broken(a, p) && !inGap {
+				v, err = values[a], g-r.dumps[a]
+			}
+
+		case resampleLinear:
+			if a >= 0 && a == b {
+				v = values[a]
+			} else if a >= 0 && b < n && !r.broken(a, b) {
+				x := (g - r.dumps[a]) / (r.dumps[b] - r.dumps[a])
+				v = values[a] + x*(values[b]-values[a])
+				err = math.Min(g-r.dumps[a], r.dumps[b]-g)
+			}
+
+		case resampleNearest:
+			da, db := math.Inf(1), math.Inf(1)
+			if a >= 0 {
+				da = g - r.dumps[a]
+			}
+			if b < n {
+				db = r.dumps[b] - g
+			}
+			if da <= db && da <= r.tolerance {
+				v, err = values[a], da
+			} else if db < da && db <= r.tolerance {
+				v, err = values[b], db
+			}
+		}
+
+		if math.IsNaN(v) {
+			continue
+		}
+
+		out.set(j, v)
+		if align != nil {
+			align.add(err)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// expectColumn fails unless c holds the expected values
+// on the grid, NaN where none is expected.
+func expectColumn(t *testing.T, c *column, grid []float64, expected []float64) {
+
+	for j, v := range expected {
+		if got := c.at(j); !sameValue(got, v) {
+			t.Errorf("expected %v at %vs, got %v", v, grid[j], got)
+		}
+	}
+}
+
+func TestResampleLinear(t *testing.T) {
+
+	nan := math.NaN()
+
+	tests := []struct {
+		name     string
+		dumps    []float64
+		breaks   []bool
+		values   []float64
+		grid     []float64
+		expected []float64
+		points   int
+		sum      float64
+		max      float64
+	}{
+		{
+			name:     "between dumps",
+			dumps:    []float64{0, 10, 20},
+			values:   []float64{0, 10, 40},
+			grid:     []float64{0, 5, 10, 15, 20},
+			expected: []float64{0, 5, 10, 25, 40},
+			points:   5, sum: 10, max: 5,
+		},
+		{
+			name:     "across a missing value",
+			dumps:    []float64{0, 10, 20},
+			values:   []float64{0, nan, 40},
+			grid:     []float64{0, 5, 10, 15, 20},
+			expected: []float64{0, 10, 20, 30, 40},
+			points:   5, sum: 20, max: 10,
+		},
+		{
+			name:     "not across a gap",
+			dumps:    []float64{0, 10, 40, 50},
+			breaks:   []bool{false, false, true, false},
+			values:   []float64{0, 10, 40, 50},
+			grid:     []float64{0, 5, 10, 15, 25, 35, 40, 45, 50},
+			expected: []float64{0, 5, 10, nan, nan, nan, 40, 45, 50},
+			points:   6, sum: 10, max: 5,
+		},
+		{
+			name:     "not beyond the dumps",
+			dumps:    []float64{0, 10},
+			values:   []float64{0, 10},
+			grid:     []float64{-5, 0, 5, 10, 15},
+			expected: []float64{nan, 0, 5, 10, nan},
+			points:   3, sum: 5, max: 5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var align alignment
+			r := newResampler(test.dumps, test.grid, test.breaks, 5)
+			c := r.column(testColumn(test.values...), resampleLinear, &align)
+
+			expectColumn(t, c, test.grid, test.expected)
+
+			if align.points != test.points || align.sum != test.sum || align.max != test.max {
+				t.Errorf("expected %d points off by %vs in total and %vs at most, got %+v", test.points, test.sum, test.max, align)
+			}
+		})
+	}
+}
+
+func TestResampleNearest(t *testing.T) {
+
+	nan := math.NaN()
+
+	tests := []struct {
+		name      string
+		values    []float64
+		tolerance float64
+		grid      []float64
+		expected  []float64
+		points    int
+		sum       float64
+		max       float64
+	}{
+		{
+			name:      "within tolerance",
+			values:    []float64{1, 2, 3},
+			tolerance: 3,
+			grid:      []float64{-2, 0, 13, 18, 23},
+			expected:  []float64{1, 1, 2, 3, 3},
+			points:    5, sum: 10, max: 3,
+		},
+		{
+			name:      "beyond tolerance",
+			values:    []float64{1, 2, 3},
+			tolerance: 3,
+			grid:      []float64{-4, 4, 5, 6, 16, 24},
+			expected:  []float64{nan, nan, nan, nan, nan, nan},
+		},
+		{
+			name:      "ties taking the earlier dump",
+			values:    []float64{1, 2, 3},
+			tolerance: 5,
+			grid:      []float64{5, 15},
+			expected:  []float64{1, 2},
+			points:    2, sum: 10, max: 5,
+		},
+		{
+			name:      "skipping missing values",
+			values:    []float64{1, nan, 3},
+			tolerance: 10,
+			grid:      []float64{9, 10, 11},
+			expected:  []float64{1, 1, 3},
+			points:    3, sum: 28, max: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var align alignment
+			r := newResampler([]float64{0, 10, 20}, test.grid, nil, test.tolerance)
+			c := r.column(testColumn(test.values...), resampleNearest, &align)
+
+			expectColumn(t, c, test.grid, test.expected)
+
+			if align.points != test.points || align.sum != test.sum || align.max != test.max {
+				t.Errorf("expected %d points off by %vs in total and %vs at most, got %+v", test.points, test.sum, test.max, align)
+			}
+		})
+	}
+}
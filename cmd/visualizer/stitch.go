@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// source is an archive along with the worker it stems
+// from, the clock offsets it measured by reference and
+// its clock correction. Its dumps are read once, when
+// it is loaded, keeping what the series stitched from
+// them need to know.
+type source struct {
+	path      string
+	archive   *dump.Archive
+	worker    topology.Worker
+	hasWorker bool
+	clocks    map[string][]clockMeasurement
+	clock     *clockCorrection
+
+	// dumps holds what was read from every file of
+	// the archive by index, values the values of its
+	// users and host metrics until all series taking
+	// dumps from it, counted by readers, are read.
+	dumps   []sourceDump
+	values  *columns
+	readers int
+}
+
+// openSource opens the archive at path, its dumps
+// left to be read by readSource.
+func openSource(path string) (*source, error) {
+
+	a, err := openArchive(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	for _, file := range a.Files {
+		if _, err := dump.ParseName(file.Name); err != nil {
+			log.Printf("skipping %s in %s: not a dump", file.Name, path)
+		}
+	}
+
+	return &source{
+		path:    path,
+		archive: a,
+	}, nil
+}
+
+// series is the dumps of one cluster, taken from a single
+// archive or stitched together from all archives of a run.
+type series struct {
+	name      string
+	worker    topology.Worker
+	hasWorker bool
+	dumps     []seriesDump
+
+	// restarts holds the times of the first
+	// dumps after the dumper restarted.
+	restarts []float64
+
+	// started is the time the run started, or of
+	// the first dump if not recorded, to count
+	// relative bounds from.
+	started float64
+}
+
+// seriesDump is dump i of src at corrected time t.
+type seriesDump struct {
+	t   float64
+	src *source
+	i   int
+}
+
+// release drops the values of the sources of s
+// once no other series is left to read them.
+func (s *series) release() {
+
+	released := make(map[*source]bool)
+	for _, d := range s.dumps {
+		if !released[d.src] {
+			released[d.src] = true
+			if d.src.readers--; d.src.readers == 0 {
+				d.src.values = nil
+			}
+		}
+	}
+}
+
+// stitch groups the dumps of all sources into series by
+// worker and run, see dump.Stitch, with their timestamps
+// corrected by the clock offsets of their archives. A
+// worker with several runs gets one series per run.
+func stitch(sources []*source) ([]*series, error) {
+
+	archives := make([]*dump.Archive, len(sources))
+	workers := make([]string, len(sources))
+	recorded := make([][]*dump.Run, len(sources))
+	byArchive := make(map[*dump.Archive]*source)
+
+	for i, src := range sources {
+		archives[i] = src.archive
+		if src.hasWorker {
+			workers[i] = src.worker.Name
+		}
+		recorded[i] = make([]*dump.Run, len(src.dumps))
+		for j, d := range src.dumps {
+			recorded[i][j] = d.run
+		}
+		byArchive[src.archive] = src
+	}
+
+	stitched, err := dump.Stitch(archives, workers, recorded)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make(map[string]int)
+	for _, ds := range stitched {
+		if ds.Run != "" {
+			runs[ds.Worker]++
+		}
+	}
+
+	all := make([]*series, 0, len(stitched))
+	for _, ds := range stitched {
+
+		s := &series{
+			name: ds.Worker,
+		}
+
+		if runs[ds.Worker] > 1 {
+			s.name = fmt.Sprintf("%s (run %s)", ds.Worker, ds.Run)
+		}
+
+		var uncertainty float64
+
+		for _, d := range ds.Dumps {
+			src := byArchive[d.Archive]
+			if src.hasWorker && !s.hasWorker {
+				s.worker, s.hasWorker = src.worker, true
+			}
+
+			t := d.Time
+			if src.clock != nil {
+				var u float64
+				t, u = src.clock.correct(t)
+				uncertainty = math.Max(uncertainty, u)
+			}
+
+			if d.Restart {
+				s.restarts = append(s.restarts, t)
+			}
+
+			s.dumps = append(s.dumps, seriesDump{t, src, d.Index})
+		}
+
+		counted := make(map[*source]bool)
+		for _, d := range s.dumps {
+			if !counted[d.src] {
+				counted[d.src] = true
+				d.src.readers++
+			}
+		}
+
+		sort.SliceStable(s.dumps, func(i, j int) bool {
+			return s.dumps[i].t < s.dumps[j].t
+		})
+
+		if len(s.dumps) > 0 {
+			s.started = s.dumps[0].t
+		}
+
+		// Dumps are in time order, so the first
+		// one records the first start of the run.
+		if len(ds.Dumps) > 0 && ds.Dumps[0].Run != nil && !ds.Dumps[0].Run.Started.IsZero() {
+			d := ds.Dumps[0]
+			s.started = float64(d.Run.Started.UnixNano()) / float64(time.Second)
+			if src := byArchive[d.Archive]; src.clock != nil {
+				s.started, _ = src.clock.correct(s.started)
+			}
+		}
+
+		if uncertainty > 0 {
+			log.Printf("corrected timestamps of %s are uncertain by up to ±%.3fs", s.name, uncertainty)
+		}
+
+		if ds.Duplicates > 0 {
+			log.Printf("dropped %d dumps of %s found in several archives", ds.Duplicates, s.name)
+		}
+
+		if len(s.restarts) > 0 {
+			log.Printf("stitched %s across %d restarts", s.name, len(s.restarts))
+		}
+
+		all = append(all, s)
+	}
+
+	return all, nil
+}
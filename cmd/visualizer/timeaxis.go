@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// origin returns the time of the first dump of all clusters.
+func (d *Dataset) origin() float64 {
+
+	origin := math.Inf(1)
+	for _, dumps := range d.Dumps {
+		if len(dumps) > 0 {
+			origin = math.Min(origin, dumps[0])
+		}
+	}
+
+	return origin
+}
+
+// gaps decides where the lines of the clusters are broken
+// because dumps are missing.
+type gaps struct {
+	breaks map[string][]bool
+}
+
+// newGaps returns gaps breaking lines once two dumps are
+// further apart than gap or, if gap is zero, than twice the
+// interval expected: the shortest one recorded by adaptive
+// sampling at the preceding dump, or the median spacing of
+// the cluster's dumps otherwise.
+func newGaps(data *Dataset, gap float64) *gaps {
+
+	g := &gaps{
+		breaks: make(map[string][]bool),
+	}
+
+	for cluster, dumps := range data.Dumps {
+
+		if len(dumps) < 2 {
+			continue
+		}
+
+		spacings := make([]float64, 0, len(dumps)-1)
+		for i := 1; i < len(dumps); i++ {
+			spacings = append(spacings, dumps[i]-dumps[i-1])
+		}
+		sort.Float64s(spacings)
+		median := spacings[len(spacings)/2]
+
+		expected := make([]float64, len(dumps))
+		for i := range expected {
+			expected[i] = math.Inf(1)
+		}
+
+		if gap <= 0 {
+			for key, c := range data.Intervals {
+				if !strings.HasPrefix(key, cluster+"/") {
+					continue
+				}
+
+				c.spans(func(start int, end int, interval float64) {
+					for i := start; i < end; i++ {
+						expected[i] = math.Min(expected[i], interval)
+					}
+				})
+			}
+		}
+
+		breaks := make([]bool, len(dumps))
+		for i := 1; i < len(dumps); i++ {
+			spacing := dumps[i] - dumps[i-1]
+
+			if gap > 0 {
+				breaks[i] = spacing > gap
+				continue
+			}
+
+			e := expected[i-1]
+			if math.IsInf(e, 1) {
+				e = median
+			}
+
+			breaks[i] = e > 0 && spacing > 2*e
+		}
+
+		g.breaks[cluster] = breaks
+	}
+
+	return g
+}
+
+// before reports whether dumps are missing between the
+// i-th dump of cluster and the one preceding it.
+func (g *gaps) before(cluster string, i int) bool {
+
+	breaks := g.breaks[cluster]
+	if i <= 0 || i >= len(breaks) {
+		return false
+	}
+
+	return breaks[i]
+}
+
+// writeTimeList writes ts as python list for the x-axis
+// chosen in opts: seconds since origin or datetimes.
+func writeTimeList(w io.Writer, ts []float64, origin float64, opts Options) {
+
+	if opts.Axis == axisAbsolute {
+		io.WriteString(w, "[datetime.datetime.fromtimestamp(x) for x in ")
+		origin = 0
+	}
+
+	io.WriteString(w, "[")
+	for i, t := range ts {
+		if i > 0 {
+			io.WriteString(w, ", ")
+		}
+		io.WriteString(w, strconv.FormatFloat(t-origin, 'f', 3, 64))
+	}
+	io.WriteString(w, "]")
+
+	if opts.Axis == axisAbsolute {
+		io.WriteString(w, "]")
+	}
+}
+
+// writeValueList writes vals as python list,
+// formatted by format and None where missing.
+func writeValueList(w io.Writer, vals []float64, format byte) {
+
+	io.WriteString(w, "[")
+	for i, v := range vals {
+		if i > 0 {
+			io.WriteString(w, ", ")
+		}
+		if math.IsNaN(v) {
+			io.WriteString(w, "None")
+		} else {
+			io.WriteString(w, strconv.FormatFloat(v, format, -1, 64))
+		}
+	}
+	io.WriteString(w, "]")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-pluto/maildir_tools/dump"
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// workerOf determines the worker an archive stems from.
+// The label the dumper wrote into its dumps takes precedence,
+// completed by topo if given. Otherwise the worker of topo
+// the archive is named after, e.g. '<unix>-<worker>.zip',
+// is returned.
+func workerOf(label *dump.Worker, cluster string, topo *topology.Topology) (topology.Worker, bool) {
+
+	if label != nil {
+		if topo != nil {
+			if w, ok := topo.Worker(label.Name); ok {
+				return w, true
+			}
+		}
+
+		return label.Topology(), true
+	}
+
+	if topo == nil {
+		return topology.Worker{}, false
+	}
+
+	for _, w := range topo.Workers {
+		if cluster == w.Name || strings.HasSuffix(cluster, "-"+w.Name) {
+			return w, true
+		}
+	}
+
+	return topology.Worker{}, false
+}
+
+// groupIndices numbers all replica groups of the
+// known clusters in sorted order, to colour by.
+func groupIndices(data *Dataset) map[string]int {
+
+	var groups []string
+	seen := make(map[string]bool)
+
+	for _, w := range data.Clusters {
+		if !seen[w.Group] {
+			seen[w.Group] = true
+			groups = append(groups, w.Group)
+		}
+	}
+
+	sort.Strings(groups)
+
+	indices := make(map[string]int)
+	for i, group := range groups {
+		indices[group] = i
+	}
+
+	return indices
+}
+
+// clusterIndices numbers all clusters outside of the topology
+// in sorted order, to colour by in place of a replica group.
+// Numbering continues after groups, so that clusters and
+// groups never share a colour.
+func clusterIndices(data *Dataset, groups map[string]int) map[string]int {
+
+	var clusters []string
+	for _, cluster := range data.Names {
+		if _, ok := data.Clusters[cluster]; !ok {
+			clusters = append(clusters, cluster)
+		}
+	}
+
+	sort.Strings(clusters)
+
+	indices := make(map[string]int)
+	for i, cluster := range clusters {
+		indices[cluster] = len(groups) + i
+	}
+
+	return indices
+}
+
+// colour returns the i-th of n distinct matplotlib colours:
+// those of the default cycle for up to ten, evenly spaced
+// hues beyond.
+func colour(i int, n int) string {
+
+	if n <= 10 {
+		return fmt.Sprintf("'C%d'", i)
+	}
+
+	return fmt.Sprintf("plot.cm.hsv(%.3f)", float64(i)/float64(n))
+}
+
+// seriesStyle returns the matplotlib keyword arguments for the
+// series of key: one colour per replica group, a thick solid
+// line for the primary as reference of its group, dashed lines
+// for replicas and dotted ones for storage nodes. Clusters
+// outside of the topology get one colour each.
+func seriesStyle(data *Dataset, groups map[string]int, clusters map[string]int, key string) string {
+
+	cluster := strings.SplitN(key, "/", 2)[0]
+
+	style := fmt.Sprintf(", color=%s", clusterColour(data, groups, clusters, cluster))
+
+	w, ok := data.Clusters[cluster]
+	if !ok {
+		return style
+	}
+
+	switch w.Role {
+	case topology.RolePrimary:
+		style += ", linestyle='-', linewidth=2"
+	case topology.RoleReplica:
+		style += ", linestyle='--'"
+	case topology.RoleStorage:
+		style += ", linestyle=':'"
+	}
+
+	return style
+}
+
+// clusterColour returns the colour of the replica group
+// of cluster, or its own one if outside of the topology.
+func clusterColour(data *Dataset, groups map[string]int, clusters map[string]int, cluster string) string {
+
+	n := len(groups) + len(clusters)
+
+	if w, ok := data.Clusters[cluster]; ok {
+		return colour(groups[w.Group], n)
+	}
+
+	return colour(clusters[cluster], n)
+}
+
+// legendWriter adds a legend entry per replica group
+// and per cluster outside of the topology.
+func legendWriter(w io.Writer, groups map[string]int, clusters map[string]int) {
+
+	if len(groups) == 0 && len(clusters) == 0 {
+		return
+	}
+
+	n := len(groups) + len(clusters)
+
+	entries := func(indices map[string]int, prefix string) {
+
+		names := make([]string, 0, len(indices))
+		for name := range indices {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return indices[names[i]] < indices[names[j]]
+		})
+
+		for _, name := range names {
+			fmt.Fprintf(w, "plot.plot([], [], color=%s, label=%s)\n", colour(indices[name], n), strconv.Quote(prefix+name))
+		}
+	}
+
+	entries(groups, "group ")
+	entries(clusters, "")
+
+	fmt.Fprintf(w, "plot.legend(loc='upper left')\n")
+}
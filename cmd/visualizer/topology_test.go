@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+func TestClusterColours(t *testing.T) {
+
+	data := NewDataset()
+	data.Names = []string{"w1", "w2", "w3", "other-a", "other-b"}
+	data.Clusters["w1"] = topology.Worker{Name: "w1", Group: "g1", Role: topology.RolePrimary}
+	data.Clusters["w2"] = topology.Worker{Name: "w2", Group: "g1", Role: topology.RoleReplica}
+	data.Clusters["w3"] = topology.Worker{Name: "w3", Group: "g2", Role: topology.RolePrimary}
+
+	groups := groupIndices(data)
+	clusters := clusterIndices(data, groups)
+
+	// Replicas share the colour of their group, every other
+	// group and cluster outside of the topology has its own.
+	byColour := make(map[string][]string)
+	for _, cluster := range data.Names {
+		c := clusterColour(data, groups, clusters, cluster)
+		byColour[c] = append(byColour[c], cluster)
+	}
+
+	if len(byColour) != 4 {
+		t.Errorf("expected 4 colours, got %v", byColour)
+	}
+	if clusterColour(data, groups, clusters, "w1") != clusterColour(data, groups, clusters, "w2") {
+		t.Error("expected w1 and w2 to share the colour of group g1")
+	}
+
+	var legend bytes.Buffer
+	legendWriter(&legend, groups, clusters)
+
+	if n := strings.Count(legend.String(), "label="); n != 4 {
+		t.Errorf("expected 4 legend entries, got %d:\n%s", n, legend.String())
+	}
+	for colour, clusters := range byColour {
+		if !strings.Contains(legend.String(), "color="+colour+",") {
+			t.Errorf("colour %s of %v missing from legend:\n%s", colour, clusters, legend.String())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// UserKeys extracts the key identifying a user from the
+// Maildir paths in dumps and maps the keys of clusters
+// storing the same user differently onto one another.
+type UserKeys struct {
+	prefix  string
+	pattern *regexp.Regexp
+	mapping map[string]map[string]string
+}
+
+// NewUserKeys returns UserKeys stripping prefix from paths or,
+// if pattern is given, taking the group named 'user', the first
+// group or the whole match of pattern. Without either the last
+// path element is the key. mapFile optionally names a JSON file
+// mapping per cluster, or '*' for all, keys to the logical user:
+//
+//	{"*": {"user1@example.com": "alice"}, "worker-3": {"u1": "alice"}}
+func NewUserKeys(prefix string, pattern string, mapFile string) (*UserKeys, error) {
+
+	u := &UserKeys{
+		prefix: prefix,
+	}
+
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user pattern: %v", err)
+		}
+		u.pattern = re
+	}
+
+	if mapFile != "" {
+
+		f, err := os.Open(mapFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := json.NewDecoder(f).Decode(&u.mapping); err != nil {
+			return nil, fmt.Errorf("failed to parse user mapping %s: %v", mapFile, err)
+		}
+	}
+
+	return u, nil
+}
+
+// Key returns the logical user the Maildir at p of cluster
+// belongs to, or false if p does not match the pattern.
+func (u *UserKeys) Key(cluster string, p string) (string, bool) {
+
+	if u == nil {
+		return path.Base(p), true
+	}
+
+	var key string
+
+	switch {
+	case u.pattern != nil:
+		m := u.pattern.FindStringSubmatch(p)
+		if m == nil {
+			return "", false
+		}
+
+		key = m[0]
+		if len(m) > 1 {
+			key = m[1]
+		}
+		for i, name := range u.pattern.SubexpNames() {
+			if name == "user" {
+				key = m[i]
+			}
+		}
+
+	case u.prefix != "":
+		if !strings.HasPrefix(p, u.prefix) {
+			return "", false
+		}
+		key = strings.TrimPrefix(p, u.prefix)
+
+	default:
+		key = path.Base(p)
+	}
+
+	if logical, ok := u.mapping[cluster][key]; ok {
+		return logical, true
+	}
+
+	if logical, ok := u.mapping["*"][key]; ok {
+		return logical, true
+	}
+
+	return key, true
+}
@@ -3,30 +3,32 @@ package main
 import (
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"strings"
 )
 
-func matplotlibWriter(w io.Writer, results map[string]map[string]int) error {
-	if len(results) == 0 {
+// matplotlibWriter plots one line per user over the dumps
+// of its cluster. Lines are broken where dumps are missing
+// or the user is missing from a dump, while dumps at which
+// a user failed to be sampled are marked with a red cross
+// at the last size known before the error. Users sampled
+// adaptively are only expected to have data once the
+// interval recorded with their previous sample passed.
+// Restarts of a cluster's dumper are marked by vertical
+// lines in its colour.
+func matplotlibWriter(w io.Writer, data *Dataset, opts Options) error {
+	if len(data.Sizes) == 0 {
 		return nil
 	}
 
-	var times []string
-	for timestamp := range results {
-		times = append(times, timestamp)
-	}
-
-	sort.Slice(times, func(i, j int) bool {
-		return times[i] < times[j]
-	})
-
 	// Deduplicate users
 	usersMap := make(map[string]bool)
-	for _, val := range results {
-		for user := range val {
-			usersMap[user] = true
-		}
+	for user := range data.Sizes {
+		usersMap[user] = true
+	}
+	for user := range data.Errors {
+		usersMap[user] = true
 	}
 
 	var users []string
@@ -34,25 +36,93 @@ func matplotlibWriter(w io.Writer, results map[string]map[string]int) error {
 		users = append(users, user)
 	}
 
+	// Keep the lines of each replica group together.
+	groups := groupIndices(data)
+	clusters := clusterIndices(data, groups)
+	group := func(user string) int {
+		if w, ok := data.Clusters[strings.SplitN(user, "/", 2)[0]]; ok {
+			return groups[w.Group]
+		}
+		return -1
+	}
+
 	sort.Slice(users, func(i, j int) bool {
+		if gi, gj := group(users[i]), group(users[j]); gi != gj {
+			return gi < gj
+		}
 		return users[i] < users[j]
 	})
 
-	fmt.Fprintf(w, "t = [%s]\n", strings.Join(times, ", "))
+	origin := data.origin()
+	gaps := newGaps(data, opts.Gap)
 
 	for i, user := range users {
-		var vals []string
-		for _, time := range times {
-			if val, ok := results[time][user]; ok {
-				vals = append(vals, fmt.Sprintf("%d", val))
+		cluster := strings.SplitN(user, "/", 2)[0]
+		dumps := data.Dumps[cluster]
+
+		sizes, errors, intervals := data.Sizes[user], data.Errors[user], data.Intervals[user]
+
+		var ts, vals, errs []float64
+		last, failed := 0.0, false
+		var due float64
+		for j, t := range dumps {
+			val := sizes.at(j)
+			ok := !math.IsNaN(val)
+			_, isErr := errors[j]
+
+			// Allow for rounding of corrected timestamps.
+			if !ok && !isErr && t < due-0.001 {
+				continue
+			}
+
+			if len(ts) > 0 && gaps.before(cluster, j) {
+				ts = append(ts, (dumps[j-1]+t)/2)
+				vals = append(vals, math.NaN())
+				errs = append(errs, math.NaN())
+			}
+
+			ts = append(ts, t)
+			vals = append(vals, val)
+
+			if ok {
+				last = val
+			}
+
+			if isErr {
+				errs = append(errs, last)
+				failed = true
 			} else {
-				vals = append(vals, "None")
+				errs = append(errs, math.NaN())
 			}
+
+			due = 0
+			if interval := intervals.at(j); !math.IsNaN(interval) {
+				due = t + interval
+			}
+		}
+
+		fmt.Fprintf(w, "t%d = ", i)
+		writeTimeList(w, ts, origin, opts)
+		fmt.Fprintf(w, "\ns%d = ", i)
+		writeValueList(w, vals, 'f')
+		fmt.Fprintf(w, "\nplot.plot(t%d, s%d%s)\n", i, i, seriesStyle(data, groups, clusters, user))
+
+		if failed {
+			fmt.Fprintf(w, "e%d = ", i)
+			writeValueList(w, errs, 'f')
+			fmt.Fprintf(w, "\nplot.plot(t%d, e%d, 'rx')\n", i, i)
 		}
+	}
 
-		fmt.Fprintf(w, "s%d = [%s]\n", i, strings.Join(vals, ", "))
-		fmt.Fprintf(w, "plot.plot(t, s%d)\n", i)
+	// Mark where dumpers restarted within a run.
+	for _, cluster := range data.Names {
+		for _, t := range data.Restarts[cluster] {
+			io.WriteString(w, "plot.axvline(")
+			writeTimeList(w, []float64{t}, origin, opts)
+			fmt.Fprintf(w, "[0], color=%s, linestyle='-.', linewidth=0.8)\n", clusterColour(data, groups, clusters, cluster))
+		}
 	}
+	legendWriter(w, groups, clusters)
 
 	return nil
 }
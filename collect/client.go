@@ -0,0 +1,356 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatch limits the number of dumps sent at once.
+const maxBatch = 100
+
+// flushTimeout bounds the time spent on shutdown
+// waiting for buffered dumps to be acknowledged.
+const flushTimeout = 10 * time.Second
+
+// Client streams the dumps of one run of a worker
+// to a collector. Dumps are buffered until the
+// collector acknowledged them, so that reconnects
+// lose nothing unless the buffer overflows, in which
+// case the oldest dumps are dropped. Dumps and batches
+// the collector refuses to store are dropped as well.
+type Client struct {
+	logger log.Logger
+	addr   string
+	worker string
+	run    string
+	size   int
+
+	mu      sync.Mutex
+	notify  chan struct{}
+	pending []Dump
+	sent    int
+	seq     uint64
+	dropped uint64
+
+	// batches holds the last Seq of every batch
+	// sent but not acknowledged, oldest first.
+	batches  []uint64
+	rejected uint64
+}
+
+// NewClient returns a Client buffering at most
+// size dumps for the collector at addr.
+func NewClient(logger log.Logger, addr string, worker string, run string, size int) *Client {
+	return &Client{
+		logger: logger,
+		addr:   addr,
+		worker: worker,
+		run:    run,
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Push queues a dump for sending without blocking.
+func (c *Client) Push(name string, data []byte) {
+
+	c.mu.Lock()
+
+	c.seq++
+	c.pending = append(c.pending, Dump{
+		Seq:  c.seq,
+		Name: name,
+		Data: data,
+	})
+
+	if len(c.pending) > c.size {
+		c.pending = c.pending[1:]
+		c.dropped++
+		if c.sent > 0 {
+			c.sent--
+		}
+	}
+
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of unacknowledged dumps.
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+// Dropped returns the number of dumps
+// lost due to a full buffer.
+func (c *Client) Dropped() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.dropped
+}
+
+// Rejected returns the number of dumps dropped
+// because the collector refused to store them.
+func (c *Client) Rejected() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rejected
+}
+
+// Run keeps a stream to the collector open until
+// ctx is done, reconnecting with exponential backoff.
+// Dumps still buffered then are flushed for at most
+// flushTimeout before Run returns.
+func (c *Client) Run(ctx context.Context) error {
+
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		start := time.Now()
+
+		err := c.session(ctx.Done())
+		if err == nil {
+			return nil
+		}
+
+		if isRejected(err) {
+			level.Error(c.logger).Log(
+				"msg", "collector rejected dumps, dropping them",
+				"addr", c.addr,
+				"dumps", c.reject(),
+				"err", err,
+			)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Only back off further if the previous
+		// session did not last for a while.
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+
+		level.Warn(c.logger).Log(
+			"msg", "lost connection to collector",
+			"addr", c.addr,
+			"retry", backoff,
+			"err", err,
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+
+	// Give the collector one last chance to
+	// store what was buffered while away.
+	if c.Pending() > 0 {
+		done := make(chan struct{})
+		close(done)
+
+		if err := c.session(done); err != nil {
+			level.Warn(c.logger).Log(
+				"msg", "failed to flush dumps to collector",
+				"addr", c.addr,
+				"pending", c.Pending(),
+				"err", err,
+			)
+		}
+	}
+
+	return nil
+}
+
+// isRejected reports whether the collector refused
+// a batch for good, e.g. because of an invalid name.
+func isRejected(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.InvalidArgument
+}
+
+// session sends all buffered dumps over a new stream
+// until it breaks. Once done is closed, the buffer is
+// flushed and session returns nil when all dumps are
+// acknowledged, or an error after flushTimeout.
+func (c *Client) session(done <-chan struct{}) error {
+
+	// The stream outlives done to flush the buffer.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dialCancel()
+
+	conn, err := grpc.DialContext(dialCtx, c.addr,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithCodec(Codec{}),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := Push(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	level.Info(c.logger).Log("msg", "connected to collector", "addr", c.addr)
+
+	// Everything not yet acknowledged
+	// is sent again on a new stream.
+	c.mu.Lock()
+	c.sent = 0
+	c.batches = nil
+	c.mu.Unlock()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if n := c.acknowledge(ack); n > 0 {
+				level.Error(c.logger).Log(
+					"msg", "collector rejected dumps, dropping them",
+					"addr", c.addr,
+					"dumps", n,
+				)
+			}
+		}
+	}()
+
+	var flushed <-chan time.Time
+
+	for {
+		c.mu.Lock()
+		end := len(c.pending)
+		if end-c.sent > maxBatch {
+			end = c.sent + maxBatch
+		}
+		dumps := append([]Dump(nil), c.pending[c.sent:end]...)
+		c.sent = end
+		if len(dumps) > 0 {
+			c.batches = append(c.batches, dumps[len(dumps)-1].Seq)
+		}
+		pending := len(c.pending)
+		c.mu.Unlock()
+
+		if len(dumps) > 0 {
+			err := stream.Send(&Batch{
+				Worker: c.worker,
+				Run:    c.run,
+				Dumps:  dumps,
+			})
+			if err != nil {
+				// The reason the stream broke
+				// for is reported by Recv.
+				return <-errs
+			}
+			continue
+		}
+
+		if flushed != nil && pending == 0 {
+			stream.CloseSend()
+			return nil
+		}
+
+		select {
+		case <-c.notify:
+		case err := <-errs:
+			return err
+		case <-done:
+			done = nil
+			flushed = time.After(flushTimeout)
+		case <-flushed:
+			return fmt.Errorf("timed out flushing %d dumps", c.Pending())
+		}
+	}
+}
+
+// acknowledge drops all dumps up to ack.Seq from the
+// buffer and returns the number of those rejected.
+func (c *Client) acknowledge(ack *Ack) int {
+
+	seq := ack.Seq
+
+	c.mu.Lock()
+
+	n := 0
+	for n < len(c.pending) && c.pending[n].Seq <= seq {
+		n++
+	}
+
+	c.pending = c.pending[n:]
+
+	if c.sent -= n; c.sent < 0 {
+		c.sent = 0
+	}
+
+	for len(c.batches) > 0 && c.batches[0] <= seq {
+		c.batches = c.batches[1:]
+	}
+
+	c.rejected += uint64(len(ack.Rejected))
+
+	c.mu.Unlock()
+
+	// Wake up a session waiting for
+	// the buffer to be flushed.
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return len(ack.Rejected)
+}
+
+// reject drops the oldest batch not yet acknowledged,
+// which the collector refused, and returns its size.
+func (c *Client) reject() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.batches) == 0 {
+		return 0
+	}
+
+	n := 0
+	for n < len(c.pending) && c.pending[n].Seq <= c.batches[0] {
+		n++
+	}
+
+	c.pending = c.pending[n:]
+	c.batches = c.batches[1:]
+	c.rejected += uint64(n)
+
+	return n
+}
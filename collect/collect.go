@@ -0,0 +1,164 @@
+// Package collect implements the gRPC service dumpers
+// stream their dumps to a central collector with.
+//
+// As no protobuf definitions are involved, messages are
+// plain Go structs encoded as JSON by Codec, and the
+// service description is written by hand.
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+
+	"google.golang.org/grpc"
+)
+
+// validName matches what is safe to use as a path element.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_@.-]+$`)
+
+// ValidName reports whether name is acceptable to the
+// collector as worker name, run ID or dump name. Only
+// letters, digits and '_@.-' are allowed, and names must
+// not start with a dot.
+func ValidName(name string) bool {
+	return validName.MatchString(name) && name[0] != '.'
+}
+
+// Dump is a single dump in the format
+// written by the dumper to disk.
+type Dump struct {
+	// Seq numbers all dumps of one client in
+	// ascending order for acknowledgements.
+	Seq uint64 `json:"seq"`
+
+	// Name is the file name of the dump,
+	// i.e. the time it was taken at.
+	Name string `json:"name"`
+
+	// Data holds the contents of the dump.
+	Data []byte `json:"data"`
+}
+
+// Batch carries dumps of one run of a worker.
+type Batch struct {
+	Worker string `json:"worker"`
+	Run    string `json:"run"`
+	Dumps  []Dump `json:"dumps"`
+}
+
+// Ack confirms that all dumps up to Seq have been
+// stored but those listed in Rejected, which the
+// collector refused to store, e.g. for their name.
+type Ack struct {
+	Seq      uint64   `json:"seq"`
+	Rejected []uint64 `json:"rejected,omitempty"`
+}
+
+// Codec encodes messages as JSON.
+type Codec struct{}
+
+// Marshal implements grpc.Codec.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements grpc.Codec.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// String implements grpc.Codec.
+func (Codec) String() string {
+	return "json"
+}
+
+// CollectorServer is implemented by collectors.
+type CollectorServer interface {
+	Push(Collector_PushServer) error
+}
+
+// Collector_PushServer is the server side of a
+// stream of batches answered by acknowledgements.
+type Collector_PushServer interface {
+	Send(*Ack) error
+	Recv() (*Batch, error)
+	grpc.ServerStream
+}
+
+type collectorPushServer struct {
+	grpc.ServerStream
+}
+
+func (x *collectorPushServer) Send(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *collectorPushServer) Recv() (*Batch, error) {
+	m := new(Batch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func pushHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CollectorServer).Push(&collectorPushServer{stream})
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "collect.Collector",
+	HandlerType: (*CollectorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       pushHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "collect",
+}
+
+// RegisterCollectorServer registers srv with s. The
+// server has to be created with grpc.CustomCodec(Codec{}).
+func RegisterCollectorServer(s *grpc.Server, srv CollectorServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// Collector_PushClient is the client side of a
+// stream of batches answered by acknowledgements.
+type Collector_PushClient interface {
+	Send(*Batch) error
+	Recv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type collectorPushClient struct {
+	grpc.ClientStream
+}
+
+func (x *collectorPushClient) Send(m *Batch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *collectorPushClient) Recv() (*Ack, error) {
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Push opens a stream of batches on conn, which has
+// to be dialed with grpc.WithCodec(Codec{}).
+func Push(ctx context.Context, conn *grpc.ClientConn) (Collector_PushClient, error) {
+
+	stream, err := grpc.NewClientStream(ctx, &serviceDesc.Streams[0], conn, "/collect.Collector/Push")
+	if err != nil {
+		return nil, err
+	}
+
+	return &collectorPushClient{stream}, nil
+}
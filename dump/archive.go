@@ -0,0 +1,495 @@
+package dump
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Archive is a set of dumps read from one source: a zip,
+// tar, gzipped or zstd-compressed tar file or a directory.
+type Archive struct {
+	// Name is the base name of the source without
+	// extensions, e.g. '<unix>-<worker>'.
+	Name  string
+	Files []File
+
+	// closer frees the temporary file
+	// the archive was spooled to, if any.
+	closer io.Closer
+}
+
+// File is a single file of an archive.
+type File struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// ReadDump reads f as dump.
+func (f File) ReadDump() (*Dump, error) {
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ReadDump(f.Name, r)
+}
+
+// Magic numbers of the supported compressed formats.
+var (
+	magicZip  = []byte("PK\x03\x04")
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// archiveExtensions are stripped from archive names, longest first.
+var archiveExtensions = []string{".tar.gz", ".tar.zst", ".tgz", ".tzst", ".tar", ".zip"}
+
+// ArchiveName returns the base name of the
+// archive at p without extensions.
+func ArchiveName(p string) string {
+
+	name := path.Base(filepath.ToSlash(p))
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+
+	return name
+}
+
+// ArchiveWorker returns the worker and upload time
+// of an archive named '<unix>-<worker>', or false
+// if it is not named that way.
+func ArchiveWorker(name string) (string, time.Time, bool) {
+
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return parts[1], time.Unix(secs, 0), true
+}
+
+// ReadDir reads all regular files of the dump directory dir,
+// leaving out hidden ones such as the dumper's run ID.
+func ReadDir(dir string) (*Archive, error) {
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		Name: ArchiveName(dir),
+	}
+
+	for _, info := range infos {
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		p := filepath.Join(dir, info.Name())
+		a.Files = append(a.Files, File{
+			Name: info.Name(),
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(p)
+			},
+		})
+	}
+
+	return a, nil
+}
+
+// ReadArchive indexes the zip or (compressed) tar archive
+// data called name, detecting the format by its magic.
+// Compressed tars are decompressed into a temporary file,
+// which needs the zstd command for zstd.
+func ReadArchive(name string, data []byte) (*Archive, error) {
+
+	open := func() (readerAt, error) {
+		return nopCloser{bytes.NewReader(data)}, nil
+	}
+
+	return indexArchive(name, open, int64(len(data)))
+}
+
+// OpenArchive indexes the archive file at p like
+// ReadArchive without reading any dump. Dumps are
+// read from the file on demand, so it has to stay.
+func OpenArchive(name string, p string) (*Archive, error) {
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func() (readerAt, error) {
+		return os.Open(p)
+	}
+
+	return indexArchive(name, open, info.Size())
+}
+
+// SpoolArchive copies the archive read from r into a
+// temporary file and indexes it like OpenArchive. The
+// file is deleted right away and its space freed once
+// the archive is closed.
+func SpoolArchive(name string, r io.Reader) (*Archive, error) {
+
+	f, size, err := spool(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := indexArchive(name, shared(f), size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Compressed tars were spooled once more.
+	if a.closer != nil {
+		f.Close()
+	} else {
+		a.closer = f
+	}
+
+	return a, nil
+}
+
+// Close frees the temporary file of an archive
+// if it has one. Its dumps cannot be read anymore.
+func (a *Archive) Close() error {
+
+	if a.closer == nil {
+		return nil
+	}
+
+	return a.closer.Close()
+}
+
+// readerAt is a file an archive is read from.
+type readerAt interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// opener opens the file an archive resides in,
+// once for indexing and once for every dump read.
+type opener func() (readerAt, error)
+
+// nopCloser is a readerAt kept open by its owner.
+type nopCloser struct {
+	io.ReaderAt
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// shared returns an opener of f, which stays open.
+func shared(f *os.File) opener {
+	return func() (readerAt, error) {
+		return nopCloser{f}, nil
+	}
+}
+
+// readCloser reads a dump and closes the file it is read from.
+type readCloser struct {
+	io.Reader
+	file io.Closer
+}
+
+func (r readCloser) Close() error {
+	return r.file.Close()
+}
+
+// spool writes the output of fill into a temporary file that
+// is deleted right away, returning it along with its size.
+func spool(fill func(w io.Writer) error) (*os.File, int64, error) {
+
+	f, err := ioutil.TempFile("", "dump-archive-")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	if err := fill(w); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, size, nil
+}
+
+// indexArchive lists the dumps of the archive of size bytes
+// opened by open, detecting the format by its magic.
+func indexArchive(name string, open opener, size int64) (*Archive, error) {
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(magicZip))
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	var decompress func(w io.Writer) error
+
+	switch {
+	case bytes.HasPrefix(magic, magicZip) || size == 0:
+		return indexZip(name, f, open, size)
+
+	case bytes.HasPrefix(magic, magicGzip):
+		decompress = func(w io.Writer) error {
+			gr, err := gzip.NewReader(io.NewSectionReader(f, 0, size))
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+
+			_, err = io.Copy(w, gr)
+			return err
+		}
+
+	case bytes.HasPrefix(magic, magicZstd):
+		// No zstd decoder is vendored, so use the command.
+		decompress = func(w io.Writer) error {
+			cmd := exec.Command("zstd", "-dc")
+			cmd.Stdin = io.NewSectionReader(f, 0, size)
+			cmd.Stdout = w
+
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("failed to decompress %s via zstd: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+			}
+			return nil
+		}
+
+	default:
+		return indexTar(name, f, open, size)
+	}
+
+	tmp, size, err := spool(decompress)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := indexTar(name, tmp, shared(tmp), size)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	a.closer = tmp
+
+	return a, nil
+}
+
+// indexZip lists the files of the zip archive f. Dumps
+// are read by their offset, so f is not kept open.
+func indexZip(name string, f io.ReaderAt, open opener, size int64) (*Archive, error) {
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip: %v", err)
+	}
+
+	a := &Archive{
+		Name: name,
+	}
+
+	for _, file := range zr.File {
+
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		if file.Method != zip.Store && file.Method != zip.Deflate {
+			return nil, fmt.Errorf("unsupported compression method %d of %s", file.Method, file.Name)
+		}
+
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zip: %v", err)
+		}
+
+		compressed := int64(file.CompressedSize64)
+		deflated := file.Method == zip.Deflate
+
+		a.Files = append(a.Files, File{
+			Name: path.Base(file.Name),
+			Open: func() (io.ReadCloser, error) {
+
+				r, err := open()
+				if err != nil {
+					return nil, err
+				}
+
+				var data io.Reader = io.NewSectionReader(r, offset, compressed)
+				if deflated {
+					data = flate.NewReader(data)
+				}
+
+				return readCloser{data, r}, nil
+			},
+		})
+	}
+
+	return a, nil
+}
+
+// indexTar lists the regular files of the tar archive f.
+// Dumps are read by their offset, so f is not kept open.
+func indexTar(name string, f io.ReaderAt, open opener, size int64) (*Archive, error) {
+
+	a := &Archive{
+		Name: name,
+	}
+
+	// Members are skipped by seeking, so the
+	// position is where their content starts.
+	sr := io.NewSectionReader(f, 0, size)
+	tr := tar.NewReader(sr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s as zip or tar: %v", name, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		length := hdr.Size
+
+		a.Files = append(a.Files, File{
+			Name: path.Base(hdr.Name),
+			Open: func() (io.ReadCloser, error) {
+
+				r, err := open()
+				if err != nil {
+					return nil, err
+				}
+
+				return readCloser{io.NewSectionReader(r, offset, length), r}, nil
+			},
+		})
+	}
+
+	return a, nil
+}
+
+// ArchiveWriter writes dumps into a zip archive.
+type ArchiveWriter struct {
+	zw *zip.Writer
+}
+
+// NewArchiveWriter returns an ArchiveWriter writing to w.
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	return &ArchiveWriter{
+		zw: zip.NewWriter(w),
+	}
+}
+
+// Add adds the dump called name with
+// modification time modified and data.
+func (aw *ArchiveWriter) Add(name string, modified time.Time, data io.Reader) error {
+
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	header.SetModTime(modified)
+
+	w, err := aw.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, data)
+
+	return err
+}
+
+// AddDir adds all regular files of the dump directory dir,
+// leaving out hidden ones such as the dumper's run ID.
+func (aw *ArchiveWriter) AddDir(dir string) error {
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = aw.Add(info.Name(), info.ModTime(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close finishes the archive.
+func (aw *ArchiveWriter) Close() error {
+	return aw.zw.Close()
+}
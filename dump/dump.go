@@ -0,0 +1,263 @@
+// Package dump reads and writes the dumps the dumper takes
+// of Maildir sizes and the archives they are collected in.
+//
+// A dump is a text file named after the time it was taken
+// at, holding one tab-separated record per line. Successful
+// samples keep the 'du -s' format, all other records start
+// with their kind:
+//
+//	version	2
+//	run	<id>	<started unix>
+//	worker	<name>	<role>	<group>
+//	phase	<name>
+//	<size>	<path>
+//	error	<path>	<message>
+//	imap	<path>	<mailbox>	<messages>	<uidnext>	<uidvalidity>	<unseen>
+//	imap_error	<path>	<message>
+//	field	<path>	<probe>.<field>	<value>
+//	probe_error	<path>	<probe>	<message>
+//	interval	<path>	<seconds>
+//	host	<metric>	<value>
+//	clock	<ref>	<offset seconds>	<rtt seconds>
+//	canary	<id>	<sent unix>	<latency seconds>
+//
+// Dumps without version line are version 0, which holds
+// every kind of record but the run and phase lines added
+// by version 1 and 2. Writers can be asked for an older
+// version to serve readers that predate a newer one,
+// leaving out the lines that version does not know, and
+// readers refuse versions newer than they know.
+package dump
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-pluto/maildir_tools/topology"
+)
+
+// Version is the newest format version
+// this package reads and writes.
+const Version = 2
+
+// VersionError is returned for dumps of a format
+// version newer than this package knows.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported dump format version %d, newest known is %d", e.Version, Version)
+}
+
+// Dump is the content of a single dump.
+type Dump struct {
+	// Name is the file name of the dump.
+	Name string
+
+	// Version is the format version it was written in.
+	Version int
+
+	// Run is nil if the dump does not record its run,
+	// Worker nil if the dumper was not given its place
+	// in the topology.
+	Run    *Run
+	Worker *Worker
+
+	// Phase names the phase of the benchmark
+	// the dump was taken in, if marked.
+	Phase string
+
+	Samples  []Sample
+	Host     []HostMetric
+	Clock    []Clock
+	Canaries []Canary
+
+	// Unknown holds lines of kinds this package does
+	// not know, e.g. added within the same version.
+	Unknown []string
+}
+
+// Record is a single line of a dump: one of
+// *Run, *Worker, *Phase, *Size, *Error, *Mailbox,
+// *IMAPError, *Field, *ProbeError, *Interval,
+// *HostMetric, *Clock, *Canary and *Unknown.
+type Record interface {
+	record()
+}
+
+// Run is the run a dump belongs to and the start of the
+// dumper process that took it, which tells restarts apart.
+type Run struct {
+	ID      string
+	Started time.Time
+}
+
+// Worker is the place of the dumper in the topology.
+type Worker struct {
+	Name  string
+	Role  string
+	Group string
+}
+
+// Phase is the phase of the benchmark, e.g. 'warmup',
+// marked at the dumper when the dump was taken.
+type Phase struct {
+	Name string
+}
+
+// Size is the disk usage of a Maildir as reported
+// by 'du -s', in blocks of 1K.
+type Size struct {
+	Path   string
+	Blocks int64
+}
+
+// Error is a failed sample of a Maildir.
+type Error struct {
+	Path    string
+	Message string
+}
+
+// MailboxStatus is the logical state of one mailbox
+// of a user as reported by IMAP STATUS.
+type MailboxStatus struct {
+	Mailbox     string `json:"mailbox"`
+	Messages    uint32 `json:"messages"`
+	UIDNext     uint32 `json:"uidNext"`
+	UIDValidity uint32 `json:"uidValidity"`
+	Unseen      uint32 `json:"unseen"`
+}
+
+// Mailbox is the status of one mailbox of a Maildir.
+type Mailbox struct {
+	Path string
+	MailboxStatus
+}
+
+// IMAPError is a failed IMAP probe of a Maildir.
+type IMAPError struct {
+	Path    string
+	Message string
+}
+
+// Field is one value a probe measured of a Maildir,
+// named '<probe>.<field>'.
+type Field struct {
+	Path  string
+	Name  string
+	Value float64
+}
+
+// ProbeError is a failed probe of a Maildir.
+type ProbeError struct {
+	Path    string
+	Probe   string
+	Message string
+}
+
+// Interval is the interval a Maildir
+// is sampled at in adaptive mode.
+type Interval struct {
+	Path     string
+	Interval time.Duration
+}
+
+// HostMetric is a single resource metric of the host,
+// e.g. 'cpu.iowait' or 'disk.sda.write_bytes'.
+type HostMetric struct {
+	Name  string
+	Value float64
+}
+
+// Clock is the offset of the dumper's clock
+// against a reference clock.
+type Clock struct {
+	Ref    string
+	Offset time.Duration
+	RTT    time.Duration
+}
+
+// Canary is a canary message seen in a
+// Maildir along with its end-to-end latency.
+type Canary struct {
+	ID      string
+	Sent    time.Time
+	Latency time.Duration
+}
+
+// Unknown is a line of a kind this package does not know.
+type Unknown struct {
+	Line string
+}
+
+func (*Run) record()        {}
+func (*Worker) record()     {}
+func (*Phase) record()      {}
+func (*Size) record()       {}
+func (*Error) record()      {}
+func (*Mailbox) record()    {}
+func (*IMAPError) record()  {}
+func (*Field) record()      {}
+func (*ProbeError) record() {}
+func (*Interval) record()   {}
+func (*HostMetric) record() {}
+func (*Clock) record()      {}
+func (*Canary) record()     {}
+func (*Unknown) record()    {}
+
+// Topology returns w as worker of the topology.
+func (w *Worker) Topology() topology.Worker {
+	return topology.Worker{
+		Name:  w.Name,
+		Role:  w.Role,
+		Group: w.Group,
+	}
+}
+
+// Sample is everything a dump records about one Maildir.
+type Sample struct {
+	Path string
+
+	// Size, in the 1K blocks of 'du -s', is
+	// only valid if Error is empty.
+	Size  int64
+	Error string
+
+	// Interval is zero unless sampled adaptively.
+	Interval time.Duration
+
+	// Mailboxes and IMAPError are set by the IMAP probe,
+	// Fields and ProbeErrors by all further probes.
+	Mailboxes   []MailboxStatus
+	IMAPError   string
+	Fields      map[string]float64
+	ProbeErrors map[string]string
+}
+
+// FormatName returns the name of the dump taken at t:
+// the Unix seconds, with milliseconds appended as a
+// decimal fraction if the dump was not taken on a
+// full second.
+func FormatName(t time.Time) string {
+
+	ms := t.Nanosecond() / int(time.Millisecond)
+	if ms == 0 {
+		return fmt.Sprintf("%d", t.Unix())
+	}
+
+	return fmt.Sprintf("%d.%03d", t.Unix(), ms)
+}
+
+// ParseName returns the time a dump was taken at in
+// Unix seconds. It fails for files that are no dumps.
+func ParseName(name string) (float64, error) {
+
+	t, err := strconv.ParseFloat(name, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is no dump", name)
+	}
+
+	return t, nil
+}
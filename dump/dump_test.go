@@ -0,0 +1,190 @@
+package dump
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readGolden reads the golden dump testdata/name.
+func readGolden(t *testing.T, name string) []byte {
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func writeDump(t *testing.T, d *Dump, version int) []byte {
+
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteDump(d); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	for version, golden := range []string{"v0.dump", "v1.dump", "v2.dump"} {
+
+		data := readGolden(t, golden)
+
+		d, err := ReadDump(golden, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", golden, err)
+		}
+
+		if d.Version != version {
+			t.Errorf("%s: expected version %d, got %d", golden, version, d.Version)
+		}
+
+		// Runs are recorded from version 1 on.
+		if version == 0 && d.Run != nil {
+			t.Errorf("%s: expected no run, got %+v", golden, d.Run)
+		} else if version > 0 && (d.Run == nil || d.Run.ID != "r1") {
+			t.Errorf("%s: expected run r1, got %+v", golden, d.Run)
+		}
+
+		if got := writeDump(t, d, version); !bytes.Equal(got, data) {
+			t.Errorf("%s: written back as\n%s\nexpected\n%s", golden, got, data)
+		}
+	}
+}
+
+func TestWriteOlderVersion(t *testing.T) {
+
+	d, err := ReadDump("v2.dump", bytes.NewReader(readGolden(t, "v2.dump")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Phase != "warmup" {
+		t.Errorf("expected phase warmup, got %q", d.Phase)
+	}
+
+	// Older versions leave out what they do not know:
+	// version 1 the phase, version 0 the run as well.
+	for version, expected := range [][]byte{
+		readGolden(t, "v0.dump"),
+		readGolden(t, "v1.dump"),
+	} {
+		if got := writeDump(t, d, version); !bytes.Equal(got, expected) {
+			t.Errorf("version %d: written as\n%s\nexpected\n%s", version, got, expected)
+		}
+	}
+}
+
+func TestVersionError(t *testing.T) {
+
+	_, err := ReadDump("v3.dump", bytes.NewReader(readGolden(t, "v3.dump")))
+
+	verr, ok := err.(*VersionError)
+	if !ok {
+		t.Fatalf("expected *VersionError, got %v", err)
+	}
+	if verr.Version != 3 {
+		t.Errorf("expected version 3, got %d", verr.Version)
+	}
+
+	for _, version := range []int{-1, Version + 1} {
+		if _, err := NewWriter(ioutil.Discard, version); err == nil {
+			t.Errorf("expected an error for version %d", version)
+		}
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+
+	goldens := map[string]string{
+		"1500000000": "v0.dump",
+		"1500000001": "v1.dump",
+		"1500000002": "v2.dump",
+	}
+
+	for _, name := range []string{"1500000002-w1.zip", "1500000002-w1.tar", "1500000002-w1.tar.gz", "1500000002-w1.tar.zst"} {
+
+		if strings.HasSuffix(name, ".zst") {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				t.Logf("skipping %s: %v", name, err)
+				continue
+			}
+		}
+
+		p := filepath.Join("testdata", name)
+		data := readGolden(t, name)
+
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		opened := []struct {
+			how  string
+			open func() (*Archive, error)
+		}{
+			{"read", func() (*Archive, error) { return ReadArchive(ArchiveName(p), data) }},
+			{"opened", func() (*Archive, error) { return OpenArchive(ArchiveName(p), p) }},
+			{"spooled", func() (*Archive, error) { return SpoolArchive(ArchiveName(p), f) }},
+		}
+
+		for _, o := range opened {
+
+			a, err := o.open()
+			if err != nil {
+				t.Fatalf("%s %s: %v", o.how, name, err)
+			}
+
+			if a.Name != "1500000002-w1" {
+				t.Errorf("%s %s: unexpected name %q", o.how, name, a.Name)
+			}
+
+			read := 0
+			for _, file := range a.Files {
+
+				golden, ok := goldens[file.Name]
+				if !ok {
+					continue
+				}
+
+				got, err := file.ReadDump()
+				if err != nil {
+					t.Fatalf("%s %s: %s: %v", o.how, name, file.Name, err)
+				}
+
+				expected, err := ReadDump(file.Name, bytes.NewReader(readGolden(t, golden)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(got, expected) {
+					t.Errorf("%s %s: %s: expected %+v, got %+v", o.how, name, file.Name, expected, got)
+				}
+				read++
+			}
+
+			if read != len(goldens) {
+				t.Errorf("%s %s: expected %d dumps, found %d", o.how, name, len(goldens), read)
+			}
+
+			if err := a.Close(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
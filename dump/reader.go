@@ -0,0 +1,303 @@
+package dump
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyntaxError is a malformed line of a dump.
+type SyntaxError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+// Reader reads the records of a dump one at a time.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+	version int
+
+	// tabs is reused to split every line.
+	tabs []string
+}
+
+// NewReader returns a Reader reading a dump from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		scanner: bufio.NewScanner(r),
+	}
+}
+
+// Version returns the format version of the
+// dump, known once a record has been read.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Line returns the number of the line last read.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Next returns the next record of the dump or io.EOF at
+// its end. Malformed lines yield a *SyntaxError, versions
+// newer than this package knows a *VersionError. Calling
+// Next after a *SyntaxError skips the malformed line.
+func (r *Reader) Next() (Record, error) {
+
+	for r.scanner.Scan() {
+		r.line++
+
+		text := r.scanner.Text()
+		if text == "" {
+			continue
+		}
+
+		tabs := r.split(text)
+
+		if tabs[0] == "version" {
+			if r.line != 1 || len(tabs) != 2 {
+				return nil, r.syntaxError(text, fmt.Errorf("misplaced version"))
+			}
+
+			version, err := strconv.Atoi(tabs[1])
+			if err != nil || version < 1 {
+				return nil, r.syntaxError(text, fmt.Errorf("invalid version"))
+			}
+
+			if version > Version {
+				return nil, &VersionError{version}
+			}
+
+			r.version = version
+			continue
+		}
+
+		rec, err := parseRecord(tabs)
+		if err != nil {
+			return nil, r.syntaxError(text, err)
+		}
+
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// split splits text at its tabs. The fields returned are
+// valid until the next call, records keep none of them.
+func (r *Reader) split(text string) []string {
+
+	tabs := r.tabs[:0]
+	for {
+		i := strings.IndexByte(text, '\t')
+		if i < 0 {
+			break
+		}
+		tabs = append(tabs, text[:i])
+		text = text[i+1:]
+	}
+	r.tabs = append(tabs, text)
+
+	return r.tabs
+}
+
+func (r *Reader) syntaxError(text string, err error) *SyntaxError {
+	return &SyntaxError{
+		Line: r.line,
+		Text: text,
+		Err:  err,
+	}
+}
+
+// parseRecord parses the tab-separated fields of a line.
+func parseRecord(tabs []string) (Record, error) {
+
+	switch {
+	case len(tabs) == 2 && tabs[0] == "phase":
+		return &Phase{Name: tabs[1]}, nil
+
+	case len(tabs) == 2:
+		blocks, err := strconv.ParseInt(tabs[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size")
+		}
+		return &Size{Path: tabs[1], Blocks: blocks}, nil
+
+	case len(tabs) == 3 && tabs[0] == "run":
+		started, err := strconv.ParseInt(tabs[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start")
+		}
+		return &Run{ID: tabs[1], Started: time.Unix(started, 0)}, nil
+
+	case len(tabs) == 4 && tabs[0] == "worker":
+		return &Worker{Name: tabs[1], Role: tabs[2], Group: tabs[3]}, nil
+
+	case len(tabs) == 3 && tabs[0] == "error":
+		return &Error{Path: tabs[1], Message: tabs[2]}, nil
+
+	case len(tabs) == 7 && tabs[0] == "imap":
+		var counts [4]uint32
+		for i := range counts {
+			n, err := strconv.ParseUint(tabs[3+i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mailbox status")
+			}
+			counts[i] = uint32(n)
+		}
+		return &Mailbox{
+			Path: tabs[1],
+			MailboxStatus: MailboxStatus{
+				Mailbox:     tabs[2],
+				Messages:    counts[0],
+				UIDNext:     counts[1],
+				UIDValidity: counts[2],
+				Unseen:      counts[3],
+			},
+		}, nil
+
+	case len(tabs) == 3 && tabs[0] == "imap_error":
+		return &IMAPError{Path: tabs[1], Message: tabs[2]}, nil
+
+	case len(tabs) == 4 && tabs[0] == "field":
+		value, err := strconv.ParseFloat(tabs[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field value")
+		}
+		return &Field{Path: tabs[1], Name: tabs[2], Value: value}, nil
+
+	case len(tabs) == 4 && tabs[0] == "probe_error":
+		return &ProbeError{Path: tabs[1], Probe: tabs[2], Message: tabs[3]}, nil
+
+	case len(tabs) == 3 && tabs[0] == "interval":
+		secs, err := strconv.ParseFloat(tabs[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval")
+		}
+		return &Interval{Path: tabs[1], Interval: seconds(secs)}, nil
+
+	case len(tabs) == 3 && tabs[0] == "host":
+		value, err := strconv.ParseFloat(tabs[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host metric")
+		}
+		return &HostMetric{Name: tabs[1], Value: value}, nil
+
+	case len(tabs) == 4 && tabs[0] == "clock":
+		offset, err := strconv.ParseFloat(tabs[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock offset")
+		}
+		rtt, err := strconv.ParseFloat(tabs[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid round trip time")
+		}
+		return &Clock{Ref: tabs[1], Offset: seconds(offset), RTT: seconds(rtt)}, nil
+
+	case len(tabs) == 4 && tabs[0] == "canary":
+		sent, err := strconv.ParseFloat(tabs[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid canary send time")
+		}
+		latency, err := strconv.ParseFloat(tabs[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid canary latency")
+		}
+		return &Canary{ID: tabs[1], Sent: time.Unix(0, int64(sent*float64(time.Second))), Latency: seconds(latency)}, nil
+	}
+
+	return &Unknown{Line: strings.Join(tabs, "\t")}, nil
+}
+
+// seconds converts secs to a duration.
+func seconds(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+// ReadDump reads the whole dump called name from r,
+// merging all records of a Maildir into one sample.
+func ReadDump(name string, r io.Reader) (*Dump, error) {
+
+	d := &Dump{
+		Name: name,
+	}
+
+	samples := make(map[string]int)
+	sample := func(path string) *Sample {
+		i, ok := samples[path]
+		if !ok {
+			i = len(d.Samples)
+			samples[path] = i
+			d.Samples = append(d.Samples, Sample{Path: path})
+		}
+		return &d.Samples[i]
+	}
+
+	dr := NewReader(r)
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch rec := rec.(type) {
+		case *Run:
+			d.Run = rec
+		case *Worker:
+			d.Worker = rec
+		case *Phase:
+			d.Phase = rec.Name
+		case *Size:
+			sample(rec.Path).Size = rec.Blocks
+		case *Error:
+			sample(rec.Path).Error = rec.Message
+		case *Mailbox:
+			s := sample(rec.Path)
+			s.Mailboxes = append(s.Mailboxes, rec.MailboxStatus)
+		case *IMAPError:
+			sample(rec.Path).IMAPError = rec.Message
+		case *Field:
+			s := sample(rec.Path)
+			if s.Fields == nil {
+				s.Fields = make(map[string]float64)
+			}
+			s.Fields[rec.Name] = rec.Value
+		case *ProbeError:
+			s := sample(rec.Path)
+			if s.ProbeErrors == nil {
+				s.ProbeErrors = make(map[string]string)
+			}
+			s.ProbeErrors[rec.Probe] = rec.Message
+		case *Interval:
+			sample(rec.Path).Interval = rec.Interval
+		case *HostMetric:
+			d.Host = append(d.Host, *rec)
+		case *Clock:
+			d.Clock = append(d.Clock, *rec)
+		case *Canary:
+			d.Canaries = append(d.Canaries, *rec)
+		case *Unknown:
+			d.Unknown = append(d.Unknown, rec.Line)
+		}
+	}
+
+	d.Version = dr.Version()
+
+	return d, nil
+}
@@ -0,0 +1,277 @@
+package dump
+
+import (
+	"io"
+	"sort"
+)
+
+// Series is the dumps of one worker and run in time
+// order, gathered from one or more archives.
+type Series struct {
+	// Worker names the worker, Run is empty for
+	// the dumps of archives not recording it.
+	Worker string
+	Run    string
+	Dumps  []SeriesDump
+
+	// Duplicates counts the dumps dropped as they
+	// were found in more than one archive.
+	Duplicates int
+}
+
+// SeriesDump is one dump of a series.
+type SeriesDump struct {
+	Archive *Archive
+	File    File
+
+	// Index is that of File in Archive.Files.
+	Index int
+
+	// Time is the time the dump was taken
+	// at in Unix seconds, Run nil unless
+	// the dump records its run.
+	Time float64
+	Run  *Run
+
+	// Restart marks the first dump after
+	// the dumper restarted within the run,
+	// or, not knowing it, the first dump
+	// continuing those of another archive.
+	Restart bool
+}
+
+// ReadRun returns the run recorded in the first
+// line of the dump f, or nil if there is none.
+func ReadRun(f File) (*Run, error) {
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rec, err := NewReader(r).Next()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	run, _ := rec.(*Run)
+
+	return run, nil
+}
+
+// seriesKey identifies a series: dumps of the same worker
+// and run form one series, dumps without run one series
+// per archive.
+type seriesKey struct {
+	worker  string
+	run     string
+	archive int
+}
+
+// Stitch groups the dumps of archives into series in the
+// order they are found. workers holds the worker of each
+// archive if known, e.g. from the dumps or a topology.
+// Dumps recording their run are merged by worker and run
+// across archives, naming the worker after the archive,
+// '<unix>-<worker>', if unknown. Other dumps form one
+// series per archive, merged with those of other archives
+// of the same worker whose dumps overlap or continue them,
+// see stitchUnrecorded. Dumps found in several archives
+// are kept once, files that are no dumps skipped.
+// runs, if given, holds the run every dump of each
+// archive records by index, as read along with its
+// other records; otherwise Stitch reads it from the
+// first line of every dump. Dumps with a malformed
+// first line count as not recording their run.
+func Stitch(archives []*Archive, workers []string, runs [][]*Run) ([]*Series, error) {
+
+	var all []*Series
+	byKey := make(map[seriesKey]*Series)
+	seen := make(map[*Series]map[string]bool)
+
+	// unrecorded holds the worker of every series
+	// not recording its run, if known.
+	unrecorded := make(map[*Series]string)
+
+	for i, a := range archives {
+
+		worker := a.Name
+		if workers[i] != "" {
+			worker = workers[i]
+		}
+
+		for j, file := range a.Files {
+
+			t, err := ParseName(file.Name)
+			if err != nil {
+				continue
+			}
+
+			// A malformed first line leaves the run unknown,
+			// it is up to the reader of the dump to report it.
+			var run *Run
+			if runs != nil {
+				run = runs[i][j]
+			} else if run, err = ReadRun(file); err != nil {
+				if _, ok := err.(*SyntaxError); !ok {
+					return nil, err
+				}
+				run = nil
+			}
+
+			key := seriesKey{worker: worker, archive: i}
+			if run != nil {
+				key = seriesKey{worker: worker, run: run.ID, archive: -1}
+				if workers[i] == "" {
+					if name, _, ok := ArchiveWorker(a.Name); ok {
+						key.worker = name
+					}
+				}
+			}
+
+			s, ok := byKey[key]
+			if !ok {
+				s = &Series{
+					Worker: key.worker,
+					Run:    key.run,
+				}
+				byKey[key] = s
+				seen[s] = make(map[string]bool)
+				all = append(all, s)
+
+				if run == nil {
+					unrecorded[s] = workers[i]
+					if name, _, ok := ArchiveWorker(a.Name); ok && workers[i] == "" {
+						unrecorded[s] = name
+					}
+				}
+			}
+
+			if seen[s][file.Name] {
+				s.Duplicates++
+				continue
+			}
+			seen[s][file.Name] = true
+
+			s.Dumps = append(s.Dumps, SeriesDump{
+				Archive: a,
+				File:    file,
+				Index:   j,
+				Time:    t,
+				Run:     run,
+			})
+		}
+	}
+
+	for _, s := range all {
+		sort.SliceStable(s.Dumps, func(i, j int) bool {
+			return s.Dumps[i].Time < s.Dumps[j].Time
+		})
+	}
+
+	all = stitchUnrecorded(all, unrecorded, seen)
+
+	for _, s := range all {
+
+		for i := 1; i < len(s.Dumps); i++ {
+			prev, cur := s.Dumps[i-1].Run, s.Dumps[i].Run
+			if prev != nil && cur != nil && !prev.Started.Equal(cur.Started) {
+				s.Dumps[i].Restart = true
+			}
+		}
+	}
+
+	return all, nil
+}
+
+// stitchUnrecorded merges the series of archives not recording
+// their run by worker, as taken by a dumper restarted without
+// run ID or predating them, where the dumps of one archive
+// overlap or continue those of another: the later begins
+// before twice the usual spacing of the earlier's dumps has
+// passed since its end. Merged series are named after
+// their worker, the first dump after the end of an
+// archive is marked as restart.
+func stitchUnrecorded(all []*Series, unrecorded map[*Series]string, seen map[*Series]map[string]bool) []*Series {
+
+	byWorker := make(map[string][]*Series)
+	for _, s := range all {
+		if worker := unrecorded[s]; worker != "" && len(s.Dumps) > 0 {
+			byWorker[worker] = append(byWorker[worker], s)
+		}
+	}
+
+	merged := make(map[*Series]bool)
+
+	for worker, series := range byWorker {
+
+		sort.SliceStable(series, func(i, j int) bool {
+			return series[i].Dumps[0].Time < series[j].Dumps[0].Time
+		})
+
+		cur := series[0]
+		for _, s := range series[1:] {
+
+			last := cur.Dumps[len(cur.Dumps)-1].Time
+			if s.Dumps[0].Time > last+2*spacing(cur.Dumps) {
+				cur = s
+				continue
+			}
+
+			cur.Worker = worker
+			cur.Duplicates += s.Duplicates
+			merged[s] = true
+
+			restart := true
+			for _, d := range s.Dumps {
+				if seen[cur][d.File.Name] {
+					cur.Duplicates++
+					continue
+				}
+				seen[cur][d.File.Name] = true
+
+				if d.Time > last && restart {
+					d.Restart, restart = true, false
+				}
+				cur.Dumps = append(cur.Dumps, d)
+			}
+
+			sort.SliceStable(cur.Dumps, func(i, j int) bool {
+				return cur.Dumps[i].Time < cur.Dumps[j].Time
+			})
+		}
+	}
+
+	if len(merged) == 0 {
+		return all
+	}
+
+	kept := all[:0]
+	for _, s := range all {
+		if !merged[s] {
+			kept = append(kept, s)
+		}
+	}
+
+	return kept
+}
+
+// spacing returns the median spacing of dumps, zero if
+// there are less than two.
+func spacing(dumps []SeriesDump) float64 {
+
+	if len(dumps) < 2 {
+		return 0
+	}
+
+	spacings := make([]float64, len(dumps)-1)
+	for i := 1; i < len(dumps); i++ {
+		spacings[i-1] = dumps[i].Time - dumps[i-1].Time
+	}
+	sort.Float64s(spacings)
+
+	return spacings[len(spacings)/2]
+}
@@ -0,0 +1,95 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// testArchive returns an archive called name of dumps taken at
+// the given seconds, recording run if not empty.
+func testArchive(name string, run string, secs ...int) *Archive {
+
+	a := &Archive{
+		Name: name,
+	}
+
+	for _, sec := range secs {
+
+		data := "1024\t/maildirs/user1\n"
+		if run != "" {
+			data = fmt.Sprintf("version\t2\nrun\t%s\t1500000000\n", run) + data
+		}
+
+		a.Files = append(a.Files, File{
+			Name: fmt.Sprintf("%d", sec),
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader([]byte(data))), nil
+			},
+		})
+	}
+
+	return a
+}
+
+// describe returns worker, run and the dump times of every
+// series, marking restarts with '*'.
+func describe(series []*Series) []string {
+
+	var out []string
+	for _, s := range series {
+
+		desc := s.Worker + "/" + s.Run + ":"
+		for _, d := range s.Dumps {
+			desc += fmt.Sprintf(" %g", d.Time)
+			if d.Restart {
+				desc += "*"
+			}
+		}
+		out = append(out, desc)
+	}
+
+	return out
+}
+
+func TestStitchUnrecorded(t *testing.T) {
+
+	archives := []*Archive{
+		// Restarted once, continuing after a short gap.
+		testArchive("1500000010-w1", "", 1500000000, 1500000005, 1500000010),
+		testArchive("1500000030-w1", "", 1500000020, 1500000025, 1500000030),
+		// Uploaded the dumps of the previous start again.
+		testArchive("1500000040-w1", "", 1500000025, 1500000030, 1500000035, 1500000040),
+		// Started anew long after.
+		testArchive("1500001000-w1", "", 1500000990, 1500000995, 1500001000),
+		// Another worker at the same time.
+		testArchive("1500000010-w2", "", 1500000000, 1500000005, 1500000010),
+		// Not named after its worker.
+		testArchive("dumps", "", 1500000015, 1500000020),
+		// Recording its run.
+		testArchive("1500000015-w3", "r1", 1500000015, 1500000020),
+	}
+
+	series, err := Stitch(archives, make([]string, len(archives)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"w1/: 1.5e+09 1.500000005e+09 1.50000001e+09 1.50000002e+09* 1.500000025e+09 1.50000003e+09 1.500000035e+09* 1.50000004e+09",
+		"1500001000-w1/: 1.50000099e+09 1.500000995e+09 1.500001e+09",
+		"1500000010-w2/: 1.5e+09 1.500000005e+09 1.50000001e+09",
+		"dumps/: 1.500000015e+09 1.50000002e+09",
+		"w3/r1: 1.500000015e+09 1.50000002e+09",
+	}
+	if got := describe(series); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected\n%q\ngot\n%q", expected, got)
+	}
+
+	if series[0].Duplicates != 2 {
+		t.Errorf("expected 2 duplicates, got %d", series[0].Duplicates)
+	}
+}
@@ -0,0 +1,198 @@
+package dump
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clean keeps free text from breaking the line format.
+var clean = strings.NewReplacer("\t", " ", "\n", " ")
+
+// Writer writes the records of a dump one at a time.
+type Writer struct {
+	w       io.Writer
+	version int
+	started bool
+}
+
+// NewWriter returns a Writer writing a dump to w in the
+// format version, from 0 up to Version. Records that
+// version does not know are left out.
+func NewWriter(w io.Writer, version int) (*Writer, error) {
+
+	if version < 0 || version > Version {
+		return nil, &VersionError{version}
+	}
+
+	return &Writer{
+		w:       w,
+		version: version,
+	}, nil
+}
+
+// Write writes rec as one line, preceded
+// by the version line if it is the first.
+func (w *Writer) Write(rec Record) error {
+
+	if !w.started {
+		w.started = true
+		if w.version > 0 {
+			if _, err := fmt.Fprintf(w.w, "version\t%d\n", w.version); err != nil {
+				return err
+			}
+		}
+	}
+
+	var line string
+
+	switch rec := rec.(type) {
+	case *Run:
+		// Runs were introduced along with versions.
+		if w.version < 1 {
+			return nil
+		}
+		line = fmt.Sprintf("run\t%s\t%d", clean.Replace(rec.ID), rec.Started.Unix())
+	case *Worker:
+		line = fmt.Sprintf("worker\t%s\t%s\t%s", rec.Name, rec.Role, rec.Group)
+	case *Phase:
+		// Older readers take phases for malformed sizes.
+		if w.version < 2 {
+			return nil
+		}
+		line = fmt.Sprintf("phase\t%s", clean.Replace(rec.Name))
+	case *Size:
+		line = fmt.Sprintf("%d\t%s", rec.Blocks, rec.Path)
+	case *Error:
+		line = fmt.Sprintf("error\t%s\t%s", rec.Path, clean.Replace(rec.Message))
+	case *Mailbox:
+		line = fmt.Sprintf("imap\t%s\t%s\t%d\t%d\t%d\t%d", rec.Path, clean.Replace(rec.Mailbox),
+			rec.Messages, rec.UIDNext, rec.UIDValidity, rec.Unseen)
+	case *IMAPError:
+		line = fmt.Sprintf("imap_error\t%s\t%s", rec.Path, clean.Replace(rec.Message))
+	case *Field:
+		line = fmt.Sprintf("field\t%s\t%s\t%s", rec.Path, clean.Replace(rec.Name), formatFloat(rec.Value))
+	case *ProbeError:
+		line = fmt.Sprintf("probe_error\t%s\t%s\t%s", rec.Path, rec.Probe, clean.Replace(rec.Message))
+	case *Interval:
+		line = fmt.Sprintf("interval\t%s\t%s", rec.Path, formatFloat(rec.Interval.Seconds()))
+	case *HostMetric:
+		line = fmt.Sprintf("host\t%s\t%s", rec.Name, formatFloat(rec.Value))
+	case *Clock:
+		line = fmt.Sprintf("clock\t%s\t%s\t%s", rec.Ref, formatFloat(rec.Offset.Seconds()), formatFloat(rec.RTT.Seconds()))
+	case *Canary:
+		line = fmt.Sprintf("canary\t%s\t%s\t%s", rec.ID,
+			strconv.FormatFloat(float64(rec.Sent.UnixNano())/float64(time.Second), 'f', 6, 64),
+			formatFloat(rec.Latency.Seconds()))
+	case *Unknown:
+		line = rec.Line
+	default:
+		return fmt.Errorf("unknown record %T", rec)
+	}
+
+	_, err := io.WriteString(w.w, line+"\n")
+
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// WriteDump writes all records of d: its run, worker and phase,
+// per sample the size or error, IMAP status, fields sorted
+// by name, failed probes and interval, then host metrics,
+// clock offsets, canaries and unknown lines.
+func (w *Writer) WriteDump(d *Dump) error {
+
+	var recs []Record
+
+	if d.Run != nil {
+		recs = append(recs, d.Run)
+	}
+
+	if d.Worker != nil {
+		recs = append(recs, d.Worker)
+	}
+
+	if d.Phase != "" {
+		recs = append(recs, &Phase{d.Phase})
+	}
+
+	for _, s := range d.Samples {
+		recs = append(recs, sampleRecords(s)...)
+	}
+
+	for i := range d.Host {
+		recs = append(recs, &d.Host[i])
+	}
+
+	for i := range d.Clock {
+		recs = append(recs, &d.Clock[i])
+	}
+
+	for i := range d.Canaries {
+		recs = append(recs, &d.Canaries[i])
+	}
+
+	for _, line := range d.Unknown {
+		recs = append(recs, &Unknown{line})
+	}
+
+	for _, rec := range recs {
+		if err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sampleRecords returns the records of s.
+func sampleRecords(s Sample) []Record {
+
+	var recs []Record
+
+	if s.Error != "" {
+		recs = append(recs, &Error{s.Path, s.Error})
+	} else {
+		recs = append(recs, &Size{s.Path, s.Size})
+	}
+
+	if s.IMAPError != "" {
+		recs = append(recs, &IMAPError{s.Path, s.IMAPError})
+	} else {
+		for _, m := range s.Mailboxes {
+			recs = append(recs, &Mailbox{s.Path, m})
+		}
+	}
+
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		recs = append(recs, &Field{s.Path, name, s.Fields[name]})
+	}
+
+	probes := make([]string, 0, len(s.ProbeErrors))
+	for probe := range s.ProbeErrors {
+		probes = append(probes, probe)
+	}
+	sort.Strings(probes)
+
+	for _, probe := range probes {
+		recs = append(recs, &ProbeError{s.Path, probe, s.ProbeErrors[probe]})
+	}
+
+	if s.Interval > 0 {
+		recs = append(recs, &Interval{s.Path, s.Interval})
+	}
+
+	return recs
+}
@@ -0,0 +1,163 @@
+// Package topology describes the workers of a replicated
+// cluster, their roles, replica groups and users, as read
+// from a JSON topology file shared by dumper and visualizer.
+//
+// A topology file looks like this:
+//
+//	{
+//	  "workers": [
+//	    {"name": "worker-1", "role": "primary", "group": "a", "storage": "storage-1", "users": ["user1@example.com"]},
+//	    {"name": "worker-2", "role": "replica", "group": "a", "storage": "storage-2", "users": ["user1@example.com"]},
+//	    {"name": "storage-1", "role": "storage"}
+//	  ]
+//	}
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Roles a worker can have.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+	RoleStorage = "storage"
+)
+
+// Worker is a single node of the cluster.
+type Worker struct {
+	// Name is the worker name the
+	// dumper on this node runs with.
+	Name string `json:"name"`
+
+	// Role is one of RolePrimary, RoleReplica and RoleStorage.
+	Role string `json:"role"`
+
+	// Group is the replica group the worker belongs to.
+	// All workers of one group hold the same users.
+	Group string `json:"group,omitempty"`
+
+	// Storage names the storage node backing the worker.
+	Storage string `json:"storage,omitempty"`
+
+	// Users lists the users the worker serves.
+	Users []string `json:"users,omitempty"`
+}
+
+// Topology is the set of all workers of a cluster.
+type Topology struct {
+	Workers []Worker `json:"workers"`
+}
+
+// Load reads and validates the topology file at path.
+func Load(path string) (*Topology, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var t Topology
+	if err := json.NewDecoder(f).Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to parse topology %s: %v", path, err)
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %v", path, err)
+	}
+
+	return &t, nil
+}
+
+// Validate checks that worker names are unique, roles are
+// known and that every replica group has one primary.
+func (t *Topology) Validate() error {
+
+	names := make(map[string]bool)
+	primaries := make(map[string]int)
+
+	for _, w := range t.Workers {
+
+		if w.Name == "" {
+			return fmt.Errorf("worker without name")
+		}
+
+		if names[w.Name] {
+			return fmt.Errorf("duplicate worker %q", w.Name)
+		}
+		names[w.Name] = true
+
+		switch w.Role {
+		case RolePrimary:
+			primaries[w.Group]++
+		case RoleReplica, RoleStorage:
+		default:
+			return fmt.Errorf("worker %q has unknown role %q", w.Name, w.Role)
+		}
+	}
+
+	for _, w := range t.Workers {
+
+		if w.Role != RoleReplica {
+			continue
+		}
+
+		if primaries[w.Group] == 0 {
+			return fmt.Errorf("replica group %q of worker %q has no primary", w.Group, w.Name)
+		}
+	}
+
+	for group, n := range primaries {
+		if n > 1 {
+			return fmt.Errorf("replica group %q has %d primaries", group, n)
+		}
+	}
+
+	return nil
+}
+
+// Worker returns the worker called name.
+func (t *Topology) Worker(name string) (Worker, bool) {
+
+	for _, w := range t.Workers {
+		if w.Name == name {
+			return w, true
+		}
+	}
+
+	return Worker{}, false
+}
+
+// Primary returns the primary of group.
+func (t *Topology) Primary(group string) (Worker, bool) {
+
+	for _, w := range t.Workers {
+		if w.Role == RolePrimary && w.Group == group {
+			return w, true
+		}
+	}
+
+	return Worker{}, false
+}
+
+// Groups returns the names of all replica groups, sorted.
+func (t *Topology) Groups() []string {
+
+	seen := make(map[string]bool)
+	var groups []string
+
+	for _, w := range t.Workers {
+		if w.Role != RoleStorage && !seen[w.Group] {
+			seen[w.Group] = true
+			groups = append(groups, w.Group)
+		}
+	}
+
+	sort.Strings(groups)
+
+	return groups
+}